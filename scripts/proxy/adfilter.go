@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/lunatv/proxy-script/hls"
+)
+
+// ===== Ad Filter =====
+//
+// CMS sources splice ad blocks into VOD playlists. The blocks are bounded by
+// EXT-X-DISCONTINUITY and usually come from a different host or path prefix
+// than the main content. Each discontinuity block is scored by a few
+// heuristics and blocks that look like ads are removed.
+
+const (
+	AdMaxBlockDuration = 180.0 // Longer blocks are never treated as ads (seconds)
+	AdOddBlockDuration = 60.0  // Only short blocks are judged by odd durations (seconds)
+	AdMaxRemovedRatio  = 0.3   // Never remove more than this share of the playlist
+	AdScoreThreshold   = 3
+)
+
+var adURLPattern = regexp.MustCompile(`(?i)(/ads?/|/adv(ert)?s?/|adjump|guanggao|/gg/|[_\-/]ad[_\-]?\d*\.ts)`)
+
+type adFilterReport struct {
+	Segments int
+	Blocks   int
+	Duration float64
+}
+
+func (r *adFilterReport) String() string {
+	return fmt.Sprintf("removed=%d; blocks=%d; duration=%.1f", r.Segments, r.Blocks, r.Duration)
+}
+
+type segmentOrigin struct {
+	host string
+	dir  string
+}
+
+type adBlock struct {
+	start, end int // Segment index range [start, end)
+	duration   float64
+}
+
+// stripAds removes ad blocks from a VOD playlist in place.
+// It returns nil when nothing was removed.
+func stripAds(p *hls.MediaPlaylist, playlistURL string) *adFilterReport {
+	if !p.Endlist && !strings.EqualFold(p.PlaylistType, "VOD") {
+		return nil
+	}
+	blocks := splitDiscontinuityBlocks(p.Segments)
+	if len(blocks) < 2 {
+		return nil
+	}
+
+	origins := make([]segmentOrigin, len(p.Segments))
+	hostDur := make(map[string]float64)
+	for i, s := range p.Segments {
+		if u, err := url.Parse(resolveURL(playlistURL, s.URI)); err == nil {
+			origins[i] = segmentOrigin{host: strings.ToLower(u.Host), dir: path.Dir(u.Path)}
+		}
+		hostDur[origins[i].host] += s.Duration
+	}
+	main := segmentOrigin{host: heaviest(hostDur)}
+	dirDur := make(map[string]float64)
+	for i, s := range p.Segments {
+		if origins[i].host == main.host {
+			dirDur[origins[i].dir] += s.Duration
+		}
+	}
+	main.dir = heaviest(dirDur)
+	typical := typicalDuration(p.Segments, origins, main)
+
+	total := p.Duration()
+	drop := make([]bool, len(p.Segments))
+	report := &adFilterReport{}
+	for _, b := range blocks {
+		if b.duration > AdMaxBlockDuration || report.Duration+b.duration > total*AdMaxRemovedRatio {
+			continue
+		}
+		if score, signal := scoreAdBlock(p.Segments, origins, b, main, typical); score < AdScoreThreshold || !signal {
+			continue
+		}
+		for i := b.start; i < b.end; i++ {
+			drop[i] = true
+		}
+		report.Blocks++
+		report.Segments += b.end - b.start
+		report.Duration += b.duration
+	}
+	if report.Segments == 0 {
+		return nil
+	}
+	p.RemoveSegments(func(i int, _ *hls.Segment) bool { return drop[i] })
+	return report
+}
+
+func splitDiscontinuityBlocks(segs []*hls.Segment) []adBlock {
+	var blocks []adBlock
+	cur := adBlock{}
+	for i, s := range segs {
+		if s.Discontinuity && i > cur.start {
+			cur.end = i
+			blocks = append(blocks, cur)
+			cur = adBlock{start: i}
+		}
+		cur.duration += s.Duration
+	}
+	if len(segs) > cur.start {
+		cur.end = len(segs)
+		blocks = append(blocks, cur)
+	}
+	return blocks
+}
+
+// scoreAdBlock sums the evidence that a block is an ad:
+// foreign host (3), foreign path prefix (2), ad-like URL (3) and, for short
+// blocks, durations that do not match the main content (1).
+// Sources may serve part of their content from another CDN host, so signal
+// reports whether there is evidence besides the origin: the URL, the
+// durations, or a short block spliced in before a discontinuity, which
+// includes pre-rolls.
+func scoreAdBlock(segs []*hls.Segment, origins []segmentOrigin, b adBlock, main segmentOrigin, typical float64) (score int, signal bool) {
+	foreignHost, foreignDir, odd, pattern := true, true, 0, false
+	for i := b.start; i < b.end; i++ {
+		if origins[i].host == main.host {
+			foreignHost = false
+			if origins[i].dir == main.dir {
+				foreignDir = false
+			}
+		}
+		if adURLPattern.MatchString(segs[i].URI) {
+			pattern = true
+		}
+		if typical > 0 && math.Abs(segs[i].Duration-typical) > 0.5 {
+			odd++
+		}
+	}
+	short := b.duration <= AdOddBlockDuration
+	if foreignHost {
+		score += 3
+	} else if foreignDir {
+		score += 2
+	}
+	if pattern {
+		score += 3
+	}
+	if short && odd*2 > b.end-b.start {
+		score++
+		signal = true
+	}
+	spliced := short && b.end < len(segs)
+	return score, signal || pattern || spliced
+}
+
+// typicalDuration returns the most common (0.1s-rounded) duration of the
+// main content's segments.
+func typicalDuration(segs []*hls.Segment, origins []segmentOrigin, main segmentOrigin) float64 {
+	counts := make(map[float64]int)
+	best, bestCount := 0.0, 0
+	for i, s := range segs {
+		if origins[i] != main {
+			continue
+		}
+		d := math.Round(s.Duration*10) / 10
+		counts[d]++
+		if c := counts[d]; c > bestCount || (c == bestCount && d > best) {
+			best, bestCount = d, c
+		}
+	}
+	return best
+}
+
+func heaviest(weights map[string]float64) string {
+	best, bestWeight := "", -1.0
+	for k, w := range weights {
+		if w > bestWeight || (w == bestWeight && k < best) {
+			best, bestWeight = k, w
+		}
+	}
+	return best
+}
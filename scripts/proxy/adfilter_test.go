@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type testBlock struct {
+	prefix   string // Segment URI prefix, absolute or relative to the playlist
+	count    int
+	duration float64
+}
+
+// vodPlaylist builds a VOD playlist with a discontinuity between blocks.
+func vodPlaylist(blocks ...testBlock) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-PLAYLIST-TYPE:VOD\n")
+	n := 0
+	for i, blk := range blocks {
+		if i > 0 {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		for j := 0; j < blk.count; j++ {
+			fmt.Fprintf(&b, "#EXTINF:%g,\n%s%d.ts\n", blk.duration, blk.prefix, n)
+			n++
+		}
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String()
+}
+
+func TestStripAds(t *testing.T) {
+	const playlistURL = "https://cdn.example.com/v/index.m3u8"
+	tests := []struct {
+		name    string
+		blocks  []testBlock
+		removed int
+	}{
+		{
+			name:    "spliced foreign block with odd durations",
+			blocks:  []testBlock{{"seg", 10, 4}, {"https://ads.example.net/x/", 3, 5}, {"seg", 10, 4}},
+			removed: 3,
+		},
+		{
+			name:    "ad keyword in path",
+			blocks:  []testBlock{{"seg", 10, 4}, {"/ad/", 2, 4}, {"seg", 10, 4}},
+			removed: 2,
+		},
+		{
+			name:    "pre-roll from another host",
+			blocks:  []testBlock{{"https://media.promo.example.net/p/", 3, 4}, {"seg", 20, 4}},
+			removed: 3,
+		},
+		{
+			name:    "trailing block from another CDN host",
+			blocks:  []testBlock{{"seg", 15, 4}, {"https://cdn2.example.net/v/seg", 5, 4}},
+			removed: 0,
+		},
+		{
+			name:    "long foreign block",
+			blocks:  []testBlock{{"seg", 60, 4}, {"https://ads.example.net/", 40, 5}, {"seg", 60, 4}},
+			removed: 0,
+		},
+		{
+			name:    "more than the removal cap",
+			blocks:  []testBlock{{"seg", 2, 4}, {"https://ads.example.net/ad/", 3, 5}, {"seg", 2, 4}},
+			removed: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := decodeMedia(t, vodPlaylist(tt.blocks...))
+			before := len(p.Segments)
+			report := stripAds(p, playlistURL)
+			if got := before - len(p.Segments); got != tt.removed {
+				t.Fatalf("removed %d segments, want %d (report %v)", got, tt.removed, report)
+			}
+			if (report != nil) != (tt.removed > 0) {
+				t.Errorf("report = %v", report)
+			}
+		})
+	}
+}
+
+func TestStripAdsLive(t *testing.T) {
+	in := strings.Replace(vodPlaylist(testBlock{"seg", 10, 4}, testBlock{"https://ads.example.net/ad/", 2, 5}, testBlock{"seg", 10, 4}), "#EXT-X-PLAYLIST-TYPE:VOD\n", "", 1)
+	in = strings.Replace(in, "#EXT-X-ENDLIST\n", "", 1)
+	p := decodeMedia(t, in)
+	if report := stripAds(p, "https://cdn.example.com/v/index.m3u8"); report != nil || len(p.Segments) != 22 {
+		t.Errorf("live playlist filtered: %v, %d segments", report, len(p.Segments))
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== Admin API =====
+//
+// Authenticated with "Authorization: Bearer <token>" (-admin-token or
+// PROXY_ADMIN_TOKEN). Without a token the endpoints are disabled, except in
+// dev mode.
+//
+//	GET  /api/proxy/admin/cache/stats (also at /api/proxy/stats)
+//	GET  /api/proxy/admin/cache/keys?source=&host=&prefix=&limit=
+//	POST /api/proxy/admin/cache/purge?key=&source=&host=&prefix=
+//	GET  /api/proxy/admin/config
+//	POST /api/proxy/admin/config/reload
+//
+// Cache keys are "source|url" plus optional "|..." suffixes (byte range,
+// decryption). prefix matches the start of the URL part.
+
+const DefaultAdminListLimit = 200
+
+var (
+	adminToken string
+	purgeMu    sync.Mutex // Serializes purges so generations are bumped one at a time
+)
+
+type cacheFilter struct {
+	Key    string
+	Source string
+	Host   string
+	Prefix string
+}
+
+func parseCacheFilter(q url.Values) cacheFilter {
+	return cacheFilter{Key: q.Get("key"), Source: q.Get("source"), Host: strings.ToLower(q.Get("host")), Prefix: q.Get("prefix")}
+}
+
+func (f cacheFilter) empty() bool {
+	return f == cacheFilter{}
+}
+
+// splitCacheKey splits a cache key into its moontv-source and target URL.
+func splitCacheKey(key string) (source, target string) {
+	source, rest, _ := strings.Cut(key, "|")
+	target, _, _ = strings.Cut(rest, "|")
+	return source, target
+}
+
+func (f cacheFilter) match(key string) bool {
+	if f.Key != "" && key != f.Key {
+		return false
+	}
+	source, target := splitCacheKey(key)
+	if f.Source != "" && source != f.Source {
+		return false
+	}
+	if f.Prefix != "" && !strings.HasPrefix(target, f.Prefix) {
+		return false
+	}
+	if f.Host != "" {
+		u, err := url.Parse(target)
+		if err != nil || strings.ToLower(u.Hostname()) != f.Host {
+			return false
+		}
+	}
+	return true
+}
+
+type cacheEntryInfo struct {
+	Key       string    `json:"key"`
+	Tier      string    `json:"tier"`
+	Bytes     int64     `json:"bytes"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (c *LRUCache) entries(tier string, match func(key string) bool) []cacheEntryInfo {
+	c.Lock()
+	defer c.Unlock()
+	var out []cacheEntryInfo
+	for key, ent := range c.items {
+		if match(key) {
+			item := ent.Value.(*CacheItem)
+			out = append(out, cacheEntryInfo{Key: key, Tier: tier, Bytes: item.SizeBytes, ExpiresAt: item.ExpiresAt})
+		}
+	}
+	return out
+}
+
+func (d *DiskCache) entries(match func(key string) bool) []cacheEntryInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var out []cacheEntryInfo
+	for key, ent := range d.items {
+		if match(key) {
+			e := ent.Value.(*diskEntry)
+			out = append(out, cacheEntryInfo{Key: key, Tier: "disk", Bytes: e.sizeBytes, ExpiresAt: e.expiresAt})
+		}
+	}
+	return out
+}
+
+// purgeCaches removes matching entries from every tier. The generation is
+// bumped first, so fills and promotions that started earlier can't write
+// purged data back; in-flight fetches are detached so newcomers refetch.
+func purgeCaches(match func(key string) bool) map[string]int {
+	purgeMu.Lock()
+	defer purgeMu.Unlock()
+	cacheGeneration.Add(1)
+	res := map[string]int{
+		"inflight": segmentFills.forgetMatching(match),
+		"memory":   globalSegmentCache.Purge(match),
+	}
+	res["inflight"] += sfGroup.ForgetMatching(func(key string) bool {
+		_, k, ok := strings.Cut(key, "|") // "key|..." and "m3u8|..."
+		return ok && match(k)
+	})
+	res["keys"] = globalKeyCache.Purge(match)
+	res["playlists"] = globalPlaylistCache.Purge(match)
+	res["negative"] = negativeCache.Purge(match)
+	if diskTier != nil {
+		res["disk"] = diskTier.Purge(match)
+	}
+	return res
+}
+
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !devMode {
+			if adminToken == "" {
+				http.Error(w, "Admin API disabled", 404)
+				return
+			}
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="proxy-admin"`)
+				http.Error(w, "Unauthorized", 401)
+				return
+			}
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	stats := map[string]interface{}{
+		"generation":    cacheGeneration.Load(),
+		"segments":      globalSegmentCache.snapshot(),
+		"segmentPolicy": globalSegmentCache.policySnapshot(),
+		"keys":          globalKeyCache.snapshot(),
+		"playlists":     globalPlaylistCache.snapshot(),
+		"coalesce":      fillStats.snapshot(),
+		"policy":        policyStats.snapshot(),
+		"negative":      negativeCache.snapshot(),
+	}
+	if diskTier != nil {
+		stats["disk"] = diskTier.snapshot()
+	}
+	if prefetch != nil {
+		stats["prefetch"] = prefetch.snapshot()
+	}
+	if tracer != nil {
+		stats["tracing"] = tracer.snapshot()
+	}
+	stats["egress"] = getConfig().egress.snapshot()
+	stats["dns"] = dnsCache.snapshot()
+	writeJSON(w, stats)
+}
+
+func handleAdminKeys(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := parseCacheFilter(q)
+	limit := DefaultAdminListLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", 400)
+			return
+		}
+		limit = n
+	}
+
+	list := globalSegmentCache.entries("memory", f.match)
+	list = append(list, globalKeyCache.entries("keys", f.match)...)
+	list = append(list, globalPlaylistCache.entries("playlists", f.match)...)
+	list = append(list, negativeCache.entries(f.match)...)
+	if diskTier != nil {
+		list = append(list, diskTier.entries(f.match)...)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Key != list[j].Key {
+			return list[i].Key < list[j].Key
+		}
+		return list[i].Tier < list[j].Tier
+	})
+	total := len(list)
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	writeJSON(w, map[string]interface{}{"total": total, "entries": list})
+}
+
+func handleAdminPurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	f := parseCacheFilter(r.URL.Query())
+	if f.empty() {
+		http.Error(w, "Missing key, source, host or prefix", 400)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"purged": purgeCaches(f.match)})
+}
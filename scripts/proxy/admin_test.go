@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatsRequireAdmin(t *testing.T) {
+	old := adminToken
+	adminToken = "admin-secret"
+	t.Cleanup(func() { adminToken = old })
+	h := requireAdmin(handleAdminStats)
+
+	for _, auth := range []string{"", "Bearer wrong"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/proxy/stats", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		h(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status %d, want 401", auth, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/proxy/stats", nil)
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	h(w, r)
+	var stats map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range []string{"segments", "coalesce", "negative", "dns"} {
+		if _, ok := stats[section]; !ok {
+			t.Errorf("stats lack %q", section)
+		}
+	}
+}
+
+func TestCacheFilter(t *testing.T) {
+	const key = "live|https://CDN.example.com/v/0.ts|range=0-99"
+	tests := []struct {
+		filter cacheFilter
+		want   bool
+	}{
+		{cacheFilter{Key: key}, true},
+		{cacheFilter{Key: "live|https://CDN.example.com/v/0.ts"}, false},
+		{cacheFilter{Source: "live"}, true},
+		{cacheFilter{Source: "vod"}, false},
+		{cacheFilter{Host: "cdn.example.com"}, true},
+		{cacheFilter{Host: "example.com"}, false},
+		{cacheFilter{Prefix: "https://CDN.example.com/v/"}, true},
+		{cacheFilter{Prefix: "https://CDN.example.com/w/"}, false},
+		{cacheFilter{Source: "live", Host: "other.example.com"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.match(key); got != tt.want {
+			t.Errorf("%+v matched %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestAdminPurge(t *testing.T) {
+	gen := cacheGeneration.Load()
+	globalSegmentCache.Set("purge-a|https://cdn.example.com/0.ts", []byte("x"), nil, time.Hour)
+	globalSegmentCache.Set("purge-b|https://cdn.example.com/0.ts", []byte("x"), nil, time.Hour)
+	negativeCache.RecordStatus(gen, "purge-a|https://cdn.example.com/1.ts", 404)
+	t.Cleanup(func() { purgeCaches(func(k string) bool { return k == "purge-b|https://cdn.example.com/0.ts" }) })
+
+	list := func(source string) float64 {
+		w := httptest.NewRecorder()
+		handleAdminKeys(w, httptest.NewRequest("GET", "/api/proxy/admin/cache/keys?source="+source, nil))
+		var res map[string]any
+		json.NewDecoder(w.Body).Decode(&res)
+		total, _ := res["total"].(float64)
+		return total
+	}
+	if n := list("purge-a"); n != 2 {
+		t.Fatalf("listed %v entries, want 2", n)
+	}
+
+	w := httptest.NewRecorder()
+	handleAdminPurge(w, httptest.NewRequest("GET", "/api/proxy/admin/cache/purge?source=purge-a", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET purge: status %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handleAdminPurge(w, httptest.NewRequest("POST", "/api/proxy/admin/cache/purge", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unfiltered purge: status %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handleAdminPurge(w, httptest.NewRequest("POST", "/api/proxy/admin/cache/purge?source=purge-a", nil))
+	var res struct{ Purged map[string]int }
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Purged["memory"] != 1 || res.Purged["negative"] != 1 {
+		t.Errorf("purged %v", res.Purged)
+	}
+	if list("purge-a") != 0 || list("purge-b") != 1 {
+		t.Error("purge matched the wrong entries")
+	}
+	if cacheGeneration.Load() == gen {
+		t.Error("purge did not bump the generation")
+	}
+}
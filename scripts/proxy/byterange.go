@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lunatv/proxy-script/hls"
+)
+
+// ===== Byte Ranges =====
+//
+// Playlists using EXT-X-BYTERANGE point many segments at one large file.
+// When such a segment is proxied its sub-range becomes the signed "range"
+// parameter ("<first>-<last>", inclusive) and part of the cache key, so every
+// sub-range is cached like a standalone segment.
+
+type segmentRange struct {
+	first, last int64 // Inclusive byte offsets
+}
+
+func (s *segmentRange) length() int64  { return s.last - s.first + 1 }
+func (s *segmentRange) String() string { return fmt.Sprintf("%d-%d", s.first, s.last) }
+
+// rangeExtras adds the signed "range" parameter for br to extras.
+func rangeExtras(extras url.Values, br *hls.ByteRange) url.Values {
+	if br == nil || br.Length <= 0 {
+		return extras
+	}
+	if extras == nil {
+		extras = url.Values{}
+	}
+	extras.Set("range", (&segmentRange{first: br.Offset, last: br.End() - 1}).String())
+	return extras
+}
+
+func parseSegmentRange(v string) (*segmentRange, error) {
+	if v == "" {
+		return nil, nil
+	}
+	a, b, ok := strings.Cut(v, "-")
+	first, err1 := strconv.ParseInt(a, 10, 64)
+	last, err2 := strconv.ParseInt(b, 10, 64)
+	if !ok || err1 != nil || err2 != nil || first < 0 || last < first {
+		return nil, errors.New("invalid range")
+	}
+	sub := &segmentRange{first: first, last: last}
+	if sub.length() > MaxSegmentSize {
+		return nil, errors.New("range too large")
+	}
+	return sub, nil
+}
+
+// openSubRange positions a response to a "Range: bytes=" request at sub and
+// returns a reader for exactly sub.length() bytes. Upstreams that ignore Range
+// and answer 200 are skipped forward instead.
+func openSubRange(resp *http.Response, sub *segmentRange) (io.Reader, error) {
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var first, last int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/", &first, &last); err != nil || first != sub.first || last < sub.last {
+			return nil, fmt.Errorf("unexpected content-range %q", resp.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		if _, err := io.CopyN(io.Discard, resp.Body, sub.first); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return &exactReader{r: resp.Body, remaining: sub.length()}, nil
+}
+
+// exactReader reads exactly remaining bytes and reports a short body as
+// io.ErrUnexpectedEOF, so a truncated sub-range is never cached.
+type exactReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.remaining {
+		p = p[:e.remaining]
+	}
+	n, err := e.r.Read(p)
+	e.remaining -= int64(n)
+	if err == io.EOF && e.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lunatv/proxy-script/hls"
+)
+
+func TestParseSegmentRange(t *testing.T) {
+	tests := map[string]string{
+		"":        "<nil>",
+		"0-99":    "0-99",
+		"100-100": "100-100",
+		"5":       "error",
+		"-1-5":    "error",
+		"10-5":    "error",
+		"a-b":     "error",
+	}
+	tests["0-"+strconv.Itoa(MaxSegmentSize)] = "error" // One byte over
+	for in, want := range tests {
+		sub, err := parseSegmentRange(in)
+		got := "error"
+		if err == nil {
+			got = "<nil>"
+			if sub != nil {
+				got = sub.String()
+			}
+		}
+		if got != want {
+			t.Errorf("parseSegmentRange(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestRangeExtras(t *testing.T) {
+	if got := rangeExtras(nil, &hls.ByteRange{Length: 100, Offset: 200}).Get("range"); got != "200-299" {
+		t.Errorf("range = %q", got)
+	}
+	if got := rangeExtras(nil, nil); got != nil {
+		t.Errorf("no byte range: %v", got)
+	}
+}
+
+func TestOpenSubRange(t *testing.T) {
+	const body = "0123456789"
+	sub := &segmentRange{first: 2, last: 5}
+	tests := []struct {
+		name   string
+		status int
+		cr     string
+		body   string
+		want   string // "error" if opening or reading fails
+	}{
+		{"partial content", 206, "bytes 2-5/10", "2345", "2345"},
+		{"range ignored", 200, "", body, "2345"},
+		{"longer partial", 206, "bytes 2-9/10", "23456789", "2345"},
+		{"wrong offset", 206, "bytes 0-5/10", "012345", "error"},
+		{"short body", 206, "bytes 2-5/10", "23", "error"},
+		{"short full body", 200, "", "012", "error"},
+		{"not found", 404, "", "", "error"},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Header: http.Header{"Content-Range": {tt.cr}}, Body: io.NopCloser(strings.NewReader(tt.body))}
+		got := "error"
+		if r, err := openSubRange(resp, sub); err == nil {
+			if data, err := io.ReadAll(r); err == nil {
+				got = string(data)
+			}
+		}
+		if got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ===== Segment Cache Policy =====
+//
+// Segment freshness follows the upstream response (RFC 9111 §4.2):
+// s-maxage, then max-age, then Expires, each less the response's Age. no-store
+// and private responses are never stored, no-cache ones are stored stale.
+// Without explicit freshness a Last-Modified date gives 10% of the object's
+// age, and otherwise SegmentTTL (InitSegmentTTL for EXT-X-MAP) applies.
+//
+// Stale entries with an ETag or Last-Modified are kept for
+// SegmentStaleRetention and revalidated with a conditional request; a 304
+// refreshes them without moving the body again.
+
+const (
+	MaxSegmentTTL         = 24 * time.Hour
+	SegmentStaleRetention = 10 * time.Minute
+	HeuristicFreshness    = 0.1 // Share of (Date - Last-Modified) a response stays fresh
+)
+
+// Request headers a shared fetch must not inherit from the viewer.
+var conditionalHeaders = []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"}
+
+type cachePolicyStats struct {
+	Uncacheable   atomic.Int64 // Responses not stored because of no-store/private
+	Revalidations atomic.Int64 // Conditional requests for stale entries
+	NotModified   atomic.Int64 // Revalidations answered with 304
+}
+
+var policyStats cachePolicyStats
+
+func (s *cachePolicyStats) snapshot() map[string]int64 {
+	return map[string]int64{
+		"uncacheable":   s.Uncacheable.Load(),
+		"revalidations": s.Revalidations.Load(),
+		"notModified":   s.NotModified.Load(),
+	}
+}
+
+func parseCacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, line := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func hasValidators(h http.Header) bool {
+	return h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+}
+
+// freshnessTTL returns how much longer a response received now stays fresh,
+// and whether it may be stored at all.
+func freshnessTTL(h http.Header, fallback time.Duration, now time.Time) (time.Duration, bool) {
+	cc := parseCacheControl(h)
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["private"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return 0, true
+	}
+
+	date := now
+	if d, err := http.ParseTime(h.Get("Date")); err == nil {
+		date = d
+	}
+	age := now.Sub(date)
+	if a, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && time.Duration(a)*time.Second > age {
+		age = time.Duration(a) * time.Second
+	}
+	if age < 0 {
+		age = 0
+	}
+
+	var lifetime time.Duration
+	if v, ok := cc["s-maxage"]; ok {
+		lifetime = parseDeltaSeconds(v)
+	} else if v, ok := cc["max-age"]; ok {
+		lifetime = parseDeltaSeconds(v)
+	} else if v := h.Get("Expires"); v != "" {
+		if exp, err := http.ParseTime(v); err == nil {
+			lifetime = exp.Sub(date) // Invalid dates mean "already expired"
+		}
+	} else {
+		lifetime, age = fallback, 0
+		if lm, err := http.ParseTime(h.Get("Last-Modified")); err == nil {
+			if heuristic := time.Duration(float64(date.Sub(lm)) * HeuristicFreshness); heuristic > lifetime {
+				lifetime = heuristic
+			}
+		}
+	}
+
+	ttl := lifetime - age
+	if ttl < 0 {
+		ttl = 0
+	}
+	if ttl > MaxSegmentTTL {
+		ttl = MaxSegmentTTL
+	}
+	return ttl, true
+}
+
+func parseDeltaSeconds(v string) time.Duration {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	if n > int64(MaxSegmentTTL/time.Second) {
+		return MaxSegmentTTL
+	}
+	return time.Duration(n) * time.Second
+}
+
+// lookupSegment finds key in memory, then on disk. A fresh entry is returned
+// with its tier ("HIT" or "HIT-DISK"); fresh disk entries are promoted. A
+// stale entry that can be revalidated is returned with an empty tier.
+func lookupSegment(key string) (*CacheItem, string) {
+	item, fresh := globalSegmentCache.Lookup(key)
+	if fresh {
+		return item, "HIT"
+	}
+	if diskTier != nil {
+		if d, ok := diskTier.Get(key); ok {
+			if ttl := time.Until(d.ExpiresAt); ttl > 0 {
+				globalSegmentCache.SetGen(d.Gen, key, d.Data, d.Headers, ttl)
+				return d, "HIT-DISK"
+			}
+			if item == nil {
+				item = d
+			}
+		}
+	}
+	if item != nil && hasValidators(item.Headers) {
+		return item, ""
+	}
+	return nil, ""
+}
+
+// revalidate adds stale's validators to an upstream request.
+func revalidate(headers map[string]string, stale *CacheItem) {
+	if etag := stale.Headers.Get("ETag"); etag != "" {
+		headers["If-None-Match"] = etag
+	}
+	if lm := stale.Headers.Get("Last-Modified"); lm != "" {
+		headers["If-Modified-Since"] = lm
+	}
+	policyStats.Revalidations.Add(1)
+}
+
+// notModifiedBody replays a stale entry for a 304 answer, with the headers the
+// 304 updated (RFC 9111 §4.3.4).
+func notModifiedBody(resp *http.Response, stale *CacheItem) (io.ReadCloser, http.Header) {
+	resp.Body.Close()
+	policyStats.NotModified.Add(1)
+	h := stale.Headers.Clone()
+	for k, vv := range resp.Header {
+		if hopByHopHeaders[k] || k == "Content-Length" {
+			continue
+		}
+		h[k] = vv
+	}
+	h.Set("Content-Length", strconv.Itoa(len(stale.Data)))
+	return io.NopCloser(bytes.NewReader(stale.Data)), h
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFreshnessTTL(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	date := func(d time.Duration) string { return now.Add(d).Format(http.TimeFormat) }
+	tests := []struct {
+		name      string
+		header    http.Header
+		want      time.Duration
+		cacheable bool
+	}{
+		{"fallback", http.Header{}, SegmentTTL, true},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=60"}}, time.Minute, true},
+		{"s-maxage wins", http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 2 * time.Minute, true},
+		{"max-age less age", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"50"}}, 10 * time.Second, true},
+		{"max-age less date", http.Header{"Cache-Control": {"max-age=60"}, "Date": {date(-30 * time.Second)}}, 30 * time.Second, true},
+		{"age past lifetime", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"90"}}, 0, true},
+		{"expires", http.Header{"Date": {date(0)}, "Expires": {date(5 * time.Minute)}}, 5 * time.Minute, true},
+		{"invalid expires", http.Header{"Expires": {"0"}}, 0, true},
+		{"max-age beats expires", http.Header{"Cache-Control": {"max-age=10"}, "Expires": {date(time.Hour)}}, 10 * time.Second, true},
+		{"heuristic", http.Header{"Date": {date(0)}, "Last-Modified": {date(-10 * time.Hour)}}, time.Hour, true},
+		{"heuristic below fallback", http.Header{"Date": {date(0)}, "Last-Modified": {date(-time.Minute)}}, SegmentTTL, true},
+		{"clamped", http.Header{"Cache-Control": {"max-age=999999999"}}, MaxSegmentTTL, true},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}}, 0, true},
+		{"no-store", http.Header{"Cache-Control": {"max-age=60, no-store"}}, 0, false},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, 0, false},
+		{"quoted and mixed case", http.Header{"Cache-Control": {`Max-Age="60"`}}, time.Minute, true},
+	}
+	for _, tt := range tests {
+		got, cacheable := freshnessTTL(tt.header, SegmentTTL, now)
+		if got != tt.want || cacheable != tt.cacheable {
+			t.Errorf("%s: freshnessTTL = %v, %v; want %v, %v", tt.name, got, cacheable, tt.want, tt.cacheable)
+		}
+	}
+}
+
+func TestNotModifiedBody(t *testing.T) {
+	stale := &CacheItem{Data: []byte("segment"), Headers: http.Header{"Etag": {`"1"`}, "Cache-Control": {"max-age=10"}, "Content-Type": {"video/mp2t"}}}
+	resp := &http.Response{StatusCode: 304, Body: io.NopCloser(strings.NewReader("")), Header: http.Header{"Cache-Control": {"max-age=60"}, "Connection": {"close"}, "Content-Length": {"0"}}}
+	body, h := notModifiedBody(resp, stale)
+	data, _ := io.ReadAll(body)
+	if string(data) != "segment" {
+		t.Errorf("body = %q", data)
+	}
+	want := map[string]string{"Cache-Control": "max-age=60", "Content-Type": "video/mp2t", "Etag": `"1"`, "Content-Length": "7", "Connection": ""}
+	for k, v := range want {
+		if got := h.Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+	if stale.Headers.Get("Cache-Control") != "max-age=10" {
+		t.Error("stale entry's headers modified")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ===== Config Reload =====
+//
+// The config is an immutable *Config behind an atomic pointer, and a reload
+// swaps in a new one. instrument pins the current config in each request's
+// context and everything done for the request reads it back with configOf,
+// so a request never mixes two configs. Each config carries its own upstream
+// clients (egressPool), built before it is published.
+// The -config file is reloaded on SIGHUP, when polling (-config-poll) sees
+// its modification time or size change, and on POST to
+// /api/proxy/admin/config/reload. A file that fails to parse or validate is
+// rejected and the last good config stays in place; sources without a key or
+// with a key already used in the same list are skipped with a warning.
+
+const DefaultConfigPollInterval = 2 * time.Second
+
+var currentConfig atomic.Pointer[Config]
+
+func init() {
+	currentConfig.Store(&Config{egress: newEgressPool()})
+}
+
+// getConfig returns the current config. It must not be modified.
+func getConfig() *Config {
+	return currentConfig.Load()
+}
+
+// configCtx carries the config a request was started with.
+type configCtx struct{}
+
+func withConfigSnapshot(ctx context.Context, cfg *Config) context.Context {
+	return context.WithValue(ctx, configCtx{}, cfg)
+}
+
+// configOf returns the config pinned in ctx, or the current one for work
+// outside a request.
+func configOf(ctx context.Context) *Config {
+	if cfg, ok := ctx.Value(configCtx{}).(*Config); ok {
+		return cfg
+	}
+	return getConfig()
+}
+
+// parseConfig decodes and validates a config file and gives it fresh
+// upstream clients.
+func parseConfig(data []byte) (*Config, error) {
+	cfg := new(Config)
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	cfg.egress = newEgressPool()
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	if err := c.TargetPolicy.compile(); err != nil {
+		return fmt.Errorf("TargetPolicy: %v", err)
+	}
+	seen := make(map[string]bool)
+	for i, p := range c.RequestProfiles {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("RequestProfiles[%d]: %v", i, err)
+		}
+	}
+	// keep skips sources without a key and later sources reusing one, so a
+	// single bad entry doesn't reject the whole file. Lookups take the first
+	// match, so the first source with a key wins either way.
+	keep := func(list string, i int, key string) bool {
+		switch {
+		case key == "":
+			slog.Warn("config: skipping source without key", "list", list, "index", i)
+		case seen[list+"|"+key]:
+			slog.Warn("config: skipping duplicate source key", "list", list, "index", i, "key", key)
+		default:
+			seen[list+"|"+key] = true
+			return true
+		}
+		return false
+	}
+	check := func(list, key string, opts SourceOptions) error {
+		switch opts.SegmentMode {
+		case "", SegmentModeDirect, SegmentModeProxy, SegmentModeAuto:
+		default:
+			return fmt.Errorf("%s: source %q: unknown segmentMode %q", list, key, opts.SegmentMode)
+		}
+		for host, ips := range opts.Resolve {
+			if host != strings.ToLower(strings.TrimSuffix(host, ".")) {
+				return fmt.Errorf("%s: source %q: resolve: host %q must be lower case without a trailing dot", list, key, host)
+			}
+			for _, ip := range ips {
+				if net.ParseIP(ip) == nil {
+					return fmt.Errorf("%s: source %q: resolve: %q is not an IP address", list, key, ip)
+				}
+			}
+		}
+		if opts.RequestProfile != nil {
+			if err := opts.RequestProfile.validate(); err != nil {
+				return fmt.Errorf("%s: source %q: requestProfile: %v", list, key, err)
+			}
+		}
+		return nil
+	}
+	live := c.LiveConfig[:0:0]
+	for i, src := range c.LiveConfig {
+		if !keep("LiveConfig", i, src.Key) {
+			continue
+		}
+		if err := check("LiveConfig", src.Key, src.SourceOptions); err != nil {
+			return err
+		}
+		live = append(live, src)
+	}
+	sites := c.SourceConfig[:0:0]
+	for i, src := range c.SourceConfig {
+		if !keep("SourceConfig", i, src.Key) {
+			continue
+		}
+		if err := check("SourceConfig", src.Key, src.SourceOptions); err != nil {
+			return err
+		}
+		sites = append(sites, src)
+	}
+	c.LiveConfig, c.SourceConfig = live, sites
+	return nil
+}
+
+type configReloader struct {
+	path string
+
+	mu          sync.Mutex // Serializes reloads
+	modTime     time.Time
+	size        int64
+	loadedAt    time.Time
+	lastAttempt time.Time
+	lastTrigger string
+	lastErr     error
+
+	reloads, failures atomic.Int64
+}
+
+var reloader *configReloader // nil without -config
+
+// newConfigReloader loads path, failing if the initial config is invalid.
+func newConfigReloader(path string) (*configReloader, error) {
+	c := &configReloader{path: path}
+	if err := c.reload("startup"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads, validates and swaps in the config file.
+func (c *configReloader) reload(trigger string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastAttempt, c.lastTrigger = time.Now(), trigger
+
+	fi, err := os.Stat(c.path)
+	if err == nil {
+		var data []byte
+		if data, err = os.ReadFile(c.path); err == nil {
+			var cfg *Config
+			if cfg, err = parseConfig(data); err == nil {
+				// Requests still holding the old config finish on its
+				// clients; their idle connections are not reused.
+				old := currentConfig.Swap(cfg)
+				old.egress.closeIdleConnections()
+				c.modTime, c.size, c.loadedAt, c.lastErr = fi.ModTime(), fi.Size(), c.lastAttempt, nil
+				c.reloads.Add(1)
+				slog.Info("config loaded", "path", c.path, "trigger", trigger, "live_sources", len(cfg.LiveConfig), "api_sources", len(cfg.SourceConfig))
+				return nil
+			}
+		}
+	}
+	c.lastErr = err
+	c.failures.Add(1)
+	if fi != nil {
+		// Don't retry the same broken file on every poll.
+		c.modTime, c.size = fi.ModTime(), fi.Size()
+	}
+	slog.Warn("config reload rejected, keeping last good config", "path", c.path, "trigger", trigger, "err", err)
+	return err
+}
+
+// watch reloads on SIGHUP and, if poll > 0, when the file changes.
+func (c *configReloader) watch(poll time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if poll > 0 {
+		tick = time.Tick(poll)
+	}
+	for {
+		select {
+		case <-hup:
+			c.reload("sighup")
+		case <-tick:
+			fi, err := os.Stat(c.path)
+			if err != nil {
+				continue // Mid-replace, or gone; keep the current config
+			}
+			c.mu.Lock()
+			changed := !fi.ModTime().Equal(c.modTime) || fi.Size() != c.size
+			c.mu.Unlock()
+			if changed {
+				c.reload("file-change")
+			}
+		}
+	}
+}
+
+type configStatus struct {
+	Path        string    `json:"path"`
+	LoadedAt    time.Time `json:"loadedAt"`
+	ModTime     time.Time `json:"modTime"`
+	LastAttempt time.Time `json:"lastAttempt"`
+	LastTrigger string    `json:"lastTrigger"`
+	LastError   string    `json:"lastError,omitempty"`
+	Reloads     int64     `json:"reloads"`
+	Failures    int64     `json:"failures"`
+	LiveSources int       `json:"liveSources"`
+	APISources  int       `json:"apiSources"`
+}
+
+func (c *configReloader) status() configStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cfg := getConfig()
+	s := configStatus{
+		Path:        c.path,
+		LoadedAt:    c.loadedAt,
+		ModTime:     c.modTime,
+		LastAttempt: c.lastAttempt,
+		LastTrigger: c.lastTrigger,
+		Reloads:     c.reloads.Load(),
+		Failures:    c.failures.Load(),
+		LiveSources: len(cfg.LiveConfig),
+		APISources:  len(cfg.SourceConfig),
+	}
+	if c.lastErr != nil {
+		s.LastError = c.lastErr.Error()
+	}
+	return s
+}
+
+func handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if reloader == nil {
+		http.Error(w, "No -config file", 404)
+		return
+	}
+	writeJSON(w, reloader.status())
+}
+
+func handleAdminConfigReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if reloader == nil {
+		http.Error(w, "No -config file", 404)
+		return
+	}
+	if err := reloader.reload("admin"); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(422)
+		json.NewEncoder(w).Encode(reloader.status())
+		return
+	}
+	writeJSON(w, reloader.status())
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigSkipsBadKeys(t *testing.T) {
+	cfg, err := parseConfig([]byte(`{
+		"LiveConfig": [
+			{"key": "", "url": "http://blank"},
+			{"key": "a", "url": "http://first", "segmentMode": "proxy"},
+			{"key": "a", "url": "http://second", "segmentMode": "bogus"},
+			{"key": "b", "url": "http://b"}
+		],
+		"SourceConfig": [
+			{"key": "a", "api": "http://site-a"},
+			{"key": "a", "api": "http://site-a2"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var live []string
+	for _, src := range cfg.LiveConfig {
+		live = append(live, src.Key+"="+src.URL)
+	}
+	if got := strings.Join(live, " "); got != "a=http://first b=http://b" {
+		t.Errorf("LiveConfig = %s", got)
+	}
+	if len(cfg.SourceConfig) != 1 || cfg.SourceConfig[0].API != "http://site-a" {
+		t.Errorf("SourceConfig = %+v", cfg.SourceConfig)
+	}
+}
+
+func TestParseConfigRejects(t *testing.T) {
+	tests := map[string]string{
+		"syntax":       `{"LiveConfig": [`,
+		"segmentMode":  `{"LiveConfig": [{"key": "a", "segmentMode": "bogus"}]}`,
+		"resolve host": `{"SourceConfig": [{"key": "a", "resolve": {"CDN.example.com": ["192.0.2.1"]}}]}`,
+		"resolve ip":   `{"SourceConfig": [{"key": "a", "resolve": {"cdn.example.com": ["cdn"]}}]}`,
+	}
+	for name, data := range tests {
+		if _, err := parseConfig([]byte(data)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestReloadKeepsLastGoodConfig(t *testing.T) {
+	old := getConfig()
+	t.Cleanup(func() { currentConfig.Store(old) })
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"LiveConfig": [{"key": "a"}]}`)
+	r, err := newConfigReloader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := getConfig()
+	write(`{"LiveConfig": [{"key": "a", "segmentMode": "bogus"}]}`)
+	if err := r.reload("test"); err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	if getConfig() != good || r.failures.Load() != 1 {
+		t.Errorf("config replaced after a rejected reload")
+	}
+
+	// A good reload publishes the new config with clients of its own.
+	write(`{"LiveConfig": [{"key": "b"}]}`)
+	if err := r.reload("test"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := getConfig(); cfg == good || cfg.egress == nil || cfg.egress == good.egress {
+		t.Errorf("reload kept the old clients")
+	}
+}
+
+func TestRequestKeepsItsConfig(t *testing.T) {
+	first := &Config{LiveConfig: []LiveSource{{Key: "a"}}}
+	withConfig(t, first)
+	h := instrument("config-test", func(w http.ResponseWriter, r *http.Request) {
+		withConfig(t, &Config{}) // Reloaded mid-request
+		if cfg := configOf(r.Context()); cfg != first || cfg.metricSource("a") != "a" {
+			t.Errorf("request switched configs")
+		}
+	})
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/proxy/m3u8?moontv-source=a", nil))
+	if configOf(context.Background()) == first {
+		t.Error("configOf outside a request ignores the reload")
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== Disk Cache (Second Tier) =====
+//
+// Segments evicted from globalSegmentCache are demoted to files under a
+// configurable directory with their own byte budget, LRU order and TTL.
+// Memory misses fall through to disk and disk hits are promoted back.
+// Files are written to a temp name, synced and renamed into place, and the
+// directory is synced after the rename. Files whose length disagrees with
+// their header are dropped on read and at startup, so an entry torn by a
+// crash is never served. Renames and removals happen under the index lock so
+// they can't interleave for the same key.
+//
+// File layout: "LTV1" | uint32 metadata length | metadata JSON | body.
+
+const (
+	DefaultDiskCacheTTL = 6 * time.Hour
+	diskFileMagic       = "LTV1"
+	diskTempPrefix      = ".tmp-"
+	diskDemoteQueue     = 256
+	diskJanitorInterval = time.Minute
+)
+
+type diskMeta struct {
+	Key        string      `json:"key"`
+	Headers    http.Header `json:"headers"`
+	Size       int64       `json:"size"`
+	ExpiresAt  time.Time   `json:"expiresAt"`  // Removal from disk
+	FreshUntil time.Time   `json:"freshUntil"` // End of upstream freshness
+}
+
+type diskEntry struct {
+	key        string
+	file       string
+	sizeBytes  int64
+	expiresAt  time.Time
+	freshUntil time.Time
+	validators bool // Can be revalidated once stale
+	etag       string
+	modified   string // Last-Modified
+	gen        uint64
+}
+
+func newDiskEntry(key, file string, size int64, headers http.Header, expiresAt, freshUntil time.Time, gen uint64) *diskEntry {
+	return &diskEntry{key: key, file: file, sizeBytes: size, expiresAt: expiresAt, freshUntil: freshUntil, validators: hasValidators(headers), etag: headers.Get("ETag"), modified: headers.Get("Last-Modified"), gen: gen}
+}
+
+// same reports whether the file already holds this representation: same
+// validators, size and freshness. Entries without validators can't tell.
+func (e *diskEntry) same(size int64, headers http.Header, freshUntil time.Time) bool {
+	return e.validators && e.sizeBytes == size && e.etag == headers.Get("ETag") && e.modified == headers.Get("Last-Modified") && e.freshUntil.Equal(freshUntil)
+}
+
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+	ttl      time.Duration
+
+	mu           sync.Mutex
+	currentBytes int64
+	items        map[string]*list.Element
+	evictList    *list.List
+
+	demote chan *CacheItem
+
+	hits, misses, purged, stale int64
+}
+
+var diskTier *DiskCache // nil when the disk tier is disabled
+
+// NewDiskCache opens (or creates) dir and indexes the entries already in it.
+func NewDiskCache(dir string, maxBytes int64, ttl time.Duration) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		ttl = DefaultDiskCacheTTL
+	}
+	d := &DiskCache{dir: dir, maxBytes: maxBytes, ttl: ttl, items: make(map[string]*list.Element), evictList: list.New(), demote: make(chan *CacheItem, diskDemoteQueue)}
+	if err := d.loadIndex(); err != nil {
+		return nil, err
+	}
+	go d.demoteLoop()
+	go d.janitor()
+	return d, nil
+}
+
+func (d *DiskCache) fileFor(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:]))
+}
+
+// loadIndex rebuilds the LRU from existing files, oldest first, and removes
+// leftovers of interrupted writes and expired entries.
+func (d *DiskCache) loadIndex() error {
+	names, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	type found struct {
+		meta  diskMeta
+		file  string
+		mtime time.Time
+	}
+	var entries []found
+	now := time.Now()
+	for _, de := range names {
+		file := filepath.Join(d.dir, de.Name())
+		if de.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(de.Name(), diskTempPrefix) {
+			os.Remove(file)
+			continue
+		}
+		meta, err := readDiskMeta(file)
+		if err != nil || now.After(meta.ExpiresAt) || d.fileFor(meta.Key) != file {
+			os.Remove(file)
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, found{meta: meta, file: file, mtime: info.ModTime()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].mtime.Before(entries[j].mtime) })
+	for _, e := range entries {
+		d.insert(newDiskEntry(e.meta.Key, e.file, e.meta.Size, e.meta.Headers, e.meta.ExpiresAt, e.meta.FreshUntil, cacheGeneration.Load()))
+	}
+	if n := len(entries); n > 0 {
+		slog.Info("disk cache indexed", "entries", n, "bytes", d.currentBytes, "dir", d.dir)
+	}
+	return nil
+}
+
+func readDiskMeta(file string) (diskMeta, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return diskMeta{}, err
+	}
+	defer f.Close()
+	meta, n, err := decodeDiskHeader(bufio.NewReader(f))
+	if err != nil {
+		return diskMeta{}, err
+	}
+	return meta, checkDiskLength(f, n+meta.Size)
+}
+
+// checkDiskLength rejects files that are shorter or longer than their header
+// says, such as a rename that reached the disk before the data did.
+func checkDiskLength(f *os.File, want int64) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != want {
+		return errors.New("disk cache: length mismatch")
+	}
+	return nil
+}
+
+func decodeDiskHeader(r io.Reader) (diskMeta, int64, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return diskMeta{}, 0, err
+	}
+	if string(hdr[:4]) != diskFileMagic {
+		return diskMeta{}, 0, errors.New("disk cache: bad magic")
+	}
+	n := binary.BigEndian.Uint32(hdr[4:])
+	if n > 1<<20 {
+		return diskMeta{}, 0, errors.New("disk cache: metadata too large")
+	}
+	raw := make([]byte, n)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return diskMeta{}, 0, err
+	}
+	var meta diskMeta
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return diskMeta{}, 0, err
+	}
+	return meta, int64(len(hdr)) + int64(n), nil
+}
+
+// Get reads an entry from disk. Its ExpiresAt is the end of upstream
+// freshness: stale entries are still returned if they can be revalidated.
+// Corrupt or mismatched files are dropped.
+func (d *DiskCache) Get(key string) (*CacheItem, bool) {
+	d.mu.Lock()
+	ent, ok := d.items[key]
+	if !ok {
+		d.misses++
+		d.mu.Unlock()
+		return nil, false
+	}
+	e := ent.Value.(*diskEntry)
+	if now := time.Now(); now.After(e.expiresAt) || (now.After(e.freshUntil) && !e.validators) {
+		d.drop(ent)
+		d.misses++
+		d.mu.Unlock()
+		return nil, false
+	}
+	d.evictList.MoveToFront(ent)
+	d.mu.Unlock()
+
+	data, h, err := d.readFile(e.file, key)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		if cur, ok := d.items[key]; ok && cur == ent {
+			d.drop(ent)
+		}
+		d.misses++
+		return nil, false
+	}
+	d.hits++
+	return &CacheItem{Key: key, Data: data, Headers: h, SizeBytes: e.sizeBytes, ExpiresAt: e.freshUntil, Gen: e.gen}, true
+}
+
+func (d *DiskCache) readFile(file, key string) ([]byte, http.Header, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	meta, n, err := decodeDiskHeader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta.Key != key {
+		return nil, nil, errors.New("disk cache: key mismatch")
+	}
+	if err := checkDiskLength(f, n+meta.Size); err != nil {
+		return nil, nil, err
+	}
+	data := make([]byte, meta.Size)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return nil, nil, err
+	}
+	return data, meta.Headers, nil
+}
+
+// Has reports whether a fresh entry exists.
+func (d *DiskCache) Has(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ent, ok := d.items[key]
+	return ok && time.Now().Before(ent.Value.(*diskEntry).freshUntil)
+}
+
+// Demote queues an evicted memory entry for writing. It never blocks: when the
+// writer falls behind, entries are dropped.
+func (d *DiskCache) Demote(item *CacheItem) {
+	select {
+	case d.demote <- item:
+	default:
+	}
+}
+
+func (d *DiskCache) demoteLoop() {
+	for item := range d.demote {
+		if err := d.Put(item.Gen, item.Key, item.Data, item.Headers, item.ExpiresAt); err != nil {
+			slog.Warn("disk cache write failed", "key", redactCacheKey(item.Key), "err", err)
+		}
+	}
+}
+
+// Put writes an entry fetched under generation gen, fresh until freshUntil,
+// atomically and accounts it against the byte budget. Entries from before the
+// latest purge are dropped.
+func (d *DiskCache) Put(gen uint64, key string, data []byte, headers http.Header, freshUntil time.Time) error {
+	size := int64(len(data))
+	if size == 0 || size > d.maxBytes {
+		return nil
+	}
+	d.mu.Lock()
+	if ent, ok := d.items[key]; ok && ent.Value.(*diskEntry).same(size, headers, freshUntil) && gen == cacheGeneration.Load() {
+		// Already on disk (promoted earlier and unchanged): just keep it.
+		e := ent.Value.(*diskEntry)
+		e.expiresAt = time.Now().Add(d.ttl)
+		e.gen = gen
+		d.evictList.MoveToFront(ent)
+		d.mu.Unlock()
+		return nil
+	}
+	d.mu.Unlock()
+
+	meta := diskMeta{Key: key, Headers: headers, Size: size, ExpiresAt: time.Now().Add(d.ttl), FreshUntil: freshUntil}
+	tmp, err := writeTempFile(d.dir, meta, data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // No-op once renamed
+
+	d.mu.Lock()
+	if gen != cacheGeneration.Load() {
+		d.stale++
+		d.mu.Unlock()
+		return nil
+	}
+	file := d.fileFor(key)
+	if err := os.Rename(tmp, file); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	if ent, ok := d.items[key]; ok {
+		d.removeElement(ent) // Its file was just replaced
+	}
+	d.insert(newDiskEntry(key, file, size, headers, meta.ExpiresAt, freshUntil, gen))
+	d.evict()
+	d.mu.Unlock()
+	// Sync the directory outside the lock so reads don't wait on the disk.
+	return syncDir(d.dir)
+}
+
+// syncDir makes renames and removals in dir durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeTempFile writes and syncs an entry under a temp name in dir.
+func writeTempFile(dir string, meta diskMeta, data []byte) (string, error) {
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(dir, diskTempPrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	var hdr [8]byte
+	copy(hdr[:4], diskFileMagic)
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(raw)))
+	w := bufio.NewWriter(tmp)
+	w.Write(hdr[:])
+	w.Write(raw)
+	w.Write(data)
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+func (d *DiskCache) Delete(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if ent, ok := d.items[key]; ok {
+		d.drop(ent)
+	}
+}
+
+// Purge removes every entry whose key matches. The caller must have bumped
+// cacheGeneration first.
+func (d *DiskCache) Purge(match func(key string) bool) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for key, ent := range d.items {
+		if match(key) {
+			d.drop(ent)
+			n++
+		}
+	}
+	d.purged += int64(n)
+	return n
+}
+
+func (d *DiskCache) insert(e *diskEntry) {
+	d.items[e.key] = d.evictList.PushFront(e)
+	d.currentBytes += e.sizeBytes
+}
+
+func (d *DiskCache) removeElement(ent *list.Element) {
+	d.evictList.Remove(ent)
+	e := ent.Value.(*diskEntry)
+	delete(d.items, e.key)
+	d.currentBytes -= e.sizeBytes
+}
+
+// drop removes an entry and its file.
+func (d *DiskCache) drop(ent *list.Element) {
+	d.removeElement(ent)
+	os.Remove(ent.Value.(*diskEntry).file)
+}
+
+// evict trims the index to the byte budget.
+func (d *DiskCache) evict() {
+	for d.currentBytes > d.maxBytes && d.evictList.Len() > 0 {
+		d.drop(d.evictList.Back())
+	}
+}
+
+func (d *DiskCache) janitor() {
+	for range time.Tick(diskJanitorInterval) {
+		now := time.Now()
+		d.mu.Lock()
+		for ent := d.evictList.Back(); ent != nil; {
+			prev := ent.Prev()
+			if e := ent.Value.(*diskEntry); now.After(e.expiresAt) {
+				d.drop(ent)
+			}
+			ent = prev
+		}
+		d.mu.Unlock()
+	}
+}
+
+func (d *DiskCache) snapshot() map[string]int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return map[string]int64{
+		"entries":  int64(d.evictList.Len()),
+		"bytes":    d.currentBytes,
+		"maxBytes": d.maxBytes,
+		"hits":     d.hits,
+		"misses":   d.misses,
+		"purged":   d.purged,
+		"stale":    d.stale,
+	}
+}
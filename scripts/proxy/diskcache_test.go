@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskCachePut(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDiskCache(dir, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := cacheGeneration.Load()
+	fresh := time.Now().Add(time.Minute).Truncate(time.Second)
+	get := func(key string) string {
+		t.Helper()
+		item, ok := d.Get(key)
+		if !ok {
+			return ""
+		}
+		return string(item.Data) + " " + item.Headers.Get("ETag")
+	}
+
+	tests := []struct {
+		name  string
+		data  string
+		etag  string
+		fresh time.Time
+		want  string
+	}{
+		{"first write", "aaaa", `"1"`, fresh, `aaaa "1"`},
+		{"same size, new etag", "bbbb", `"2"`, fresh, `bbbb "2"`},
+		{"same size and etag, revalidated", "cccc", `"2"`, fresh.Add(time.Minute), `cccc "2"`},
+		{"same size, no validators", "dddd", "", fresh, "dddd "},
+		{"different size", "eeeeee", "", fresh, "eeeeee "},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.etag != "" {
+			h.Set("ETag", tt.etag)
+		}
+		if err := d.Put(gen, "k", []byte(tt.data), h, tt.fresh); err != nil {
+			t.Fatal(err)
+		}
+		if got := get("k"); got != tt.want {
+			t.Errorf("%s: Get = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// A promoted entry demoted again unchanged keeps its file.
+	h := http.Header{"Etag": {`"3"`}}
+	d.Put(gen, "p", []byte("ffff"), h, fresh)
+	d.Put(gen, "p", []byte("gggg"), h, fresh)
+	if got := get("p"); got != `ffff "3"` {
+		t.Errorf("unchanged entry rewritten: %q", got)
+	}
+
+	// Entries from before a purge are dropped.
+	d.Put(gen-1, "old", []byte("x"), nil, fresh)
+	if got := get("old"); got != "" {
+		t.Errorf("stale generation stored: %q", got)
+	}
+
+	// Reopening indexes what is on disk.
+	d2, err := NewDiskCache(dir, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item, ok := d2.Get("k"); !ok || string(item.Data) != "eeeeee" || !item.ExpiresAt.Equal(fresh) {
+		t.Errorf("reopened Get = %+v, %v", item, ok)
+	}
+}
+
+func TestDiskCacheEvicts(t *testing.T) {
+	d, err := NewDiskCache(t.TempDir(), 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen, fresh := cacheGeneration.Load(), time.Now().Add(time.Minute)
+	d.Put(gen, "a", []byte("aaaa"), nil, fresh)
+	d.Put(gen, "b", []byte("bbbb"), nil, fresh)
+	d.Get("a") // a is now the most recently used
+	d.Put(gen, "c", []byte("cccc"), nil, fresh)
+	if _, ok := d.Get("b"); ok {
+		t.Error("least recently used entry kept")
+	}
+	if !d.Has("a") || !d.Has("c") {
+		t.Error("recent entries evicted")
+	}
+}
+
+func TestDiskCacheDropsTornFiles(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDiskCache(dir, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen, fresh := cacheGeneration.Load(), time.Now().Add(time.Minute)
+	for _, key := range []string{"short", "long"} {
+		if err := d.Put(gen, key, []byte("segment"), nil, fresh); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Simulate writes that only partly reached the disk before a crash.
+	short, long := d.fileFor("short"), d.fileFor("long")
+	info, _ := os.Stat(short)
+	os.Truncate(short, info.Size()-1)
+	f, _ := os.OpenFile(long, os.O_APPEND|os.O_WRONLY, 0)
+	f.Write([]byte("x"))
+	f.Close()
+
+	if _, ok := d.Get("long"); ok {
+		t.Error("overlong file served")
+	}
+	if _, err := os.Stat(long); !os.IsNotExist(err) {
+		t.Errorf("torn file kept: %v", err)
+	}
+	d2, err := NewDiskCache(dir, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d2.Has("short") {
+		t.Error("truncated file indexed on startup")
+	}
+	if _, err := os.Stat(short); !os.IsNotExist(err) {
+		t.Errorf("torn file kept: %v", err)
+	}
+}
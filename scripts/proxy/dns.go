@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ===== DNS =====
+//
+// Upstream host names are resolved through a cache in front of the system
+// resolver or, with -dns-upstream, DNS-over-HTTPS (an https:// URL, RFC 8484)
+// or plain nameservers ("1.1.1.1,8.8.8.8:53", tried in order until one
+// answers or says the name doesn't exist, TCP when a UDP answer is
+// truncated). Answers are kept for their TTL, clamped to
+// MinDNSTTL..MaxDNSTTL; the system resolver reports none, so its answers
+// are kept for -dns-ttl. Failures are kept for DNSNegativeTTL. Concurrent
+// misses for a host share one lookup.
+//
+// A source's "resolve" option pins hosts to fixed addresses, for CDN
+// pinning:
+//
+//	"LiveConfig": [{"key": "x", "resolve": {"cdn.example.com": ["203.0.113.7"]}}]
+//
+// Every address, resolved or pinned, still goes through the target policy
+// in resolveAndPickSafeIP.
+
+const (
+	MinDNSTTL      = 5 * time.Second
+	MaxDNSTTL      = 10 * time.Minute
+	DefaultDNSTTL  = time.Minute
+	DNSNegativeTTL = 5 * time.Second
+	DNSTimeout     = 5 * time.Second
+	dnsTryTimeout  = 2 * time.Second // Per nameserver
+	MaxDNSEntries  = 10000
+)
+
+type dnsEntry struct {
+	ips       []net.IP
+	err       error
+	expiresAt time.Time
+}
+
+type dnsFlight struct {
+	done  chan struct{}
+	entry dnsEntry
+}
+
+type DNSCache struct {
+	lookup    func(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+	systemTTL time.Duration // Set before serving
+
+	mu      sync.Mutex
+	items   map[string]dnsEntry
+	flights map[string]*dnsFlight
+
+	hits, misses, coalesced, errors, overrides, queries atomic.Int64
+}
+
+var dnsCache = NewDNSCache(nil)
+
+// NewDNSCache returns a cache over lookup, or over the system resolver if
+// lookup is nil.
+func NewDNSCache(lookup func(ctx context.Context, host string) ([]net.IP, time.Duration, error)) *DNSCache {
+	c := &DNSCache{lookup: lookup, systemTTL: DefaultDNSTTL, items: make(map[string]dnsEntry), flights: make(map[string]*dnsFlight)}
+	if c.lookup == nil {
+		c.lookup = c.lookupSystem
+	}
+	return c
+}
+
+// newDNSUpstream parses -dns-upstream.
+func newDNSUpstream(spec string) (func(ctx context.Context, host string) ([]net.IP, time.Duration, error), error) {
+	switch {
+	case spec == "" || spec == "system":
+		return nil, nil
+	case strings.HasPrefix(spec, "https://"):
+		doh := &http.Client{Timeout: DNSTimeout, Transport: &http.Transport{Proxy: nil, ForceAttemptHTTP2: true, MaxIdleConnsPerHost: 4}}
+		return func(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+			return lookupBoth(ctx, host, func(ctx context.Context, query []byte) ([]byte, error) {
+				return exchangeDoH(ctx, doh, spec, query)
+			})
+		}, nil
+	}
+	var servers []string
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		if host, _, _ := net.SplitHostPort(s); net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("nameserver %q is not an IP address", s)
+		}
+		servers = append(servers, s)
+	}
+	return func(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+		return lookupBoth(ctx, host, func(ctx context.Context, query []byte) ([]byte, error) {
+			var err error
+			for _, server := range servers {
+				tryCtx, cancel := context.WithTimeout(ctx, dnsTryTimeout)
+				var resp []byte
+				resp, err = exchangeUDP(tryCtx, server, query)
+				cancel()
+				if err != nil {
+					continue
+				}
+				if len(resp) < 4 {
+					err = errDNSMalformed
+					continue
+				}
+				// SERVFAIL, REFUSED and the like are that server's problem.
+				if rcode := resp[3] & 0x0F; rcode != 0 && rcode != 3 {
+					err = fmt.Errorf("dns rcode %d from %s", rcode, server)
+					continue
+				}
+				return resp, nil
+			}
+			return nil, err
+		})
+	}, nil
+}
+
+// Resolve returns the addresses of host for sourceKey: its pinned ones, or
+// cached or looked-up ones.
+func (c *DNSCache) Resolve(ctx context.Context, sourceKey, host string) ([]net.IP, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if pinned := configOf(ctx).sourceOptions(sourceKey).Resolve[host]; len(pinned) > 0 {
+		c.overrides.Add(1)
+		ips := make([]net.IP, 0, len(pinned))
+		for _, s := range pinned {
+			ips = append(ips, net.ParseIP(s)) // Validated when the config was loaded
+		}
+		return ips, nil
+	}
+
+	c.mu.Lock()
+	if e, ok := c.items[host]; ok && time.Now().Before(e.expiresAt) {
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return e.ips, e.err
+	}
+	f, ok := c.flights[host]
+	if ok {
+		c.coalesced.Add(1)
+	} else {
+		f = &dnsFlight{done: make(chan struct{})}
+		c.flights[host] = f
+		c.misses.Add(1)
+		go c.fill(host, f)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.entry.ips, f.entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fill looks host up for every caller waiting on f, detached from them.
+func (c *DNSCache) fill(host string, f *dnsFlight) {
+	ctx, cancel := context.WithTimeout(context.Background(), DNSTimeout)
+	defer cancel()
+	c.queries.Add(1)
+	ips, ttl, err := c.lookup(ctx, host)
+	if err == nil && len(ips) == 0 {
+		err = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	if err != nil {
+		c.errors.Add(1)
+		ttl = DNSNegativeTTL
+	} else {
+		ttl = min(max(ttl, MinDNSTTL), MaxDNSTTL)
+	}
+	f.entry = dnsEntry{ips: ips, err: err, expiresAt: time.Now().Add(ttl)}
+
+	c.mu.Lock()
+	if len(c.items) >= MaxDNSEntries {
+		c.sweep()
+	}
+	if len(c.items) < MaxDNSEntries {
+		c.items[host] = f.entry
+	}
+	delete(c.flights, host)
+	c.mu.Unlock()
+	close(f.done)
+}
+
+// sweep drops expired entries, or every entry if none has expired. c.mu must
+// be held.
+func (c *DNSCache) sweep() {
+	now := time.Now()
+	for host, e := range c.items {
+		if now.After(e.expiresAt) {
+			delete(c.items, host)
+		}
+	}
+	if len(c.items) >= MaxDNSEntries {
+		clear(c.items)
+	}
+}
+
+func (c *DNSCache) lookupSystem(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, c.systemTTL, nil
+}
+
+func (c *DNSCache) snapshot() map[string]int64 {
+	c.mu.Lock()
+	n := len(c.items)
+	c.mu.Unlock()
+	return map[string]int64{
+		"entries":   int64(n),
+		"hits":      c.hits.Load(),
+		"misses":    c.misses.Load(),
+		"coalesced": c.coalesced.Load(),
+		"errors":    c.errors.Load(),
+		"overrides": c.overrides.Load(),
+		"queries":   c.queries.Load(),
+	}
+}
+
+// resolveHost resolves host through dnsCache for the source in ctx,
+// reporting to the request's httptrace hooks.
+func resolveHost(ctx context.Context, host string) ([]net.IP, error) {
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+	ips, err := dnsCache.Resolve(ctx, sourceKeyOf(ctx), host)
+	if trace != nil && trace.DNSDone != nil {
+		addrs := make([]net.IPAddr, len(ips))
+		for i, ip := range ips {
+			addrs[i] = net.IPAddr{IP: ip}
+		}
+		trace.DNSDone(httptrace.DNSDoneInfo{Addrs: addrs, Err: err})
+	}
+	return ips, err
+}
+
+// ===== DNS Wire Format =====
+
+const (
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypeAAAA  = 28
+	dnsClassIN   = 1
+
+	maxDNSCNAMEs = 8
+)
+
+// dnsQueryID returns a random transaction ID. It is the only thing an
+// off-path attacker has to guess to spoof a UDP answer, so it comes from
+// crypto/rand.
+func dnsQueryID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// lookupBoth queries A and AAAA records through exchange and merges them.
+func lookupBoth(ctx context.Context, host string, exchange func(ctx context.Context, query []byte) ([]byte, error)) ([]net.IP, time.Duration, error) {
+	type answer struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	results := make(chan answer, 2)
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		go func() {
+			id := dnsQueryID()
+			query, err := buildDNSQuery(id, host, qtype)
+			if err != nil {
+				results <- answer{err: err}
+				return
+			}
+			resp, err := exchange(ctx, query)
+			if err != nil {
+				results <- answer{err: err}
+				return
+			}
+			ips, ttl, err := parseDNSResponse(resp, id, host, qtype)
+			results <- answer{ips, ttl, err}
+		}()
+	}
+	var ips []net.IP
+	ttl := MaxDNSTTL
+	var err error
+	for range 2 {
+		a := <-results
+		if a.err != nil {
+			err = a.err
+			continue
+		}
+		if len(a.ips) > 0 {
+			ips = append(ips, a.ips...)
+			ttl = min(ttl, a.ttl)
+		}
+	}
+	if len(ips) == 0 && err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	return ips, ttl, nil
+}
+
+func buildDNSQuery(id uint16, host string, qtype uint16) ([]byte, error) {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = append(b, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0) // RD; one question
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid host name %q", host)
+		}
+		b = append(append(b, byte(len(label))), label...)
+	}
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	return binary.BigEndian.AppendUint16(b, dnsClassIN), nil
+}
+
+var errDNSMalformed = errors.New("malformed dns response")
+
+// readDNSName returns the lower-cased name at off, following compression
+// pointers, and the offset after it in the record.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; off < len(msg); {
+		switch n := int(msg[off]); {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), next, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errDNSMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		case n&0xC0 != 0 || off+1+n > len(msg):
+			return "", 0, errDNSMalformed
+		default:
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += n + 1
+		}
+	}
+	return "", 0, errDNSMalformed
+}
+
+// parseDNSResponse returns the addresses of type qtype owned by host or a
+// name its CNAME chain leads to, and their lowest TTL. The response must
+// answer the question that was asked; records for other names are ignored,
+// so a lying or confused server can't plant addresses for them.
+func parseDNSResponse(msg []byte, id uint16, host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id || msg[2]&0x80 == 0 {
+		return nil, 0, errDNSMalformed
+	}
+	switch rcode := msg[3] & 0x0F; rcode {
+	case 0:
+	case 3:
+		return nil, 0, errors.New("no such host")
+	default:
+		return nil, 0, fmt.Errorf("dns rcode %d", rcode)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	qd, an := int(binary.BigEndian.Uint16(msg[4:])), int(binary.BigEndian.Uint16(msg[6:]))
+	if qd != 1 {
+		return nil, 0, errDNSMalformed
+	}
+	name, off, err := readDNSName(msg, 12)
+	if err != nil || off+4 > len(msg) {
+		return nil, 0, errDNSMalformed
+	}
+	if name != host || binary.BigEndian.Uint16(msg[off:]) != qtype || binary.BigEndian.Uint16(msg[off+2:]) != dnsClassIN {
+		return nil, 0, errors.New("dns response for another question")
+	}
+	off += 4
+
+	type record struct {
+		owner string
+		rtype uint16
+		ttl   time.Duration
+		data  []byte
+		cname string
+	}
+	records := make([]record, 0, an)
+	for range an {
+		var r record
+		if r.owner, off, err = readDNSName(msg, off); err != nil || off+10 > len(msg) {
+			return nil, 0, errDNSMalformed
+		}
+		rtype, class := binary.BigEndian.Uint16(msg[off:]), binary.BigEndian.Uint16(msg[off+2:])
+		r.rtype, r.ttl = rtype, time.Duration(binary.BigEndian.Uint32(msg[off+4:]))*time.Second
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, 0, errDNSMalformed
+		}
+		if class == dnsClassIN {
+			switch {
+			case rtype == dnsTypeCNAME:
+				if r.cname, _, err = readDNSName(msg, off); err != nil {
+					return nil, 0, errDNSMalformed
+				}
+				records = append(records, r)
+			case rtype == qtype && (rdlen == net.IPv4len || rdlen == net.IPv6len):
+				r.data = msg[off : off+rdlen]
+				records = append(records, r)
+			}
+		}
+		off += rdlen
+	}
+
+	// Follow the CNAME chain from host, whatever order the records came in.
+	owners := map[string]bool{host: true}
+	ttl := MaxDNSTTL
+	for range maxDNSCNAMEs {
+		grew := false
+		for _, r := range records {
+			if r.rtype == dnsTypeCNAME && owners[r.owner] && !owners[r.cname] {
+				owners[r.cname] = true
+				ttl = min(ttl, r.ttl)
+				grew = true
+			}
+		}
+		if !grew {
+			break
+		}
+	}
+	var ips []net.IP
+	for _, r := range records {
+		if r.rtype == qtype && owners[r.owner] {
+			ips = append(ips, net.IP(bytes.Clone(r.data)))
+			ttl = min(ttl, r.ttl)
+		}
+	}
+	return ips, ttl, nil
+}
+
+func exchangeDoH(ctx context.Context, c *http.Client, endpoint string, query []byte) ([]byte, error) {
+	id0, id1 := query[0], query[1]
+	query[0], query[1] = 0, 0 // RFC 8484 §4.1: ID 0 for cacheability
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh status %d", resp.StatusCode)
+	}
+	msg, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) >= 2 {
+		msg[0], msg[1] = id0, id1
+	}
+	return msg, nil
+}
+
+// exchangeUDP queries server over UDP, retrying over TCP if the answer is
+// truncated.
+func exchangeUDP(ctx context.Context, server string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 12 || buf[0] != query[0] || buf[1] != query[1] {
+			continue // Stray or spoofed packet
+		}
+		if buf[2]&0x02 == 0 {
+			return buf[:n], nil
+		}
+		return exchangeTCP(ctx, server, query)
+	}
+}
+
+func exchangeTCP(ctx context.Context, server string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	_, err = io.ReadFull(conn, msg)
+	return msg, err
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testRR struct {
+	name  string // "@" is a compression pointer to the question name
+	rtype uint16
+	ttl   uint32
+	data  []byte // Address, or a name for CNAME records
+}
+
+func appendDNSName(b []byte, name string) []byte {
+	if name == "@" {
+		return append(b, 0xC0, 12)
+	}
+	for _, label := range strings.Split(name, ".") {
+		b = append(append(b, byte(len(label))), label...)
+	}
+	return append(b, 0)
+}
+
+// dnsResponse builds a response to a query for qname and qtype.
+func dnsResponse(id uint16, rcode byte, qname string, qtype uint16, rrs ...testRR) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = append(b, 0x81, 0x80|rcode, 0, 1)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rrs)))
+	b = append(b, 0, 0, 0, 0)
+	b = appendDNSName(b, qname)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+	for _, rr := range rrs {
+		b = appendDNSName(b, rr.name)
+		b = binary.BigEndian.AppendUint16(b, rr.rtype)
+		b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+		b = binary.BigEndian.AppendUint32(b, rr.ttl)
+		data := rr.data
+		if rr.rtype == dnsTypeCNAME {
+			data = appendDNSName(nil, string(rr.data))
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+		b = append(b, data...)
+	}
+	return b
+}
+
+func aRecord(name string, ttl uint32, ip string) testRR {
+	return testRR{name, dnsTypeA, ttl, net.ParseIP(ip).To4()}
+}
+
+func cnameRecord(name string, ttl uint32, target string) testRR {
+	return testRR{name, dnsTypeCNAME, ttl, []byte(target)}
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	const id, host = 0x1234, "cdn.example.com"
+	tests := []struct {
+		name string
+		msg  []byte
+		ips  string
+		ttl  time.Duration
+		err  bool
+	}{
+		{"answer", dnsResponse(id, 0, host, dnsTypeA, aRecord(host, 60, "192.0.2.1"), aRecord(host, 30, "192.0.2.2")), "192.0.2.1 192.0.2.2", 30 * time.Second, false},
+		{"compressed owner", dnsResponse(id, 0, host, dnsTypeA, aRecord("@", 60, "192.0.2.1")), "192.0.2.1", time.Minute, false},
+		{"owner case", dnsResponse(id, 0, host, dnsTypeA, aRecord("CDN.Example.COM", 60, "192.0.2.1")), "192.0.2.1", time.Minute, false},
+		{"cname chain", dnsResponse(id, 0, host, dnsTypeA, cnameRecord(host, 300, "edge.cdn.net"), cnameRecord("edge.cdn.net", 20, "e1.cdn.net"), aRecord("e1.cdn.net", 60, "192.0.2.9")), "192.0.2.9", 20 * time.Second, false},
+		{"cname out of order", dnsResponse(id, 0, host, dnsTypeA, aRecord("e1.cdn.net", 60, "192.0.2.9"), cnameRecord(host, 300, "e1.cdn.net")), "192.0.2.9", time.Minute, false},
+		{"foreign owner", dnsResponse(id, 0, host, dnsTypeA, aRecord("bank.example.net", 60, "192.0.2.66"), aRecord(host, 60, "192.0.2.1")), "192.0.2.1", time.Minute, false},
+		{"foreign cname", dnsResponse(id, 0, host, dnsTypeA, cnameRecord("other.example.com", 60, "evil.net"), aRecord("evil.net", 60, "192.0.2.66")), "", MaxDNSTTL, false},
+		{"other question name", dnsResponse(id, 0, "bank.example.net", dnsTypeA, aRecord("bank.example.net", 60, "192.0.2.66")), "", 0, true},
+		{"other question type", dnsResponse(id, 0, host, dnsTypeAAAA), "", 0, true},
+		{"wrong id", dnsResponse(id+1, 0, host, dnsTypeA, aRecord(host, 60, "192.0.2.1")), "", 0, true},
+		{"nxdomain", dnsResponse(id, 3, host, dnsTypeA), "", 0, true},
+		{"servfail", dnsResponse(id, 2, host, dnsTypeA), "", 0, true},
+		{"truncated", dnsResponse(id, 0, host, dnsTypeA, aRecord(host, 60, "192.0.2.1"))[:40], "", 0, true},
+		{"short", []byte{0x12, 0x34, 0x81}, "", 0, true},
+	}
+	for _, tt := range tests {
+		ips, ttl, err := parseDNSResponse(tt.msg, id, host+".", dnsTypeA)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: err = %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, ip := range ips {
+			got = append(got, ip.String())
+		}
+		if strings.Join(got, " ") != tt.ips || (!tt.err && ttl != tt.ttl) {
+			t.Errorf("%s: %v, %v; want %s, %v", tt.name, got, ttl, tt.ips, tt.ttl)
+		}
+	}
+
+	// A compression loop is malformed, not an endless walk.
+	msg := dnsResponse(id, 0, host, dnsTypeA)
+	msg = append(msg[:6], append([]byte{0, 1, 0, 0, 0, 0}, msg[12:]...)...)
+	msg = append(msg, 0xC0, byte(len(msg)))
+	if _, _, err := parseDNSResponse(msg, id, host, dnsTypeA); !errors.Is(err, errDNSMalformed) {
+		t.Errorf("compression loop: %v", err)
+	}
+}
+
+func TestBuildDNSQuery(t *testing.T) {
+	q, err := buildDNSQuery(0xBEEF, "cdn.example.com", dnsTypeAAAA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(q) != 0xBEEF || q[2] != 0x01 {
+		t.Errorf("header % x", q[:4])
+	}
+	name, off, err := readDNSName(q, 12)
+	if err != nil || name != "cdn.example.com" || binary.BigEndian.Uint16(q[off:]) != dnsTypeAAAA {
+		t.Errorf("question %q, %v", name, err)
+	}
+	for _, bad := range []string{"", "a..b", strings.Repeat("x", 64) + ".com"} {
+		if _, err := buildDNSQuery(1, bad, dnsTypeA); err == nil {
+			t.Errorf("buildDNSQuery(%q) accepted", bad)
+		}
+	}
+}
+
+func TestLookupBoth(t *testing.T) {
+	ips, ttl, err := lookupBoth(context.Background(), "cdn.example.com", func(_ context.Context, query []byte) ([]byte, error) {
+		name, off, _ := readDNSName(query, 12)
+		id, qtype := binary.BigEndian.Uint16(query), binary.BigEndian.Uint16(query[off:])
+		if qtype == dnsTypeAAAA {
+			return dnsResponse(id, 0, name, qtype, testRR{name, dnsTypeAAAA, 30, net.ParseIP("2001:db8::1")}), nil
+		}
+		return dnsResponse(id, 0, name, qtype, aRecord(name, 90, "192.0.2.1")), nil
+	})
+	if err != nil || len(ips) != 2 || ttl != 30*time.Second {
+		t.Errorf("lookupBoth = %v, %v, %v", ips, ttl, err)
+	}
+
+	// A spoofed answer for another name is not taken.
+	_, _, err = lookupBoth(context.Background(), "cdn.example.com", func(_ context.Context, query []byte) ([]byte, error) {
+		_, off, _ := readDNSName(query, 12)
+		return dnsResponse(binary.BigEndian.Uint16(query), 0, "evil.net", binary.BigEndian.Uint16(query[off:]), aRecord("evil.net", 60, "192.0.2.66")), nil
+	})
+	if err == nil {
+		t.Error("mismatched answers accepted")
+	}
+}
+
+// fakeNameserver answers every query with rcode and, for A queries without
+// an error, ip.
+func fakeNameserver(t *testing.T, rcode byte, ip string) (string, *atomic.Int32) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			query := buf[:n]
+			name, off, _ := readDNSName(query, 12)
+			id, qtype := binary.BigEndian.Uint16(query), binary.BigEndian.Uint16(query[off:])
+			var rrs []testRR
+			if rcode == 0 && qtype == dnsTypeA {
+				rrs = append(rrs, aRecord(name, 60, ip))
+			}
+			pc.WriteTo(dnsResponse(id, rcode, name, qtype, rrs...), addr)
+		}
+	}()
+	return pc.LocalAddr().String(), &queries
+}
+
+func TestNameserversTriedInOrder(t *testing.T) {
+	servfail, _ := fakeNameserver(t, 2, "")
+	nxdomain, _ := fakeNameserver(t, 3, "")
+	good, goodQueries := fakeNameserver(t, 0, "192.0.2.7")
+
+	lookup, err := newDNSUpstream(servfail + "," + good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips, _, err := lookup(context.Background(), "cdn.example.com")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.7")) {
+		t.Errorf("after SERVFAIL: %v, %v", ips, err)
+	}
+
+	// A name that doesn't exist is an answer: the next server isn't asked.
+	goodQueries.Store(0)
+	lookup, _ = newDNSUpstream(nxdomain + "," + good)
+	if _, _, err := lookup(context.Background(), "cdn.example.com"); err == nil || goodQueries.Load() != 0 {
+		t.Errorf("after NXDOMAIN: err %v, %d queries to the next server", err, goodQueries.Load())
+	}
+
+	lookup, _ = newDNSUpstream(servfail)
+	if _, _, err := lookup(context.Background(), "cdn.example.com"); err == nil || !strings.Contains(err.Error(), "rcode 2") {
+		t.Errorf("only SERVFAIL: %v", err)
+	}
+}
+
+func TestDNSQueryIDs(t *testing.T) {
+	seen := make(map[uint16]bool)
+	for range 64 {
+		seen[dnsQueryID()] = true
+	}
+	if len(seen) < 60 {
+		t.Errorf("%d distinct IDs in 64", len(seen))
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	c := NewDNSCache(func(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+		calls.Add(1)
+		<-release
+		switch host {
+		case "short.example.com":
+			return []net.IP{net.ParseIP("192.0.2.1")}, time.Millisecond, nil
+		case "empty.example.com":
+			return nil, time.Minute, nil
+		}
+		return nil, 0, errors.New("lookup failed")
+	})
+
+	// Concurrent misses share one lookup.
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ips, err := c.Resolve(context.Background(), "", "short.example.com"); err != nil || len(ips) != 1 {
+				t.Errorf("Resolve = %v, %v", ips, err)
+			}
+		}()
+	}
+	for c.snapshot()["misses"]+c.snapshot()["coalesced"] < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Errorf("%d lookups for concurrent misses", calls.Load())
+	}
+
+	// TTLs are clamped up to MinDNSTTL, and the case and trailing dot of
+	// the name don't matter.
+	c.Resolve(context.Background(), "", "Short.Example.com.")
+	if calls.Load() != 1 {
+		t.Error("fresh entry looked up again")
+	}
+	if e := c.items["short.example.com"]; time.Until(e.expiresAt) < MinDNSTTL-time.Second {
+		t.Errorf("ttl not clamped: expires in %v", time.Until(e.expiresAt))
+	}
+
+	// Failures and empty answers are remembered for DNSNegativeTTL.
+	for _, host := range []string{"fail.example.com", "empty.example.com"} {
+		for range 2 {
+			if _, err := c.Resolve(context.Background(), "", host); err == nil {
+				t.Errorf("%s resolved", host)
+			}
+		}
+		if e := c.items[host]; e.err == nil || time.Until(e.expiresAt) > DNSNegativeTTL {
+			t.Errorf("%s: negative entry %+v", host, e)
+		}
+	}
+	if calls.Load() != 3 {
+		t.Errorf("%d lookups, want 3", calls.Load())
+	}
+}
+
+func TestDNSCachePinned(t *testing.T) {
+	withConfig(t, &Config{LiveConfig: []LiveSource{{Key: "pinned", SourceOptions: SourceOptions{Resolve: map[string][]string{"cdn.example.com": {"203.0.113.7", "2001:db8::7"}}}}}})
+	c := NewDNSCache(func(context.Context, string) ([]net.IP, time.Duration, error) {
+		t.Error("pinned host looked up")
+		return nil, 0, errors.New("unexpected")
+	})
+	ips, err := c.Resolve(context.Background(), "pinned", "CDN.example.com.")
+	if err != nil || len(ips) != 2 || !ips[0].Equal(net.ParseIP("203.0.113.7")) {
+		t.Errorf("Resolve = %v, %v", ips, err)
+	}
+	if c.snapshot()["overrides"] != 1 {
+		t.Errorf("snapshot = %v", c.snapshot())
+	}
+}
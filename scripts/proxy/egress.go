@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ===== Egress Proxies =====
+//
+// A request profile's egress names an outbound proxy for the upstreams it
+// matches, "http://[user:pass@]host:port" (HTTP CONNECT) or
+// "socks5://[user:pass@]host:port", or "direct" to undo a broader rule.
+// Each egress gets its own client and connection pool. Every config has its
+// own egressPool of these clients plus the direct ones, so connections opened
+// under an old target policy are never reused after a reload. The SSRF guard runs
+// before the tunnel is opened and the proxy is asked to connect to the checked
+// IP, never to a name it would resolve itself, so socks5h is refused and
+// plain http upstreams are tunnelled too. The proxy's own address is the operator's
+// choice and is not checked.
+
+const EgressDirect = "direct"
+
+// egressPool holds the upstream clients of one config.
+type egressPool struct {
+	direct  *http.Client
+	private *http.Client // Direct, for sources with allowPrivate
+
+	mu      sync.Mutex
+	clients map[string]*http.Client // By egress proxy, "|private" appended
+}
+
+// Dial counters outlive the pools of replaced configs.
+var egressDials, egressDialErrors atomic.Int64
+
+func newEgressPool() *egressPool {
+	return &egressPool{
+		direct:  newUpstreamClient(upstreamDialer.DialContext),
+		private: newUpstreamClient(upstreamDialer.DialContext),
+		clients: make(map[string]*http.Client),
+	}
+}
+
+// sourceKeyCtx carries the moontv-source a request is made for.
+type sourceKeyCtx struct{}
+
+func withSourceKey(ctx context.Context, sourceKey string) context.Context {
+	return context.WithValue(ctx, sourceKeyCtx{}, sourceKey)
+}
+
+func sourceKeyOf(ctx context.Context) string {
+	s, _ := ctx.Value(sourceKeyCtx{}).(string)
+	return s
+}
+
+// clientFor returns the client for a request to targetURL, going through the
+// egress of the request profile of the source in ctx. Sources with
+// allowPrivate get pools of their own, so other sources can't reuse their
+// connections to private addresses.
+func clientFor(ctx context.Context, targetURL string) *http.Client {
+	cfg, sourceKey := configOf(ctx), sourceKeyOf(ctx)
+	p := cfg.requestProfile(sourceKey, targetURL)
+	private := cfg.sourceOptions(sourceKey).AllowPrivate
+	if p.Egress == "" || p.Egress == EgressDirect {
+		if private {
+			return cfg.egress.private
+		}
+		return cfg.egress.direct
+	}
+	return cfg.egress.client(p.Egress, private)
+}
+
+func (e *egressPool) client(proxy string, private bool) *http.Client {
+	key := proxy
+	if private {
+		key += "|private"
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if c, ok := e.clients[key]; ok {
+		return c
+	}
+	u, err := parseEgress(proxy)
+	if err != nil {
+		// Rejected when the config was loaded; fail the request, not open.
+		return &http.Client{Transport: failingTransport{err}}
+	}
+	c := newUpstreamClient(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		egressDials.Add(1)
+		conn, err := dialEgress(ctx, u, addr)
+		if err != nil {
+			egressDialErrors.Add(1)
+			return nil, fmt.Errorf("egress %s: %w", u.Host, err)
+		}
+		return conn, nil
+	})
+	e.clients[key] = c
+	return c
+}
+
+// closeIdleConnections closes the pool's idle connections once its config
+// has been replaced.
+func (e *egressPool) closeIdleConnections() {
+	e.direct.CloseIdleConnections()
+	e.private.CloseIdleConnections()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, c := range e.clients {
+		c.CloseIdleConnections()
+	}
+}
+
+func (e *egressPool) snapshot() map[string]int64 {
+	e.mu.Lock()
+	n := len(e.clients)
+	e.mu.Unlock()
+	return map[string]int64{
+		"clients":    int64(n),
+		"dials":      egressDials.Load(),
+		"dialErrors": egressDialErrors.Load(),
+	}
+}
+
+type failingTransport struct{ err error }
+
+func (t failingTransport) RoundTrip(*http.Request) (*http.Response, error) { return nil, t.err }
+
+func parseEgress(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "socks5":
+	case "socks5h":
+		// The proxy would resolve the name itself, past the SSRF guard.
+		return nil, errors.New("socks5h is not supported, use socks5")
+	default:
+		return nil, fmt.Errorf("unsupported egress scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, errors.New("egress needs host:port")
+	}
+	return u, nil
+}
+
+// dialEgress opens a tunnel through proxy to target, an ip:port.
+func dialEgress(ctx context.Context, proxy *url.URL, target string) (net.Conn, error) {
+	conn, err := upstreamDialer.DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(upstreamDialer.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	if proxy.Scheme == "http" {
+		conn, err = connectHTTP(conn, proxy, target)
+	} else {
+		err = connectSOCKS5(conn, proxy, target)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// bufferedConn returns bytes the proxy sent after its response first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func connectHTTP(conn net.Conn, proxy *url.URL, target string) (net.Conn, error) {
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: target}, Host: target, Header: http.Header{}}
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(proxy.User.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("CONNECT: %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+func connectSOCKS5(conn net.Conn, proxy *url.URL, target string) error {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil {
+		return fmt.Errorf("socks5: invalid target %q", target)
+	}
+
+	methods := []byte{0x00}
+	if proxy.User != nil {
+		methods = []byte{0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != methods[0] {
+		return errors.New("socks5: authentication method rejected")
+	}
+	if proxy.User != nil {
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("socks5: credentials too long")
+		}
+		msg := append([]byte{0x01, byte(len(user))}, user...)
+		msg = append(append(msg, byte(len(pass))), pass...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("socks5: authentication failed")
+		}
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 0x01), ip4...)
+	} else {
+		req = append(append(req, 0x04), ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("socks5: connect failed (reply %d)", head[1])
+	}
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		if _, err := io.ReadFull(conn, head[:1]); err != nil {
+			return err
+		}
+		skip = int(head[0])
+	default:
+		return errors.New("socks5: malformed reply")
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2)) // Bound address and port
+	return err
+}
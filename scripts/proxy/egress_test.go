@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeProxy accepts one connection, runs handshake on it and then relays it
+// to the address the handshake returned.
+func fakeProxy(t *testing.T, handshake func(conn net.Conn, br *bufio.Reader) (string, error)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		target, err := handshake(conn, br)
+		if err != nil {
+			return
+		}
+		up, err := net.Dial("tcp", target)
+		if err != nil {
+			return
+		}
+		defer up.Close()
+		go io.Copy(up, br)
+		io.Copy(conn, up)
+	}()
+	return ln.Addr().String()
+}
+
+// socks5Handshake serves the proxy side of a SOCKS5 CONNECT to an IPv4
+// address, requiring user/pass authentication if user is set.
+func socks5Handshake(user, pass string) func(net.Conn, *bufio.Reader) (string, error) {
+	return func(conn net.Conn, br *bufio.Reader) (string, error) {
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(br, head); err != nil || head[0] != 0x05 {
+			return "", errors.New("bad greeting")
+		}
+		io.ReadFull(br, make([]byte, head[1]))
+		if user == "" {
+			conn.Write([]byte{0x05, 0x00})
+		} else {
+			conn.Write([]byte{0x05, 0x02})
+			io.ReadFull(br, head)
+			u := make([]byte, head[1])
+			io.ReadFull(br, u)
+			io.ReadFull(br, head[:1])
+			p := make([]byte, head[0])
+			io.ReadFull(br, p)
+			if string(u) != user || string(p) != pass {
+				conn.Write([]byte{0x01, 0x01})
+				return "", errors.New("bad credentials")
+			}
+			conn.Write([]byte{0x01, 0x00})
+		}
+		req := make([]byte, 4+net.IPv4len+2)
+		if _, err := io.ReadFull(br, req); err != nil || req[1] != 0x01 || req[3] != 0x01 {
+			return "", errors.New("bad request")
+		}
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		port := binary.BigEndian.Uint16(req[8:])
+		return net.JoinHostPort(net.IP(req[4:8]).String(), strconv.Itoa(int(port))), nil
+	}
+}
+
+// connectHandshake serves the proxy side of an HTTP CONNECT, requiring auth
+// as the Proxy-Authorization header.
+func connectHandshake(auth string) func(net.Conn, *bufio.Reader) (string, error) {
+	return func(conn net.Conn, br *bufio.Reader) (string, error) {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return "", err
+		}
+		if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != auth {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return "", errors.New("rejected")
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		return req.Host, nil
+	}
+}
+
+// echoServer answers "hello" to every connection.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestDialEgress(t *testing.T) {
+	target := echoServer(t)
+	tests := []struct {
+		name      string
+		scheme    string
+		user      *url.Userinfo
+		handshake func(net.Conn, *bufio.Reader) (string, error)
+		ok        bool
+	}{
+		{"socks5", "socks5", nil, socks5Handshake("", ""), true},
+		{"socks5 auth", "socks5", url.UserPassword("u", "p"), socks5Handshake("u", "p"), true},
+		{"socks5 bad auth", "socks5", url.UserPassword("u", "x"), socks5Handshake("u", "p"), false},
+		{"socks5 auth required", "socks5", nil, socks5Handshake("u", "p"), false},
+		{"connect", "http", nil, connectHandshake(""), true},
+		{"connect auth", "http", url.UserPassword("u", "p"), connectHandshake("Basic dTpw"), true},
+		{"connect rejected", "http", nil, connectHandshake("Basic dTpw"), false},
+	}
+	for _, tt := range tests {
+		proxy := &url.URL{Scheme: tt.scheme, Host: fakeProxy(t, tt.handshake), User: tt.user}
+		conn, err := dialEgress(context.Background(), proxy, target)
+		if !tt.ok {
+			if err == nil {
+				conn.Close()
+				t.Errorf("%s: dial succeeded", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got, _ := io.ReadAll(conn)
+		conn.Close()
+		if string(got) != "hello" {
+			t.Errorf("%s: read %q through the tunnel", tt.name, got)
+		}
+	}
+}
+
+func TestParseEgress(t *testing.T) {
+	tests := map[string]bool{
+		"http://proxy:3128":       true,
+		"socks5://u:p@proxy:1080": true,
+		"socks5h://proxy:1080":    false,
+		"https://proxy:443":       false,
+		"socks5://proxy":          false,
+		"http://:3128":            false,
+		"socks5://[::1]:1080":     true,
+		"ftp://proxy:21":          false,
+	}
+	for raw, ok := range tests {
+		if _, err := parseEgress(raw); (err == nil) != ok {
+			t.Errorf("parseEgress(%q) = %v, want ok %v", raw, err, ok)
+		}
+	}
+	if err := (&RequestProfile{Egress: "socks5h://proxy:1080"}).validate(); err == nil || !strings.Contains(err.Error(), "socks5h") {
+		t.Errorf("socks5h egress validated: %v", err)
+	}
+}
+
+func TestEgressClient(t *testing.T) {
+	srv, ctx := testUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "via proxy")
+	}))
+	proxy := "socks5://" + fakeProxy(t, socks5Handshake("", ""))
+	cfg := *getConfig()
+	cfg.RequestProfiles = []HostRequestProfile{{Hosts: []string{"127.0.0.1"}, RequestProfile: RequestProfile{Egress: proxy}}}
+	withConfig(t, &cfg)
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+	resp, err := clientFor(ctx, srv.URL).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "via proxy" || egressDials.Load() == 0 {
+		t.Errorf("body %q, %d egress dials", body, egressDials.Load())
+	}
+}
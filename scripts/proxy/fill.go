@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ===== Streaming Fill =====
+//
+// A cache miss starts one upstream fetch per cache key. Its body is teed into
+// a shared buffer while it downloads: the first viewer streams bytes as they
+// arrive, concurrent viewers of the same key attach to the same buffer, and
+// the completed buffer is committed to the cache at the end. Bodies larger
+// than MaxSegmentSize keep streaming to the attached viewers but are never
+// cached; only their last FillLagWindow bytes are kept, in a ring buffer, and
+// viewers who fall further behind are cut off.
+//
+// The fetch runs on its own context, reference-counted by the attached
+// viewers. It is cancelled only when the last viewer leaves, unless it is
+// close enough to done to finish into the cache. It keeps the values of the
+// starting viewer's context, so its upstream logging carries that request ID.
+
+const (
+	fillChunkSize       = 32 * 1024
+	SegmentFetchTimeout = 60 * time.Second
+	FillFinishRatio     = 0.75            // Keep fetching without viewers past this share of Content-Length
+	FillFinishBytes     = 1 * 1024 * 1024 // ...or when this little is left
+	FillLagWindow       = 4 * 1024 * 1024 // Bytes an overflowed fill keeps for viewers behind it
+)
+
+var errFillLagging = errors.New("fill: viewer fell behind the stream")
+
+type coalesceStats struct {
+	Fetches  atomic.Int64 // Upstream fetches started
+	Hits     atomic.Int64 // Viewers attached to an in-flight fetch
+	Waits    atomic.Int64 // Viewers that blocked waiting for upstream headers
+	Cancels  atomic.Int64 // Fetches cancelled after the last viewer left
+	Orphaned atomic.Int64 // Fetches kept running after the last viewer left
+	Lagging  atomic.Int64 // Viewers cut off for falling behind an overflowed fetch
+}
+
+var fillStats coalesceStats
+
+func (s *coalesceStats) snapshot() map[string]int64 {
+	return map[string]int64{
+		"fetches":  s.Fetches.Load(),
+		"hits":     s.Hits.Load(),
+		"waits":    s.Waits.Load(),
+		"cancels":  s.Cancels.Load(),
+		"orphaned": s.Orphaned.Load(),
+		"lagging":  s.Lagging.Load(),
+	}
+}
+
+type fillSource func(ctx context.Context) (io.ReadCloser, http.Header, error)
+
+type segmentFill struct {
+	group    *fillGroup
+	key      string
+	cancel   context.CancelFunc
+	expected int64 // Content-Length, or -1 if unknown
+
+	mu       sync.Mutex
+	changed  chan struct{} // Closed and replaced on every state change
+	header   http.Header
+	ready    bool
+	buf      []byte // The whole body, until it overflows
+	ring     []byte // The last FillLagWindow bytes, once overflowed
+	size     int64  // Bytes received so far
+	overflow bool
+	done     bool
+	err      error
+	readers  map[*fillReader]struct{}
+}
+
+type fillGroup struct {
+	mu sync.Mutex
+	m  map[string]*segmentFill
+}
+
+var segmentFills fillGroup
+
+// join attaches to the in-progress fill for key, or starts one from source.
+// ctx only bounds this viewer; the fetch itself runs on a detached context.
+// leader reports whether this call started the fetch.
+func (g *fillGroup) join(ctx context.Context, key string, source fillSource, commit func([]byte, http.Header)) (r *fillReader, leader bool) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*segmentFill)
+	}
+	if f, ok := g.m[key]; ok {
+		if r := f.attach(ctx); r != nil {
+			g.mu.Unlock()
+			fillStats.Hits.Add(1)
+			return r, false
+		}
+	}
+	fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), SegmentFetchTimeout)
+	f := &segmentFill{group: g, key: key, cancel: cancel, expected: -1, changed: make(chan struct{}), readers: make(map[*fillReader]struct{})}
+	g.m[key] = f
+	r = f.attach(ctx)
+	g.mu.Unlock()
+
+	fillStats.Fetches.Add(1)
+	go g.run(fetchCtx, key, f, source, commit)
+	return r, true
+}
+
+func (g *fillGroup) forget(key string, f *segmentFill) {
+	g.mu.Lock()
+	if g.m[key] == f {
+		delete(g.m, key)
+	}
+	g.mu.Unlock()
+}
+
+// inFlight reports whether a fetch for key is running.
+func (g *fillGroup) inFlight(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.m[key]
+	return ok
+}
+
+// forgetMatching detaches in-flight fills whose key matches. Their viewers
+// keep streaming, but newcomers start a fresh fetch.
+func (g *fillGroup) forgetMatching(match func(key string) bool) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := 0
+	for key := range g.m {
+		if match(key) {
+			delete(g.m, key)
+			n++
+		}
+	}
+	return n
+}
+
+func (g *fillGroup) run(ctx context.Context, key string, f *segmentFill, source fillSource, commit func([]byte, http.Header)) {
+	defer g.forget(key, f)
+	defer f.cancel()
+	body, h, err := source(ctx)
+	if err != nil {
+		f.finish(err)
+		return
+	}
+	defer body.Close()
+
+	f.mu.Lock()
+	f.header = h
+	f.ready = true
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && n > 0 {
+		f.expected = n
+		if n <= MaxSegmentSize {
+			f.buf = make([]byte, 0, n)
+		}
+	}
+	f.broadcast()
+	f.mu.Unlock()
+
+	chunk := make([]byte, fillChunkSize)
+	for {
+		n, err := body.Read(chunk)
+		if n > 0 {
+			f.mu.Lock()
+			if f.overflow {
+				f.ringWrite(chunk[:n])
+			} else {
+				f.buf = append(f.buf, chunk[:n]...)
+				f.size += int64(n)
+			}
+			overflowed := !f.overflow && f.size > MaxSegmentSize
+			if overflowed {
+				f.startRing()
+			}
+			f.broadcast()
+			f.mu.Unlock()
+			if overflowed {
+				g.forget(key, f) // Newcomers can't start from the beginning
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			// Only this goroutine appends, and buf is only dropped on
+			// overflow, so the completed buffer can be read without the lock.
+			if err == nil && !f.overflow {
+				commit(f.buf, h)
+			}
+			f.finish(err)
+			return
+		}
+	}
+}
+
+// attach registers a new reader, or returns nil if the body overflowed.
+func (f *segmentFill) attach(ctx context.Context) *fillReader {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.overflow {
+		return nil
+	}
+	r := &fillReader{f: f, ctx: ctx}
+	f.readers[r] = struct{}{}
+	return r
+}
+
+func (f *segmentFill) finish(err error) {
+	f.mu.Lock()
+	f.done = true
+	f.err = err
+	f.broadcast()
+	f.mu.Unlock()
+}
+
+func (f *segmentFill) broadcast() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// startRing moves the tail of an overflowing body into the ring buffer.
+func (f *segmentFill) startRing() {
+	f.overflow = true
+	f.ring = make([]byte, FillLagWindow)
+	tail := f.buf[max(0, len(f.buf)-FillLagWindow):]
+	f.buf = nil
+	f.size -= int64(len(tail))
+	f.ringWrite(tail)
+}
+
+func (f *segmentFill) ringWrite(p []byte) {
+	for len(p) > 0 {
+		n := copy(f.ring[f.size%int64(len(f.ring)):], p)
+		p = p[n:]
+		f.size += int64(n)
+	}
+}
+
+// readAt copies body bytes from off, which must be below f.size, into p.
+func (f *segmentFill) readAt(p []byte, off int64) (int, error) {
+	if !f.overflow {
+		return copy(p, f.buf[off:]), nil
+	}
+	window := int64(len(f.ring))
+	if f.size-off > window {
+		return 0, errFillLagging
+	}
+	i := off % window
+	return copy(p, f.ring[i:min(window, i+f.size-off)]), nil
+}
+
+// fillReader is one viewer's cursor into a segmentFill.
+type fillReader struct {
+	f   *segmentFill
+	ctx context.Context
+	off int64
+}
+
+// closeToDone reports whether the fetch should finish without viewers.
+func (f *segmentFill) closeToDone() bool {
+	if f.expected <= 0 || f.overflow {
+		return false
+	}
+	return float64(f.size) >= float64(f.expected)*FillFinishRatio || f.expected-f.size <= FillFinishBytes
+}
+
+// Header waits for the upstream response headers.
+func (r *fillReader) Header() (http.Header, error) {
+	f := r.f
+	for waited := false; ; waited = true {
+		f.mu.Lock()
+		if f.ready {
+			h := f.header
+			f.mu.Unlock()
+			return h, nil
+		}
+		if f.done {
+			err := f.err
+			f.mu.Unlock()
+			return nil, err
+		}
+		changed := f.changed
+		f.mu.Unlock()
+		if !waited {
+			fillStats.Waits.Add(1)
+		}
+		select {
+		case <-changed:
+		case <-r.ctx.Done():
+			return nil, r.ctx.Err()
+		}
+	}
+}
+
+func (r *fillReader) Read(p []byte) (int, error) {
+	f := r.f
+	for {
+		f.mu.Lock()
+		if r.off < f.size {
+			n, err := f.readAt(p, r.off)
+			r.off += int64(n)
+			f.mu.Unlock()
+			if err == errFillLagging {
+				fillStats.Lagging.Add(1)
+			}
+			return n, err
+		}
+		if f.done {
+			err := f.err
+			f.mu.Unlock()
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+// Close detaches the reader. The last reader to leave an unfinished fill cancels the upstream fetch
+// unless it is close to done.
+func (r *fillReader) Close() error {
+	f, g := r.f, r.f.group
+	// Lock order matches join so nobody can attach to a fill being abandoned.
+	g.mu.Lock()
+	f.mu.Lock()
+	delete(f.readers, r)
+	abandon, orphan := false, false
+	if len(f.readers) == 0 && !f.done {
+		if f.closeToDone() {
+			orphan = true
+		} else {
+			abandon = true
+			if g.m[f.key] == f {
+				delete(g.m, f.key) // Newcomers start a fresh fetch
+			}
+		}
+	}
+	f.mu.Unlock()
+	g.mu.Unlock()
+
+	switch {
+	case abandon:
+		fillStats.Cancels.Add(1)
+		f.cancel()
+	case orphan:
+		fillStats.Orphaned.Add(1)
+	}
+	return nil
+}
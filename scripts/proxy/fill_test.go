@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pipeSource is a fillSource whose body the test writes.
+func pipeSource(calls *atomic.Int32, started chan<- context.Context) (fillSource, *io.PipeWriter) {
+	pr, pw := io.Pipe()
+	return func(ctx context.Context) (io.ReadCloser, http.Header, error) {
+		calls.Add(1)
+		if started != nil {
+			started <- ctx
+		}
+		return pr, http.Header{"Content-Type": {"video/mp2t"}}, nil
+	}, pw
+}
+
+func TestFillCoalesces(t *testing.T) {
+	var g fillGroup
+	var calls atomic.Int32
+	source, pw := pipeSource(&calls, nil)
+	committed := make(chan []byte, 1)
+	commit := func(b []byte, _ http.Header) { committed <- b }
+
+	a, leader := g.join(context.Background(), "k", source, commit)
+	b, follower := g.join(context.Background(), "k", source, commit)
+	if !leader || follower {
+		t.Fatalf("leader = %v, second leader = %v", leader, follower)
+	}
+	body := bytes.Repeat([]byte("0123456789"), 10000)
+	go func() {
+		pw.Write(body)
+		pw.Close()
+	}()
+	for _, r := range []*fillReader{a, b} {
+		if h, err := r.Header(); err != nil || h.Get("Content-Type") != "video/mp2t" {
+			t.Fatalf("Header() = %v, %v", h, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, body) {
+			t.Errorf("read %d bytes, %v", len(got), err)
+		}
+		r.Close()
+	}
+	if got := <-committed; !bytes.Equal(got, body) {
+		t.Errorf("committed %d bytes", len(got))
+	}
+	if calls.Load() != 1 {
+		t.Errorf("%d upstream fetches, want 1", calls.Load())
+	}
+}
+
+func TestFillCutsOffLaggingReader(t *testing.T) {
+	var g fillGroup
+	var calls atomic.Int32
+	source, pw := pipeSource(&calls, nil)
+	commit := func([]byte, http.Header) { t.Error("overflowed body committed") }
+
+	fast, _ := g.join(context.Background(), "k", source, commit)
+	slow, _ := g.join(context.Background(), "k", source, commit)
+	defer fast.Close()
+	defer slow.Close()
+
+	step := bytes.Repeat([]byte{'x'}, 1<<20)
+	buf := make([]byte, len(step))
+	for written := 0; written <= MaxSegmentSize+FillLagWindow; written += len(step) {
+		if _, err := pw.Write(step); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(fast, buf); err != nil {
+			t.Fatalf("fast reader at %d: %v", written, err)
+		}
+	}
+	if g.inFlight("k") {
+		t.Error("overflowed fill still joinable")
+	}
+	if _, err := slow.Read(buf); err != errFillLagging {
+		t.Errorf("slow reader: %v, want errFillLagging", err)
+	}
+	pw.Close()
+	if _, err := io.ReadAll(fast); err != nil {
+		t.Errorf("fast reader: %v", err)
+	}
+}
+
+func TestFillCancelsWhenLastViewerLeaves(t *testing.T) {
+	var g fillGroup
+	var calls atomic.Int32
+	started := make(chan context.Context, 1)
+	source, pw := pipeSource(&calls, started)
+	defer pw.Close()
+
+	r, _ := g.join(context.Background(), "k", source, func([]byte, http.Header) {})
+	fetchCtx := <-started
+	r.Close()
+	select {
+	case <-fetchCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("fetch not cancelled")
+	}
+	if g.inFlight("k") {
+		t.Error("abandoned fill still joinable")
+	}
+}
+
+func TestFillSurvivesLeaderCancel(t *testing.T) {
+	var g fillGroup
+	var calls atomic.Int32
+	started := make(chan context.Context, 1)
+	source, pw := pipeSource(&calls, started)
+	committed := make(chan []byte, 1)
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leader, _ := g.join(leaderCtx, "k", source, func(b []byte, _ http.Header) { committed <- b })
+	follower, _ := g.join(context.Background(), "k", source, nil)
+	fetchCtx := <-started
+
+	cancelLeader()
+	leader.Close()
+	if fetchCtx.Err() != nil {
+		t.Fatal("fetch cancelled with the first viewer")
+	}
+	go func() {
+		pw.Write([]byte("segment"))
+		pw.Close()
+	}()
+	if got, err := io.ReadAll(follower); err != nil || string(got) != "segment" {
+		t.Errorf("follower read %q, %v", got, err)
+	}
+	follower.Close()
+	if got := <-committed; string(got) != "segment" {
+		t.Errorf("committed %q", got)
+	}
+}
@@ -0,0 +1,115 @@
+package hls
+
+import (
+	"strings"
+)
+
+// Attribute is a single NAME=VALUE pair of an attribute list.
+type Attribute struct {
+	Key    string
+	Value  string // Unquoted value
+	Quoted bool   // Value was (and will be) written as a quoted-string
+}
+
+// AttributeList is an ordered attribute list (RFC 8216 §4.2).
+// Order and quoting are preserved so that untouched tags round-trip verbatim.
+type AttributeList []Attribute
+
+// ParseAttributeList parses the value part of an attribute-list tag.
+// It is lenient: stray whitespace is trimmed and an unterminated quoted-string
+// runs to the end of the input.
+func ParseAttributeList(s string) AttributeList {
+	var out AttributeList
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return out
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return out
+		}
+		a := Attribute{Key: strings.TrimSpace(s[:eq])}
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		if strings.HasPrefix(s, `"`) {
+			a.Quoted = true
+			if end := strings.IndexByte(s[1:], '"'); end >= 0 {
+				a.Value = s[1 : 1+end]
+				s = s[end+2:]
+			} else {
+				a.Value = s[1:]
+				s = ""
+			}
+		} else if end := strings.IndexByte(s, ','); end >= 0 {
+			a.Value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		} else {
+			a.Value = strings.TrimSpace(s)
+			s = ""
+		}
+		out = append(out, a)
+	}
+}
+
+// Lookup returns the value of key and whether it is present.
+func (l AttributeList) Lookup(key string) (string, bool) {
+	for _, a := range l {
+		if a.Key == key {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// Get returns the value of key, or "" if absent.
+func (l AttributeList) Get(key string) string {
+	v, _ := l.Lookup(key)
+	return v
+}
+
+// Set replaces the value of key in place, or appends it if absent.
+func (l *AttributeList) Set(key, value string, quoted bool) {
+	for i := range *l {
+		if (*l)[i].Key == key {
+			(*l)[i].Value = value
+			(*l)[i].Quoted = quoted
+			return
+		}
+	}
+	*l = append(*l, Attribute{Key: key, Value: value, Quoted: quoted})
+}
+
+// Del removes key from the list.
+func (l *AttributeList) Del(key string) {
+	out := (*l)[:0]
+	for _, a := range *l {
+		if a.Key != key {
+			out = append(out, a)
+		}
+	}
+	*l = out
+}
+
+// Clone returns a copy that can be modified independently.
+func (l AttributeList) Clone() AttributeList {
+	return append(AttributeList(nil), l...)
+}
+
+func (l AttributeList) String() string {
+	var b strings.Builder
+	for i, a := range l {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(a.Key)
+		b.WriteByte('=')
+		if a.Quoted {
+			b.WriteByte('"')
+			b.WriteString(a.Value)
+			b.WriteByte('"')
+		} else {
+			b.WriteString(a.Value)
+		}
+	}
+	return b.String()
+}
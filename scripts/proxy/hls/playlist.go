@@ -0,0 +1,721 @@
+// Package hls is a small typed model of HLS playlists (RFC 8216).
+// Playlists decode into a MasterPlaylist or MediaPlaylist whose URIs are
+// addressable by the tag they belong to, and encode back to text.
+package hls
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Tag names used by the decoder and encoder.
+const (
+	TagHeader                = "EXTM3U"
+	TagInf                   = "EXTINF"
+	TagVersion               = "EXT-X-VERSION"
+	TagTargetDuration        = "EXT-X-TARGETDURATION"
+	TagMediaSequence         = "EXT-X-MEDIA-SEQUENCE"
+	TagDiscontinuitySequence = "EXT-X-DISCONTINUITY-SEQUENCE"
+	TagPlaylistType          = "EXT-X-PLAYLIST-TYPE"
+	TagIFramesOnly           = "EXT-X-I-FRAMES-ONLY"
+	TagIndependentSegments   = "EXT-X-INDEPENDENT-SEGMENTS"
+	TagStart                 = "EXT-X-START"
+	TagDefine                = "EXT-X-DEFINE"
+	TagServerControl         = "EXT-X-SERVER-CONTROL"
+	TagPartInf               = "EXT-X-PART-INF"
+	TagAllowCache            = "EXT-X-ALLOW-CACHE"
+	TagSkip                  = "EXT-X-SKIP"
+	TagEndlist               = "EXT-X-ENDLIST"
+	TagDiscontinuity         = "EXT-X-DISCONTINUITY"
+	TagByteRange             = "EXT-X-BYTERANGE"
+	TagKey                   = "EXT-X-KEY"
+	TagMap                   = "EXT-X-MAP"
+	TagProgramDateTime       = "EXT-X-PROGRAM-DATE-TIME"
+	TagGap                   = "EXT-X-GAP"
+	TagPart                  = "EXT-X-PART"
+	TagPreloadHint           = "EXT-X-PRELOAD-HINT"
+	TagRenditionReport       = "EXT-X-RENDITION-REPORT"
+	TagDateRange             = "EXT-X-DATERANGE"
+	TagMedia                 = "EXT-X-MEDIA"
+	TagStreamInf             = "EXT-X-STREAM-INF"
+	TagIFrameStreamInf       = "EXT-X-I-FRAME-STREAM-INF"
+	TagSessionData           = "EXT-X-SESSION-DATA"
+	TagSessionKey            = "EXT-X-SESSION-KEY"
+	TagContentSteering       = "EXT-X-CONTENT-STEERING"
+)
+
+// Encryption methods of EXT-X-KEY.
+const (
+	MethodNone      = "NONE"
+	MethodAES128    = "AES-128"
+	MethodSampleAES = "SAMPLE-AES"
+)
+
+// ErrEmpty is returned when the input holds no tags and no URIs.
+var ErrEmpty = errors.New("hls: empty playlist")
+
+var attributeListTags = map[string]bool{
+	TagKey: true, TagMap: true, TagMedia: true, TagStreamInf: true, TagIFrameStreamInf: true,
+	TagSessionData: true, TagSessionKey: true, TagStart: true, TagDateRange: true, TagPart: true,
+	TagPartInf: true, TagServerControl: true, TagPreloadHint: true, TagRenditionReport: true,
+	TagSkip: true, TagContentSteering: true, TagDefine: true,
+}
+
+// Tags that describe the whole media playlist rather than the next segment.
+var mediaHeaderTags = map[string]bool{
+	TagVersion: true, TagTargetDuration: true, TagMediaSequence: true, TagDiscontinuitySequence: true,
+	TagPlaylistType: true, TagIFramesOnly: true, TagIndependentSegments: true, TagStart: true,
+	TagDefine: true, TagServerControl: true, TagPartInf: true, TagAllowCache: true, TagSkip: true,
+}
+
+// Tags that belong after the last segment of a media playlist.
+var mediaTrailerTags = map[string]bool{
+	TagEndlist: true, TagPreloadHint: true, TagRenditionReport: true,
+}
+
+// ===== Tags =====
+
+// Tag is one "#..." line. Attribute-list tags carry Attrs; every other tag
+// keeps its raw Value. Comment lines have an empty Name and the comment text
+// in Value.
+type Tag struct {
+	Name  string
+	Value string
+	Attrs AttributeList
+}
+
+// ParseTag parses a line starting with '#'.
+func ParseTag(line string) *Tag {
+	body := strings.TrimPrefix(line, "#")
+	if !strings.HasPrefix(body, "EXT") {
+		return &Tag{Value: body}
+	}
+	t := &Tag{Name: body}
+	if i := strings.IndexByte(body, ':'); i >= 0 {
+		t.Name, t.Value = body[:i], body[i+1:]
+	}
+	if attributeListTags[t.Name] {
+		t.Attrs = ParseAttributeList(t.Value)
+		t.Value = ""
+	}
+	return t
+}
+
+// URI returns the URI attribute of an attribute-list tag.
+func (t *Tag) URI() string { return t.Attrs.Get("URI") }
+
+// SetURI replaces the URI attribute of an attribute-list tag.
+func (t *Tag) SetURI(uri string) { t.Attrs.Set("URI", uri, true) }
+
+func (t *Tag) String() string {
+	if t.Name == "" {
+		return "#" + t.Value
+	}
+	if t.Attrs != nil {
+		return "#" + t.Name + ":" + t.Attrs.String()
+	}
+	if t.Value != "" {
+		return "#" + t.Name + ":" + t.Value
+	}
+	return "#" + t.Name
+}
+
+// ===== Segment attributes =====
+
+// ByteRange is a resolved EXT-X-BYTERANGE (or EXT-X-MAP BYTERANGE) sub-range.
+type ByteRange struct {
+	Length int64
+	Offset int64
+}
+
+// ParseByteRange parses "<n>[@<o>]". hasOffset reports whether "@<o>" was present.
+func ParseByteRange(s string) (br ByteRange, hasOffset bool, err error) {
+	s = strings.TrimSpace(s)
+	n, o, found := strings.Cut(s, "@")
+	if br.Length, err = strconv.ParseInt(n, 10, 64); err != nil || br.Length < 0 {
+		return ByteRange{}, false, fmt.Errorf("hls: invalid byte range %q", s)
+	}
+	if found {
+		if br.Offset, err = strconv.ParseInt(o, 10, 64); err != nil || br.Offset < 0 {
+			return ByteRange{}, false, fmt.Errorf("hls: invalid byte range %q", s)
+		}
+	}
+	return br, found, nil
+}
+
+// End returns the offset one past the last byte of the range.
+func (b ByteRange) End() int64 { return b.Offset + b.Length }
+
+func (b ByteRange) String() string { return fmt.Sprintf("%d@%d", b.Length, b.Offset) }
+
+// Key is one EXT-X-KEY (or EXT-X-SESSION-KEY) entry.
+type Key struct {
+	Attrs AttributeList
+}
+
+func (k *Key) Method() string    { return k.Attrs.Get("METHOD") }
+func (k *Key) URI() string       { return k.Attrs.Get("URI") }
+func (k *Key) SetURI(uri string) { k.Attrs.Set("URI", uri, true) }
+
+// KeyFormat returns KEYFORMAT, defaulting to "identity".
+func (k *Key) KeyFormat() string {
+	if f := k.Attrs.Get("KEYFORMAT"); f != "" {
+		return f
+	}
+	return "identity"
+}
+
+// IV returns the explicit 16-byte IV, if the key carries a valid one.
+func (k *Key) IV() ([]byte, bool) {
+	v := k.Attrs.Get("IV")
+	if len(v) < 3 || (v[:2] != "0x" && v[:2] != "0X") {
+		return nil, false
+	}
+	raw := v[2:]
+	if len(raw) < 32 {
+		raw = strings.Repeat("0", 32-len(raw)) + raw
+	}
+	iv, err := hex.DecodeString(raw)
+	if err != nil || len(iv) != 16 {
+		return nil, false
+	}
+	return iv, true
+}
+
+// SequenceIV returns the implicit IV for a media sequence number (RFC 8216 §5.2).
+func SequenceIV(seq uint64) []byte {
+	iv := make([]byte, 16)
+	for i := 15; i >= 8; i-- {
+		iv[i] = byte(seq)
+		seq >>= 8
+	}
+	return iv
+}
+
+func (k *Key) String() string { return "#" + TagKey + ":" + k.Attrs.String() }
+
+// Map is an EXT-X-MAP media initialization section.
+type Map struct {
+	Attrs AttributeList
+}
+
+func (m *Map) URI() string       { return m.Attrs.Get("URI") }
+func (m *Map) SetURI(uri string) { m.Attrs.Set("URI", uri, true) }
+
+// ByteRange returns the BYTERANGE attribute, if any. A missing offset means 0.
+func (m *Map) ByteRange() (ByteRange, bool) {
+	v, ok := m.Attrs.Lookup("BYTERANGE")
+	if !ok {
+		return ByteRange{}, false
+	}
+	br, _, err := ParseByteRange(v)
+	return br, err == nil
+}
+
+func (m *Map) String() string { return "#" + TagMap + ":" + m.Attrs.String() }
+
+// ===== Playlists =====
+
+// Playlist is either a *MasterPlaylist or a *MediaPlaylist.
+type Playlist interface {
+	Encode() []byte
+}
+
+// MasterPlaylist lists variant streams and renditions.
+// Tags holds every non-variant tag (EXT-X-MEDIA, EXT-X-I-FRAME-STREAM-INF,
+// EXT-X-SESSION-*, ...) in input order; they are written before the variants.
+type MasterPlaylist struct {
+	Tags     []*Tag
+	Variants []*Variant
+}
+
+// Variant is an EXT-X-STREAM-INF tag and the URI that follows it.
+type Variant struct {
+	StreamInf *Tag
+	URI       string
+}
+
+// Bandwidth returns the BANDWIDTH attribute of the variant.
+func (v *Variant) Bandwidth() int64 {
+	if v.StreamInf == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(v.StreamInf.Attrs.Get("BANDWIDTH"), 10, 64)
+	return n
+}
+
+// TagsNamed returns the master playlist tags with the given name.
+func (p *MasterPlaylist) TagsNamed(name string) []*Tag {
+	var out []*Tag
+	for _, t := range p.Tags {
+		if t.Name == name {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// Encode writes the playlist back to text.
+func (p *MasterPlaylist) Encode() []byte {
+	var b bytes.Buffer
+	b.WriteString("#" + TagHeader + "\n")
+	for _, t := range p.Tags {
+		b.WriteString(t.String())
+		b.WriteByte('\n')
+	}
+	for _, v := range p.Variants {
+		if v.StreamInf != nil {
+			b.WriteString(v.StreamInf.String())
+			b.WriteByte('\n')
+		}
+		b.WriteString(v.URI)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// MediaPlaylist is a list of media segments.
+//
+// Header holds the playlist-level tags and Trailer the tags after the last
+// segment; both are written verbatim. The typed fields mirror Header and
+// Trailer as decoded and are informational: use SetMediaSequence and
+// SetDiscontinuitySequence to change the corresponding tags.
+type MediaPlaylist struct {
+	Header   []*Tag
+	Segments []*Segment
+	Trailer  []*Tag
+
+	TargetDuration        float64
+	MediaSequence         uint64
+	DiscontinuitySequence uint64
+	PlaylistType          string
+	Endlist               bool
+}
+
+// Segment is one media segment with its effective key and map state.
+// Keys and Map are shared by consecutive segments until the playlist changes
+// them; the encoder only writes EXT-X-KEY and EXT-X-MAP when they change.
+type Segment struct {
+	URI            string
+	Duration       float64
+	Title          string
+	Discontinuity  bool
+	ByteRange      *ByteRange
+	Keys           []*Key
+	Map            *Map
+	Tags           []*Tag // Other tags preceding the segment (PROGRAM-DATE-TIME, PART, CUE markers, ...)
+	SequenceNumber uint64
+
+	rawDuration string
+}
+
+// Encrypted reports whether the segment has a key whose method is not NONE.
+func (s *Segment) Encrypted() bool {
+	for _, k := range s.Keys {
+		if k.Method() != "" && k.Method() != MethodNone {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys returns every distinct key referenced by the segments.
+func (p *MediaPlaylist) Keys() []*Key {
+	seen := make(map[*Key]bool)
+	var out []*Key
+	for _, s := range p.Segments {
+		for _, k := range s.Keys {
+			if !seen[k] {
+				seen[k] = true
+				out = append(out, k)
+			}
+		}
+	}
+	return out
+}
+
+// Maps returns every distinct media initialization section.
+func (p *MediaPlaylist) Maps() []*Map {
+	seen := make(map[*Map]bool)
+	var out []*Map
+	for _, s := range p.Segments {
+		if s.Map != nil && !seen[s.Map] {
+			seen[s.Map] = true
+			out = append(out, s.Map)
+		}
+	}
+	return out
+}
+
+// Duration returns the sum of all segment durations in seconds.
+func (p *MediaPlaylist) Duration() float64 {
+	var d float64
+	for _, s := range p.Segments {
+		d += s.Duration
+	}
+	return d
+}
+
+// SetMediaSequence rewrites EXT-X-MEDIA-SEQUENCE and renumbers the segments.
+func (p *MediaPlaylist) SetMediaSequence(seq uint64) {
+	p.MediaSequence = seq
+	p.setHeaderValue(TagMediaSequence, strconv.FormatUint(seq, 10))
+	p.renumber()
+}
+
+// SetDiscontinuitySequence rewrites EXT-X-DISCONTINUITY-SEQUENCE.
+func (p *MediaPlaylist) SetDiscontinuitySequence(seq uint64) {
+	p.DiscontinuitySequence = seq
+	p.setHeaderValue(TagDiscontinuitySequence, strconv.FormatUint(seq, 10))
+}
+
+func (p *MediaPlaylist) setHeaderValue(name, value string) {
+	for _, t := range p.Header {
+		if t.Name == name {
+			t.Value = value
+			return
+		}
+	}
+	p.Header = append(p.Header, &Tag{Name: name, Value: value})
+}
+
+func (p *MediaPlaylist) renumber() {
+	for i, s := range p.Segments {
+		s.SequenceNumber = p.MediaSequence + uint64(i)
+	}
+}
+
+// RemoveSegments drops every segment for which drop returns true and keeps
+// the playlist consistent:
+//   - A discontinuity on a dropped segment moves to the next kept segment.
+//   - Dropping leading segments advances EXT-X-MEDIA-SEQUENCE and
+//     EXT-X-DISCONTINUITY-SEQUENCE.
+//   - AES-128 keys with an implicit IV get an explicit IV when a kept
+//     segment's sequence number changes, so decryption keeps working.
+//
+// It returns the number of removed segments.
+func (p *MediaPlaylist) RemoveSegments(drop func(i int, s *Segment) bool) int {
+	kept := p.Segments[:0:0]
+	var leading, leadingDisc uint64
+	carryDisc := false
+	for i, s := range p.Segments {
+		if drop(i, s) {
+			if len(kept) == 0 {
+				leading++
+				if s.Discontinuity {
+					leadingDisc++
+				}
+			} else if s.Discontinuity {
+				carryDisc = true
+			}
+			continue
+		}
+		if carryDisc {
+			s.Discontinuity = true
+			carryDisc = false
+		}
+		kept = append(kept, s)
+	}
+	removed := len(p.Segments) - len(kept)
+	if removed == 0 {
+		return 0
+	}
+	if len(kept) > 0 && leading > 0 && kept[0].Discontinuity {
+		// The first segment's discontinuity is implied by the sequence bump.
+		kept[0].Discontinuity = false
+		leadingDisc++
+	}
+
+	newSeq := p.MediaSequence + leading
+	for i, s := range kept {
+		if s.SequenceNumber != newSeq+uint64(i) {
+			s.Keys = pinImplicitIVs(s.Keys, s.SequenceNumber)
+		}
+	}
+	p.Segments = kept
+	if leading > 0 {
+		p.SetMediaSequence(newSeq)
+	} else {
+		p.renumber()
+	}
+	if leadingDisc > 0 {
+		p.SetDiscontinuitySequence(p.DiscontinuitySequence + leadingDisc)
+	}
+	return removed
+}
+
+// pinImplicitIVs returns keys with the sequence-derived IV made explicit.
+func pinImplicitIVs(keys []*Key, seq uint64) []*Key {
+	needsPin := false
+	for _, k := range keys {
+		if k.Method() == MethodAES128 {
+			if _, ok := k.IV(); !ok {
+				needsPin = true
+			}
+		}
+	}
+	if !needsPin {
+		return keys
+	}
+	out := make([]*Key, len(keys))
+	for i, k := range keys {
+		out[i] = k
+		if k.Method() == MethodAES128 {
+			if _, ok := k.IV(); !ok {
+				attrs := k.Attrs.Clone()
+				attrs.Set("IV", "0x"+hex.EncodeToString(SequenceIV(seq)), false)
+				out[i] = &Key{Attrs: attrs}
+			}
+		}
+	}
+	return out
+}
+
+// Encode writes the playlist back to text.
+func (p *MediaPlaylist) Encode() []byte {
+	var b bytes.Buffer
+	b.WriteString("#" + TagHeader + "\n")
+	for _, t := range p.Header {
+		b.WriteString(t.String())
+		b.WriteByte('\n')
+	}
+	lastKeys, lastMap := "", ""
+	for _, s := range p.Segments {
+		if s.Discontinuity {
+			b.WriteString("#" + TagDiscontinuity + "\n")
+		}
+		keys := encodeKeys(s.Keys)
+		if keys != lastKeys {
+			if keys == "" {
+				keys = "#" + TagKey + ":METHOD=" + MethodNone + "\n"
+			}
+			b.WriteString(keys)
+			lastKeys = keys
+		}
+		if s.Map != nil {
+			if m := s.Map.String(); m != lastMap {
+				b.WriteString(m)
+				b.WriteByte('\n')
+				lastMap = m
+			}
+		}
+		for _, t := range s.Tags {
+			b.WriteString(t.String())
+			b.WriteByte('\n')
+		}
+		b.WriteString("#" + TagInf + ":")
+		b.WriteString(s.durationString())
+		b.WriteByte(',')
+		b.WriteString(s.Title)
+		b.WriteByte('\n')
+		if s.ByteRange != nil {
+			b.WriteString("#" + TagByteRange + ":" + s.ByteRange.String() + "\n")
+		}
+		b.WriteString(s.URI)
+		b.WriteByte('\n')
+	}
+	for _, t := range p.Trailer {
+		b.WriteString(t.String())
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+func encodeKeys(keys []*Key) string {
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func (s *Segment) durationString() string {
+	if s.rawDuration != "" {
+		if d, err := strconv.ParseFloat(s.rawDuration, 64); err == nil && d == s.Duration {
+			return s.rawDuration
+		}
+	}
+	return strconv.FormatFloat(s.Duration, 'f', -1, 64)
+}
+
+// ===== Decoding =====
+
+// Decode parses a master or media playlist. It is lenient about missing
+// #EXTM3U headers, CRLF line endings, blank lines and unknown tags.
+func Decode(data []byte) (Playlist, error) {
+	lines := splitLines(data)
+	if len(lines) == 0 {
+		return nil, ErrEmpty
+	}
+	if isMaster(lines) {
+		return decodeMaster(lines), nil
+	}
+	return decodeMedia(lines), nil
+}
+
+func splitLines(data []byte) []string {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	var out []string
+	for _, l := range strings.Split(string(data), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+func tagName(line string) string {
+	name := strings.TrimPrefix(line, "#")
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+func isMaster(lines []string) bool {
+	master := false
+	for _, l := range lines {
+		if !strings.HasPrefix(l, "#EXT") {
+			continue
+		}
+		switch tagName(l) {
+		case TagInf:
+			return false
+		case TagStreamInf, TagIFrameStreamInf, TagMedia, TagSessionData, TagSessionKey:
+			master = true
+		}
+	}
+	return master
+}
+
+func decodeMaster(lines []string) *MasterPlaylist {
+	p := &MasterPlaylist{}
+	var inf *Tag
+	for _, l := range lines {
+		if !strings.HasPrefix(l, "#") {
+			p.Variants = append(p.Variants, &Variant{StreamInf: inf, URI: l})
+			inf = nil
+			continue
+		}
+		t := ParseTag(l)
+		switch t.Name {
+		case TagHeader:
+		case TagStreamInf:
+			inf = t
+		default:
+			p.Tags = append(p.Tags, t)
+		}
+	}
+	return p
+}
+
+func decodeMedia(lines []string) *MediaPlaylist {
+	p := &MediaPlaylist{}
+	seg := &Segment{}
+	var keys []*Key
+	var curMap *Map
+	var pending []*Tag // Tags since the last URI, in input order
+	keyRun := false    // Consecutive EXT-X-KEY tags form one key set
+	hasRangeOffset := false
+	var prevRangeEnd int64
+	prevRangeURI := ""
+
+	for _, l := range lines {
+		if !strings.HasPrefix(l, "#") {
+			seg.URI = l
+			seg.Keys = keys
+			seg.Map = curMap
+			if seg.ByteRange != nil && !hasRangeOffset {
+				if prevRangeURI == l {
+					seg.ByteRange.Offset = prevRangeEnd
+				}
+			}
+			if seg.ByteRange != nil {
+				prevRangeEnd, prevRangeURI = seg.ByteRange.End(), l
+			} else {
+				prevRangeURI = ""
+			}
+			p.Segments = append(p.Segments, seg)
+			seg = &Segment{}
+			// Trailer tags ahead of a segment still go after the last one.
+			for _, t := range pending {
+				if mediaTrailerTags[t.Name] {
+					p.Trailer = append(p.Trailer, t)
+				}
+			}
+			pending = nil
+			hasRangeOffset = false
+			keyRun = false
+			continue
+		}
+
+		t := ParseTag(l)
+		if t.Name != TagKey {
+			keyRun = false
+		}
+		if !mediaHeaderTags[t.Name] && t.Name != TagHeader {
+			pending = append(pending, t)
+		}
+		switch {
+		case t.Name == TagHeader:
+		case t.Name == TagInf:
+			d, title, _ := strings.Cut(t.Value, ",")
+			seg.rawDuration = strings.TrimSpace(d)
+			seg.Duration, _ = strconv.ParseFloat(seg.rawDuration, 64)
+			seg.Title = title
+		case t.Name == TagByteRange:
+			if br, hasOffset, err := ParseByteRange(t.Value); err == nil {
+				seg.ByteRange = &br
+				hasRangeOffset = hasOffset
+			}
+		case t.Name == TagDiscontinuity:
+			seg.Discontinuity = true
+		case t.Name == TagKey:
+			if !keyRun {
+				keys = nil
+			}
+			keyRun = true
+			k := &Key{Attrs: t.Attrs}
+			if k.Method() == MethodNone {
+				keys = nil
+			} else {
+				keys = append(keys, k)
+			}
+		case t.Name == TagMap:
+			curMap = &Map{Attrs: t.Attrs}
+		case mediaHeaderTags[t.Name]:
+			p.Header = append(p.Header, t)
+			p.decodeHeaderTag(t)
+		case mediaTrailerTags[t.Name]:
+			if t.Name == TagEndlist {
+				p.Endlist = true
+			}
+		default:
+			seg.Tags = append(seg.Tags, t)
+		}
+	}
+	// Tags after the last URI have no segment to attach to; keep them as
+	// they were.
+	p.Trailer = append(p.Trailer, pending...)
+	p.renumber()
+	return p
+}
+
+func (p *MediaPlaylist) decodeHeaderTag(t *Tag) {
+	v := strings.TrimSpace(t.Value)
+	switch t.Name {
+	case TagTargetDuration:
+		p.TargetDuration, _ = strconv.ParseFloat(v, 64)
+	case TagMediaSequence:
+		p.MediaSequence, _ = strconv.ParseUint(v, 10, 64)
+	case TagDiscontinuitySequence:
+		p.DiscontinuitySequence, _ = strconv.ParseUint(v, 10, 64)
+	case TagPlaylistType:
+		p.PlaylistType = v
+	}
+}
@@ -0,0 +1,289 @@
+package hls
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string // Defaults to in
+	}{
+		{
+			name: "master",
+			in: `#EXTM3U
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",DEFAULT=YES,URI="audio/en.m3u8"
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=86000,URI="iframe.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2",AUDIO="aac"
+720p/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2560000,RESOLUTION=1920x1080
+1080p/index.m3u8
+`,
+		},
+		{
+			name: "media",
+			in: `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:7
+#EXTINF:9.009,
+seg7.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:10.000,title
+seg8.ts
+#EXT-X-ENDLIST
+`,
+		},
+		{
+			name: "byterange",
+			in: `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXTINF:4,
+#EXT-X-BYTERANGE:1000@0
+main.ts
+#EXTINF:4,
+#EXT-X-BYTERANGE:2000
+main.ts
+#EXTINF:4,
+#EXT-X-BYTERANGE:500@100
+other.ts
+`,
+			// Implicit offsets continue the previous range of the same URI.
+			want: `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXTINF:4,
+#EXT-X-BYTERANGE:1000@0
+main.ts
+#EXTINF:4,
+#EXT-X-BYTERANGE:2000@1000
+main.ts
+#EXTINF:4,
+#EXT-X-BYTERANGE:500@100
+other.ts
+`,
+		},
+		{
+			name: "key and map",
+			in: `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-KEY:METHOD=AES-128,URI="https://k.example.com/key?id=1,2",IV=0x00000000000000000000000000000001
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+#EXTINF:6,
+a.m4s
+#EXTINF:6,
+b.m4s
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:6,
+c.m4s
+`,
+		},
+		{
+			name: "trailing tags",
+			in: `#EXTM3U
+#EXT-X-TARGETDURATION:2
+#EXTINF:2,
+a.ts
+#EXT-X-DISCONTINUITY
+#EXT-X-KEY:METHOD=AES-128,URI="k2"
+#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00Z
+#EXTINF:2,
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="b.part0.ts"
+`,
+		},
+		{
+			name: "tags after endlist",
+			in: `#EXTM3U
+#EXT-X-TARGETDURATION:2
+#EXTINF:2,
+a.ts
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="b.part0.ts"
+#EXT-X-ENDLIST
+#EXT-X-DISCONTINUITY
+# packaged by origin-1
+`,
+		},
+		{
+			name: "crlf and no header",
+			in:   "#EXT-X-TARGETDURATION:2\r\n\r\n#EXTINF:2,\r\na.ts\r\n",
+			want: "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\na.ts\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := tt.want
+			if want == "" {
+				want = tt.in
+			}
+			pl, err := Decode([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(pl.Encode()); got != want {
+				t.Errorf("Encode() =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeMaster(t *testing.T) {
+	pl, err := Decode([]byte(`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="a, b",URI="audio.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS="avc1,mp4a"
+low.m3u8
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok := pl.(*MasterPlaylist)
+	if !ok {
+		t.Fatalf("got %T, want *MasterPlaylist", pl)
+	}
+	if len(p.Variants) != 1 || p.Variants[0].URI != "low.m3u8" || p.Variants[0].Bandwidth() != 800000 {
+		t.Fatalf("variants = %+v", p.Variants)
+	}
+	if got := p.Variants[0].StreamInf.Attrs.Get("CODECS"); got != "avc1,mp4a" {
+		t.Errorf("CODECS = %q", got)
+	}
+	media := p.TagsNamed(TagMedia)
+	if len(media) != 1 || media[0].URI() != "audio.m3u8" || media[0].Attrs.Get("NAME") != "a, b" {
+		t.Errorf("EXT-X-MEDIA = %+v", media)
+	}
+}
+
+func TestDecodeMedia(t *testing.T) {
+	pl, err := Decode([]byte(`#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:5
+#EXT-X-KEY:METHOD=AES-128,URI="key1"
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="100@50"
+#EXTINF:10,
+a.ts
+#EXT-X-KEY:METHOD=AES-128,URI="key2",KEYFORMAT="identity"
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="skd://x",KEYFORMAT="com.apple.streamingkeydelivery"
+#EXTINF:8.5,
+b.ts
+#EXT-X-ENDLIST
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok := pl.(*MediaPlaylist)
+	if !ok {
+		t.Fatalf("got %T, want *MediaPlaylist", pl)
+	}
+	if p.TargetDuration != 10 || p.MediaSequence != 5 || !p.Endlist {
+		t.Errorf("header = %v %v %v", p.TargetDuration, p.MediaSequence, p.Endlist)
+	}
+	if len(p.Segments) != 2 || p.Duration() != 18.5 {
+		t.Fatalf("segments = %d, duration %v", len(p.Segments), p.Duration())
+	}
+	a, b := p.Segments[0], p.Segments[1]
+	if a.SequenceNumber != 5 || b.SequenceNumber != 6 {
+		t.Errorf("sequence numbers = %d, %d", a.SequenceNumber, b.SequenceNumber)
+	}
+	if len(a.Keys) != 1 || a.Keys[0].URI() != "key1" || !a.Encrypted() {
+		t.Errorf("a.Keys = %+v", a.Keys)
+	}
+	if len(b.Keys) != 2 || b.Keys[0].URI() != "key2" || b.Keys[1].KeyFormat() != "com.apple.streamingkeydelivery" {
+		t.Errorf("b.Keys = %+v", b.Keys)
+	}
+	if a.Map == nil || a.Map != b.Map || a.Map.URI() != "init.mp4" {
+		t.Fatalf("maps = %v, %v", a.Map, b.Map)
+	}
+	if br, ok := a.Map.ByteRange(); !ok || br != (ByteRange{Length: 100, Offset: 50}) {
+		t.Errorf("map byte range = %v, %v", br, ok)
+	}
+	if len(p.Keys()) != 3 || len(p.Maps()) != 1 {
+		t.Errorf("Keys() = %d, Maps() = %d", len(p.Keys()), len(p.Maps()))
+	}
+}
+
+func TestDecodeEmpty(t *testing.T) {
+	if _, err := Decode([]byte("\n \r\n")); err != ErrEmpty {
+		t.Errorf("err = %v, want ErrEmpty", err)
+	}
+}
+
+func TestParseAttributeList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want AttributeList
+	}{
+		{`METHOD=AES-128,URI="a,b=c",IV=0x1`, AttributeList{{Key: "METHOD", Value: "AES-128"}, {Key: "URI", Value: "a,b=c", Quoted: true}, {Key: "IV", Value: "0x1"}}},
+		{` A = 1 , B="x"`, AttributeList{{Key: "A", Value: "1"}, {Key: "B", Value: "x", Quoted: true}}},
+		{`URI="unterminated`, AttributeList{{Key: "URI", Value: "unterminated", Quoted: true}}},
+		{``, nil},
+	}
+	for _, tt := range tests {
+		got := ParseAttributeList(tt.in)
+		if len(got) != len(tt.want) {
+			t.Errorf("ParseAttributeList(%q) = %+v, want %+v", tt.in, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ParseAttributeList(%q)[%d] = %+v, want %+v", tt.in, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		in        string
+		want      ByteRange
+		hasOffset bool
+		err       bool
+	}{
+		{"100", ByteRange{Length: 100}, false, false},
+		{"100@20", ByteRange{Length: 100, Offset: 20}, true, false},
+		{" 5@0 ", ByteRange{Length: 5}, true, false},
+		{"-1", ByteRange{}, false, true},
+		{"1@x", ByteRange{}, false, true},
+	}
+	for _, tt := range tests {
+		got, hasOffset, err := ParseByteRange(tt.in)
+		if (err != nil) != tt.err || got != tt.want || hasOffset != tt.hasOffset {
+			t.Errorf("ParseByteRange(%q) = %v, %v, %v", tt.in, got, hasOffset, err)
+		}
+	}
+}
+
+func TestRemoveSegments(t *testing.T) {
+	pl, _ := Decode([]byte(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-KEY:METHOD=AES-128,URI="k"
+#EXTINF:4,
+ad0.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:4,
+a.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:4,
+ad1.ts
+#EXTINF:4,
+b.ts
+`))
+	p := pl.(*MediaPlaylist)
+	if n := p.RemoveSegments(func(_ int, s *Segment) bool { return strings.HasPrefix(s.URI, "ad") }); n != 2 {
+		t.Fatalf("removed %d, want 2", n)
+	}
+	if p.MediaSequence != 11 || p.DiscontinuitySequence != 1 {
+		t.Errorf("sequences = %d, %d", p.MediaSequence, p.DiscontinuitySequence)
+	}
+	a, b := p.Segments[0], p.Segments[1]
+	if a.Discontinuity || !b.Discontinuity {
+		t.Errorf("discontinuities = %v, %v", a.Discontinuity, b.Discontinuity)
+	}
+	// b moved from sequence 13 to 12, so its IV must be pinned.
+	if _, ok := a.Keys[0].IV(); ok {
+		t.Error("a got an explicit IV it does not need")
+	}
+	if iv, ok := b.Keys[0].IV(); !ok || iv[15] != 13 {
+		t.Errorf("b IV = %x, %v", iv, ok)
+	}
+}
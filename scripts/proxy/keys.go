@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/lunatv/proxy-script/hls"
+)
+
+// ===== AES-128 Keys =====
+//
+// EXT-X-KEY URIs are rewritten to /api/proxy/key. Keys are fetched with the
+// request profile of the source and key URL (never the viewer's headers), validated, and cached with
+// their own TTL so a playlist full of segments costs one upstream key fetch.
+
+const (
+	AESKeySize      = 16
+	KeyTTL          = 10 * time.Minute
+	KeyFetchTimeout = 20 * time.Second
+	MaxKeyItems     = 512
+)
+
+var globalKeyCache = NewLRUCache(MaxKeyItems, MaxKeyItems*4096)
+
+func serveKey(w http.ResponseWriter, r *http.Request, targetURL, sourceKey string) {
+	key, hit, err := getKey(r.Context(), sourceKey, targetURL)
+	if err != nil {
+		// A player that got an empty 200 would use it as the key.
+		if r.Context().Err() == nil {
+			upstreamError(w, r, "Key error", err)
+		}
+		return
+	}
+	xcache := "MISS"
+	if hit {
+		xcache = "HIT"
+	}
+
+	setCORSHeaders(w)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(key)))
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(KeyTTL.Seconds())))
+	w.Header().Set("X-Cache", xcache)
+	w.Write(key)
+}
+
+// getKey returns a validated key from globalKeyCache, collapsing concurrent
+// misses through sfGroup. The fetch runs detached from ctx, so the callers
+// sharing it don't fail when the one that started it goes away.
+func getKey(ctx context.Context, sourceKey, keyURL string) ([]byte, bool, error) {
+	cacheKey := sourceKey + "|" + keyURL
+	_, span := startSpan(ctx, "cache.lookup", spanKindInternal)
+	key, _, ok := globalKeyCache.Get(cacheKey)
+	span.SetAttr("cache.tier", "keys")
+	span.SetAttr("cache.hit", ok)
+	span.End()
+	if ok {
+		return key, true, nil
+	}
+	_, span = startSpan(ctx, "singleflight.wait", spanKindInternal)
+	defer span.End()
+	key, _, shared, err := sfGroup.Do("key|"+cacheKey, func() ([]byte, http.Header, error) {
+		gen := cacheGeneration.Load()
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), KeyFetchTimeout)
+		defer cancel()
+		k, err := fetchKey(fetchCtx, sourceKey, keyURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		globalKeyCache.SetGen(gen, cacheKey, k, nil, KeyTTL)
+		return k, nil, nil
+	})
+	span.SetAttr("coalesced", shared)
+	span.SetError(err)
+	return key, false, err
+}
+
+func fetchKey(ctx context.Context, sourceKey, targetURL string) ([]byte, error) {
+	profile := configOf(ctx).requestProfile(sourceKey, targetURL)
+	headers := profile.headers(nil)
+	headers["Accept-Encoding"] = "identity"
+
+	resp, err := fetchWithRetry(ctx, "GET", targetURL, profile.userAgent(), headers)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	key, err := io.ReadAll(io.LimitReader(resp.Body, AESKeySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != AESKeySize {
+		return nil, fmt.Errorf("invalid key length %d", len(key))
+	}
+	return key, nil
+}
+
+// ===== Server-Side Decryption =====
+//
+// In decrypt mode the rewritten playlist drops EXT-X-KEY and every segment URL
+// carries the signed key URL ("dkey") and IV ("div"). The segment handler
+// fetches the key and serves clear TS.
+
+type segmentDecryption struct {
+	keyURL string
+	iv     []byte
+}
+
+func parseSegmentDecryption(cfg *Config, q url.Values) (*segmentDecryption, error) {
+	keyURL := q.Get("dkey")
+	if keyURL == "" {
+		return nil, nil
+	}
+	if err := cfg.validateTargetURL(q.Get("moontv-source"), keyURL); err != nil {
+		return nil, err
+	}
+	iv, err := hex.DecodeString(q.Get("div"))
+	if err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid iv")
+	}
+	return &segmentDecryption{keyURL: keyURL, iv: iv}, nil
+}
+
+func (d *segmentDecryption) cacheSuffix() string {
+	return "dec|" + d.keyURL + "|" + hex.EncodeToString(d.iv)
+}
+
+// canDecryptServerSide reports whether every key is a plain AES-128 identity
+// key. SAMPLE-AES, DRM key formats and encrypted init sections stay with the
+// player.
+func canDecryptServerSide(p *hls.MediaPlaylist) bool {
+	keys := p.Keys()
+	if len(keys) == 0 || len(p.Maps()) > 0 {
+		return false
+	}
+	for _, k := range keys {
+		if k.Method() != hls.MethodAES128 || k.KeyFormat() != "identity" || k.URI() == "" {
+			return false
+		}
+	}
+	for _, s := range p.Segments {
+		if len(s.Keys) > 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// decryptSegment wraps a segment body in a streaming decrypter and fixes up
+// its headers. A key that fails to decrypt is evicted so the next request
+// refetches it.
+func decryptSegment(ctx context.Context, body io.Reader, h http.Header, dec *segmentDecryption, sourceKey string) (io.Reader, http.Header, error) {
+	key, _, err := getKey(ctx, sourceKey, dec.keyURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cacheKey := sourceKey + "|" + dec.keyURL
+	r := &cbcReader{src: body, mode: cipher.NewCBCDecrypter(block, dec.iv), onCorrupt: func() { globalKeyCache.Delete(cacheKey) }}
+	h = h.Clone()
+	h.Del("Content-Length")
+	h.Del("Content-Range")
+	h.Del("ETag")
+	h.Set("Content-Type", "video/mp2t")
+	return r, h, nil
+}
+
+var errBadPadding = errors.New("decrypt: bad padding")
+
+// cbcReader decrypts AES-128-CBC as it streams. The last decrypted block is
+// held back until EOF so the PKCS#7 padding can be checked and stripped.
+type cbcReader struct {
+	src       io.Reader
+	mode      cipher.BlockMode
+	onCorrupt func()
+	in        []byte // Ciphertext not yet decrypted (less than a block)
+	out       []byte // Plaintext ready to return
+	held      []byte // Last plaintext block
+	chunk     []byte
+	err       error
+}
+
+func (c *cbcReader) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.fill()
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+func (c *cbcReader) fill() {
+	if c.chunk == nil {
+		c.chunk = make([]byte, 32*1024)
+	}
+	n, err := c.src.Read(c.chunk)
+	c.in = append(c.in, c.chunk[:n]...)
+	if full := len(c.in) / aes.BlockSize * aes.BlockSize; full > 0 {
+		plain := make([]byte, len(c.held)+full)
+		copy(plain, c.held)
+		c.mode.CryptBlocks(plain[len(c.held):], c.in[:full])
+		c.in = append(c.in[:0], c.in[full:]...)
+		split := len(plain) - aes.BlockSize
+		c.out, c.held = plain[:split], plain[split:]
+	}
+	switch {
+	case err == io.EOF:
+		c.err = io.EOF
+		pad := 0
+		if len(c.held) == aes.BlockSize {
+			pad = int(c.held[aes.BlockSize-1])
+		}
+		if len(c.in) != 0 || pad == 0 || pad > aes.BlockSize {
+			c.corrupt()
+			return
+		}
+		for _, b := range c.held[aes.BlockSize-pad:] {
+			if int(b) != pad {
+				c.corrupt()
+				return
+			}
+		}
+		c.out = append(c.out, c.held[:aes.BlockSize-pad]...)
+		c.held = nil
+	case err != nil:
+		c.err = err
+	}
+}
+
+func (c *cbcReader) corrupt() {
+	c.err = errBadPadding
+	if c.onCorrupt != nil {
+		c.onCorrupt()
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetKeySurvivesLeaderCancel(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	var fetches atomic.Int32
+	srv, ctx := testUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		w.Write([]byte("0123456789abcdef"))
+	}))
+	keyURL := srv.URL + "/leader-cancel.key"
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	leader := make(chan error, 1)
+	go func() {
+		_, _, err := getKey(leaderCtx, testSource, keyURL)
+		leader <- err
+	}()
+	<-started
+	follower := make(chan []byte, 1)
+	go func() {
+		key, _, err := getKey(ctx, testSource, keyURL)
+		if err != nil {
+			t.Error(err)
+		}
+		follower <- key
+	}()
+	time.Sleep(20 * time.Millisecond) // Let the follower join the flight
+	cancel()
+	close(release)
+
+	if key := <-follower; string(key) != "0123456789abcdef" {
+		t.Errorf("follower got %q", key)
+	}
+	<-leader
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("%d upstream fetches, want 1", n)
+	}
+}
+
+func TestServeKeyErrors(t *testing.T) {
+	srv, ctx := testUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("short"))
+	}))
+	keyURL := srv.URL + "/bad.key"
+	r := httptest.NewRequest("GET", "/api/proxy/key?url="+url.QueryEscape(keyURL), nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	serveKey(w, r, keyURL, testSource)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("invalid key: status %d, want 502", w.Code)
+	}
+}
+
+func TestPrefetchKeysMatchSignedURLs(t *testing.T) {
+	withSecret(t)
+	opts := SourceOptions{Decrypt: true}
+	withConfig(t, &Config{LiveConfig: []LiveSource{{Key: "src", SourceOptions: opts}}})
+	const playlistURL = "https://cdn.example.com/vod/index.m3u8"
+	const in = `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:3
+#EXT-X-KEY:METHOD=AES-128,URI="k1"
+#EXTINF:4,
+#EXT-X-BYTERANGE:1000@0
+main.ts
+#EXT-X-KEY:METHOD=AES-128,URI="/k2",IV=0x0000000000000000000000000000000f
+#EXTINF:4,
+b.ts
+#EXT-X-ENDLIST
+`
+	jobs := prefetchJobs(decodeMedia(t, in), playlistURL, "src", getConfig())
+	p := decodeMedia(t, in)
+	rewriteM3U8(p, playlistURL, "https://proxy.example.com/api/proxy", "src", getConfig(), false)
+	if len(jobs) != len(p.Segments) {
+		t.Fatalf("%d jobs for %d segments", len(jobs), len(p.Segments))
+	}
+	for i, s := range p.Segments {
+		target := proxiedTarget(t, s.URI, "/segment")
+		u, _ := url.Parse(s.URI)
+		q := u.Query()
+		dec, err := parseSegmentDecryption(getConfig(), q)
+		if err != nil || dec == nil {
+			t.Fatalf("segment %d: decryption %v, %v", i, dec, err)
+		}
+		sub, err := parseSegmentRange(q.Get("range"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key := segmentCacheKey(q.Get("moontv-source"), target, sub, dec); key != jobs[i].cacheKey {
+			t.Errorf("segment %d: handler key %q, prefetch key %q", i, key, jobs[i].cacheKey)
+		}
+	}
+}
+
+func encryptCBC(t *testing.T, key, iv, plain []byte) []byte {
+	t.Helper()
+	pad := aes.BlockSize - len(plain)%aes.BlockSize
+	buf := append(append([]byte(nil), plain...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	block, _ := aes.NewCipher(key)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(buf, buf)
+	return buf
+}
+
+// oneByteReader returns one byte per Read, to exercise block reassembly.
+type oneByteReader struct{ r io.Reader }
+
+func (o oneByteReader) Read(p []byte) (int, error) { return o.r.Read(p[:1]) }
+
+func TestCBCReader(t *testing.T) {
+	key, iv := []byte("0123456789abcdef"), make([]byte, aes.BlockSize)
+	block, _ := aes.NewCipher(key)
+	for _, n := range []int{0, 1, 15, 16, 17, 100000} {
+		plain := []byte(strings.Repeat("x", n))
+		ct := encryptCBC(t, key, iv, plain)
+		for _, src := range []io.Reader{bytes.NewReader(ct), oneByteReader{bytes.NewReader(ct)}} {
+			got, err := io.ReadAll(&cbcReader{src: src, mode: cipher.NewCBCDecrypter(block, iv)})
+			if err != nil || !bytes.Equal(got, plain) {
+				t.Errorf("len %d: got %d bytes, %v", n, len(got), err)
+			}
+		}
+	}
+
+	ct := encryptCBC(t, key, iv, []byte("hello"))
+	wrong, _ := aes.NewCipher([]byte("fedcba9876543210"))
+	for name, r := range map[string]*cbcReader{
+		"wrong key": {src: bytes.NewReader(ct), mode: cipher.NewCBCDecrypter(wrong, iv)},
+		"truncated": {src: bytes.NewReader(ct[:len(ct)-1]), mode: cipher.NewCBCDecrypter(block, iv)},
+	} {
+		corrupt := false
+		r.onCorrupt = func() { corrupt = true }
+		if _, err := io.ReadAll(r); err != errBadPadding || !corrupt {
+			t.Errorf("%s: err %v, corrupt %v", name, err, corrupt)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ===== Logging =====
+//
+// Logs go through log/slog as text or JSON (-log-format), from -log-level
+// up; the standard log package is routed into it too. Every request gets an
+// ID, taken from a well-formed incoming X-Request-ID or generated, which is
+// returned as X-Request-ID and attached to everything logged on its behalf,
+// including upstream fetches of fills it started. One access log entry is
+// written when the request finishes. URLs are logged with credentials,
+// signatures and token-like query parameters redacted.
+
+const maxRequestIDLength = 64
+
+var logLevel = new(slog.LevelVar)
+
+// Query parameters whose names contain one of these are redacted.
+var sensitiveParams = []string{"sign", "token", "auth", "key", "secret", "pass", "session", "credential", "policy", "hdnts"}
+
+func setupLogging(format, level string) error {
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+	return nil
+}
+
+// fatal logs at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestInfo collects what the access log reports about upstream work done
+// for a request. Methods are no-ops on nil.
+type requestInfo struct {
+	id            string
+	upstreamBytes atomic.Int64
+
+	mu             sync.Mutex
+	upstreamHost   string
+	upstreamStatus int
+	retries        int
+	err            error
+}
+
+type requestInfoKey struct{}
+
+func requestInfoOf(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// logger returns the default logger, tagged with the request ID of ctx.
+func logger(ctx context.Context) *slog.Logger {
+	if info := requestInfoOf(ctx); info != nil {
+		return slog.Default().With("request_id", info.id)
+	}
+	return slog.Default()
+}
+
+// noteAttempt records an upstream attempt. Only the first upstream host is
+// reported, not the hosts of keys fetched to decrypt its response.
+func (i *requestInfo) noteAttempt(targetURL string, status int, retry bool) {
+	if i == nil {
+		return
+	}
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.upstreamHost != "" && i.upstreamHost != u.Host {
+		return
+	}
+	i.upstreamHost = u.Host
+	i.upstreamStatus = status
+	if retry {
+		i.retries++
+	}
+}
+
+// noteError records why a request failed, for responses that only say
+// "Fetch error".
+func (i *requestInfo) noteError(err error) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.err = err
+	i.mu.Unlock()
+}
+
+// upstreamError logs err for the request and answers with a generic message
+// and the status of upstreamErrorStatus. Viewers going away are only logged
+// at debug level.
+func upstreamError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	requestInfoOf(r.Context()).noteError(err)
+	level := slog.LevelWarn
+	if errors.Is(err, context.Canceled) {
+		level = slog.LevelDebug
+	}
+	logger(r.Context()).Log(r.Context(), level, strings.ToLower(msg), "url", redactURL(r.URL.Query().Get("url")), "err", redactError(err))
+	http.Error(w, msg, upstreamErrorStatus(err))
+}
+
+// upstreamErrorStatus is 403 for targets the policy refused, 504 for
+// timeouts and 502 otherwise.
+func upstreamErrorStatus(err error) int {
+	var denied *targetDenied
+	var ne net.Error
+	switch {
+	case errors.As(err, &denied):
+		return http.StatusForbidden
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// redactError renders err with the URL of a *url.Error redacted.
+func redactError(err error) string {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return fmt.Sprintf("%s %q: %v", ue.Op, redactURL(ue.URL), ue.Err)
+	}
+	return err.Error()
+}
+
+// requestID returns the client's X-Request-ID if it is safe to log and echo,
+// or a new random one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" && len(id) <= maxRequestIDLength && strings.Trim(id, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789._-") == "" {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// redactURL hides userinfo and sensitive query values. URLs nested in query
+// values (the proxy's own url= and dkey=) are redacted in turn.
+func redactURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "REDACTED"
+	}
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		for name, values := range q {
+			for i, v := range values {
+				switch {
+				case strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://"):
+					values[i] = redactURL(v)
+				case isSensitiveParam(name):
+					values[i] = "REDACTED"
+				}
+			}
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+func isSensitiveParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range sensitiveParams {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactCacheKey redacts the URL part of a cache key.
+func redactCacheKey(key string) string {
+	source, target := splitCacheKey(key)
+	return source + "|" + redactURL(target)
+}
+
+func logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{id: requestID(r)}
+		w.Header().Set("X-Request-ID", info.id)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		q := r.URL.Query()
+		attrs := []slog.Attr{
+			slog.String("request_id", info.id),
+			slog.String("remote", r.RemoteAddr),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Int("bytes", sw.length),
+			slog.Duration("duration", time.Since(start)),
+		}
+		if target := q.Get("url"); target != "" {
+			attrs = append(attrs, slog.String("url", redactURL(target)))
+		}
+		if source := q.Get("moontv-source"); source != "" {
+			attrs = append(attrs, slog.String("source", source))
+		}
+		if cache := sw.Header().Get("X-Cache"); cache != "" {
+			attrs = append(attrs, slog.String("cache", cache))
+		}
+		info.mu.Lock()
+		if info.upstreamHost != "" {
+			attrs = append(attrs, slog.String("upstream_host", info.upstreamHost), slog.Int("upstream_status", info.upstreamStatus), slog.Int("retries", info.retries), slog.Int64("upstream_bytes", info.upstreamBytes.Load()))
+		}
+		if info.err != nil {
+			attrs = append(attrs, slog.String("error", redactError(info.err)))
+		}
+		info.mu.Unlock()
+
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelWarn
+		}
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRedactURL(t *testing.T) {
+	tests := map[string]string{
+		"":                                       "",
+		"https://cdn.example.com/a.ts?x=1":       "https://cdn.example.com/a.ts?x=1",
+		"https://u:p@cdn.example.com/a.ts":       "https://REDACTED@cdn.example.com/a.ts",
+		"https://cdn.example.com/a.ts?Token=abc": "https://cdn.example.com/a.ts?Token=REDACTED",
+		"https://cdn.example.com/a.ts?hdnts=e~1": "https://cdn.example.com/a.ts?hdnts=REDACTED",
+		"%zz":                                    "REDACTED",
+	}
+	// The proxy's own URLs carry the upstream URL, redacted in turn.
+	nested := "/api/proxy/segment?sign=s&url=" + url.QueryEscape("https://cdn.example.com/a.ts?auth_key=k")
+	tests[nested] = "/api/proxy/segment?sign=REDACTED&url=" + url.QueryEscape("https://cdn.example.com/a.ts?auth_key=REDACTED")
+	for in, want := range tests {
+		if got := redactURL(in); got != want {
+			t.Errorf("redactURL(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	for id, kept := range map[string]bool{
+		"abc-123_x.y":           true,
+		"":                      false,
+		"bad id":                false,
+		"evil\nlog":             false,
+		strings.Repeat("a", 65): false,
+		strings.Repeat("a", 64): true,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Request-ID", id)
+		got := requestID(r)
+		if (got == id) != kept {
+			t.Errorf("X-Request-ID %q: got %q", id, got)
+		}
+		if !kept && len(got) != 16 {
+			t.Errorf("generated ID %q", got)
+		}
+	}
+}
+
+func TestLogRequest(t *testing.T) {
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	h := logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := requestInfoOf(r.Context())
+		info.noteAttempt("https://cdn.example.com/a.ts", 503, false)
+		info.noteAttempt("https://cdn.example.com/a.ts", 503, true)
+		info.noteAttempt("https://keys.example.com/k", 200, false) // Not the first host
+		upstreamError(w, r, "Fetch error", &url.Error{Op: "Get", URL: "https://cdn.example.com/a.ts?token=t", Err: errors.New("boom")})
+	}))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/proxy/segment?moontv-source=live&url="+url.QueryEscape("https://cdn.example.com/a.ts?token=t"), nil)
+	r.Header.Set("X-Request-ID", "req-1")
+	h.ServeHTTP(w, r)
+	if w.Header().Get("X-Request-ID") != "req-1" || w.Code != 502 {
+		t.Fatalf("status %d, X-Request-ID %q", w.Code, w.Header().Get("X-Request-ID"))
+	}
+
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]any
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, m)
+	}
+	if len(lines) != 2 || lines[0]["msg"] != "fetch error" || lines[0]["request_id"] != "req-1" {
+		t.Fatalf("log = %v", lines)
+	}
+	access := lines[1]
+	want := map[string]any{
+		"msg":             "request",
+		"level":           "WARN",
+		"request_id":      "req-1",
+		"status":          float64(502),
+		"source":          "live",
+		"url":             "https://cdn.example.com/a.ts?token=REDACTED",
+		"upstream_host":   "cdn.example.com",
+		"upstream_status": float64(503),
+		"retries":         float64(1),
+		"error":           `Get "https://cdn.example.com/a.ts?token=REDACTED": boom`,
+	}
+	for k, v := range want {
+		if access[k] != v {
+			t.Errorf("access log %s = %v, want %v", k, access[k], v)
+		}
+	}
+}
+
+func TestUpstreamErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{errors.New("connection refused"), 502},
+		{fmt.Errorf("ssrf blocked: %w", &targetDenied{kind: "private", rule: "10.0.0.1"}), 403},
+		{context.DeadlineExceeded, 504},
+		{&url.Error{Op: "Get", URL: "https://cdn.example.com/a.ts", Err: timeoutError{}}, 504},
+		{context.Canceled, 502},
+	}
+	for _, tt := range tests {
+		if got := upstreamErrorStatus(tt.err); got != tt.want {
+			t.Errorf("upstreamErrorStatus(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
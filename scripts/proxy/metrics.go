@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ===== Metrics =====
+//
+// /metrics serves the Prometheus text format (0.0.4). The metric types are
+// hand-rolled: the module has no dependencies, and the client library isn't
+// worth pulling in for a few counters and histograms. Request metrics are
+// labelled by handler type and moontv-source. Sources missing from the config
+// are reported as "other", so forged URLs can't inflate the series count.
+// Cache and coalescing figures are read from the stats snapshots at scrape
+// time.
+
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type metricVec struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64 // Histograms only
+
+	mu     sync.RWMutex
+	series map[string]*metricSeries // By label values joined with \xff
+}
+
+type metricSeries struct {
+	values  []string
+	count   atomic.Uint64   // Counter value, or number of observations
+	sum     atomic.Uint64   // Float64 bits; histograms only
+	buckets []atomic.Uint64 // Observations per bucket, not cumulative
+}
+
+var metricRegistry []*metricVec
+
+func newMetricVec(kind, name, help string, buckets []float64, labels ...string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*metricSeries)}
+	metricRegistry = append(metricRegistry, m)
+	return m
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return newMetricVec("counter", name, help, nil, labels...)
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *metricVec {
+	return newMetricVec("histogram", name, help, buckets, labels...)
+}
+
+// with returns the series for the given label values, in label order.
+func (m *metricVec) with(values ...string) *metricSeries {
+	key := strings.Join(values, "\xff")
+	m.mu.RLock()
+	s, ok := m.series[key]
+	m.mu.RUnlock()
+	if ok {
+		return s
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.series[key]; ok {
+		return s
+	}
+	s = &metricSeries{values: values, buckets: make([]atomic.Uint64, len(m.buckets))}
+	m.series[key] = s
+	return s
+}
+
+func (s *metricSeries) Inc() {
+	s.count.Add(1)
+}
+
+func (s *metricSeries) Add(n int64) {
+	if n > 0 {
+		s.count.Add(uint64(n))
+	}
+}
+
+// Observe records v into a histogram series with the given buckets.
+func (s *metricSeries) Observe(buckets []float64, v float64) {
+	if i := sort.SearchFloat64s(buckets, v); i < len(buckets) {
+		s.buckets[i].Add(1)
+	}
+	s.count.Add(1)
+	for {
+		old := s.sum.Load()
+		if s.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+var (
+	requestsTotal     = newCounterVec("lunatv_proxy_requests_total", "Requests served, by status code.", "handler", "source", "code")
+	requestDuration   = newHistogramVec("lunatv_proxy_request_duration_seconds", "Time to serve a request.", DefaultLatencyBuckets, "handler", "source")
+	responseBytes     = newCounterVec("lunatv_proxy_response_bytes_total", "Body bytes sent to viewers.", "handler", "source")
+	cacheResults      = newCounterVec("lunatv_proxy_cache_results_total", "Requests by X-Cache result.", "handler", "source", "result")
+	upstreamResponses = newCounterVec("lunatv_proxy_upstream_responses_total", "Upstream attempts by status code (\"error\" for transport errors).", "handler", "source", "code")
+	upstreamRetries   = newCounterVec("lunatv_proxy_upstream_retries_total", "Upstream attempts after the first one.", "handler", "source")
+	upstreamBytes     = newCounterVec("lunatv_proxy_upstream_received_bytes_total", "Body bytes received from upstreams.", "handler", "source")
+	semaphoreTimeouts = newCounterVec("lunatv_proxy_semaphore_timeouts_total", "Requests rejected after waiting for a fetch slot.", "handler", "source")
+	signatureFailures = newCounterVec("lunatv_proxy_signature_failures_total", "Requests rejected by signature verification.", "handler", "source", "reason")
+	targetDenials     = newCounterVec("lunatv_proxy_target_denials_total", "Upstream targets refused by the target policy.", "rule")
+)
+
+type metricLabels struct {
+	handler, source string
+}
+
+type metricLabelsKey struct{}
+
+// withMetricLabels tags upstream fetches made under ctx.
+func withMetricLabels(ctx context.Context, handler, sourceKey string) context.Context {
+	return context.WithValue(ctx, metricLabelsKey{}, metricLabels{handler: handler, source: configOf(ctx).metricSource(sourceKey)})
+}
+
+func metricLabelsOf(ctx context.Context) metricLabels {
+	if l, ok := ctx.Value(metricLabelsKey{}).(metricLabels); ok {
+		return l
+	}
+	return metricLabels{handler: "internal", source: "none"}
+}
+
+// metricSource bounds the moontv-source label to the configured sources.
+func (c *Config) metricSource(sourceKey string) string {
+	if sourceKey == "" {
+		return "none"
+	}
+	for _, src := range c.LiveConfig {
+		if src.Key == sourceKey {
+			return sourceKey
+		}
+	}
+	for _, src := range c.SourceConfig {
+		if src.Key == sourceKey {
+			return sourceKey
+		}
+	}
+	return "other"
+}
+
+// instrument records request metrics for one handler type, pins the current
+// config and tags the request context for upstream metrics and traces the
+// request.
+func instrument(handler string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx, span := startServerSpan(r, handler)
+		ctx = withConfigSnapshot(ctx, getConfig())
+		sourceKey := r.URL.Query().Get("moontv-source")
+		ctx = withSourceKey(withMetricLabels(ctx, handler, sourceKey), sourceKey)
+		labels := metricLabelsOf(ctx)
+		sw := &statusWriter{ResponseWriter: w}
+		next(sw, r.WithContext(ctx))
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttr("http.status_code", status)
+		span.SetAttr("moontv.source", labels.source)
+		span.SetAttr("url.full", redactURL(r.URL.Query().Get("url")))
+		if info := requestInfoOf(ctx); info != nil {
+			span.SetAttr("request_id", info.id)
+		}
+		if status >= 500 {
+			span.SetError(fmt.Errorf("status %d", status))
+		}
+		span.End()
+		requestsTotal.with(handler, labels.source, strconv.Itoa(status)).Inc()
+		requestDuration.with(handler, labels.source).Observe(DefaultLatencyBuckets, time.Since(start).Seconds())
+		responseBytes.with(handler, labels.source).Add(int64(sw.length))
+		if result := sw.Header().Get("X-Cache"); result != "" {
+			cacheResults.with(handler, labels.source, strings.ToLower(result)).Inc()
+		}
+	}
+}
+
+// countingBody counts upstream body bytes as they are read.
+type countingBody struct {
+	io.ReadCloser
+	series *metricSeries
+	info   *requestInfo // May be nil
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.series.Add(int64(n))
+	if b.info != nil {
+		b.info.upstreamBytes.Add(int64(n))
+	}
+	return n, err
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	for _, m := range metricRegistry {
+		m.write(bw)
+	}
+
+	writeGauge(bw, "lunatv_proxy_semaphore_in_use", "Fetch slots in use.", float64(len(globalSem)))
+	writeGauge(bw, "lunatv_proxy_semaphore_capacity", "Fetch slots available in total.", float64(cap(globalSem)))
+
+	tiers := map[string]map[string]int64{
+		"segments":  globalSegmentCache.snapshot(),
+		"keys":      globalKeyCache.snapshot(),
+		"playlists": globalPlaylistCache.snapshot(),
+		"negative":  negativeCache.snapshot(),
+		"dns":       dnsCache.snapshot(),
+	}
+	if diskTier != nil {
+		tiers["disk"] = diskTier.snapshot()
+	}
+	names := make([]string, 0, len(tiers))
+	for name := range tiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, family := range []struct{ name, kind, help, stat string }{
+		{"lunatv_proxy_cache_hits_total", "counter", "Cache lookups that found a fresh entry.", "hits"},
+		{"lunatv_proxy_cache_misses_total", "counter", "Cache lookups that found nothing fresh.", "misses"},
+		{"lunatv_proxy_cache_evictions_total", "counter", "Entries evicted to stay within budget.", "evictions"},
+		{"lunatv_proxy_cache_entries", "gauge", "Entries held.", "entries"},
+		{"lunatv_proxy_cache_bytes", "gauge", "Bytes held.", "bytes"},
+		{"lunatv_proxy_cache_max_bytes", "gauge", "Byte budget.", "maxBytes"},
+	} {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		for _, name := range names {
+			if v, ok := tiers[name][family.stat]; ok {
+				fmt.Fprintf(bw, "%s{cache=%q} %d\n", family.name, name, v)
+			}
+		}
+	}
+
+	fmt.Fprintf(bw, "# HELP lunatv_proxy_coalesce_fetches_total Upstream fetches started for coalesced work.\n# TYPE lunatv_proxy_coalesce_fetches_total counter\n")
+	fmt.Fprintf(bw, "lunatv_proxy_coalesce_fetches_total{kind=\"segment\"} %d\n", fillStats.Fetches.Load())
+	fmt.Fprintf(bw, "lunatv_proxy_coalesce_fetches_total{kind=\"singleflight\"} %d\n", sfGroup.calls.Load())
+	fmt.Fprintf(bw, "# HELP lunatv_proxy_coalesce_joins_total Callers that joined a fetch already in flight.\n# TYPE lunatv_proxy_coalesce_joins_total counter\n")
+	fmt.Fprintf(bw, "lunatv_proxy_coalesce_joins_total{kind=\"segment\"} %d\n", fillStats.Hits.Load())
+	fmt.Fprintf(bw, "lunatv_proxy_coalesce_joins_total{kind=\"singleflight\"} %d\n", sfGroup.shared.Load())
+	fmt.Fprintf(bw, "# HELP lunatv_proxy_coalesce_ratio Share of callers served by another caller's fetch.\n# TYPE lunatv_proxy_coalesce_ratio gauge\n")
+	fmt.Fprintf(bw, "lunatv_proxy_coalesce_ratio{kind=\"segment\"} %g\n", hitRatio(fillStats.Hits.Load(), fillStats.Fetches.Load()))
+	fmt.Fprintf(bw, "lunatv_proxy_coalesce_ratio{kind=\"singleflight\"} %g\n", hitRatio(sfGroup.shared.Load(), sfGroup.calls.Load()))
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, v)
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.RLock()
+	series := make([]*metricSeries, 0, len(m.series))
+	for _, s := range m.series {
+		series = append(series, s)
+	}
+	m.mu.RUnlock()
+	sort.Slice(series, func(i, j int) bool {
+		return strings.Join(series[i].values, "\xff") < strings.Join(series[j].values, "\xff")
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, s := range series {
+		labels := m.labelString(s.values)
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s{%s} %d\n", m.name, labels, s.count.Load())
+			continue
+		}
+		var cumulative uint64
+		for i, le := range m.buckets {
+			cumulative += s.buckets[i].Load()
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", m.name, labels, le, cumulative)
+		}
+		count := s.count.Load()
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", m.name, labels, count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", m.name, labels, math.Float64frombits(s.sum.Load()))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", m.name, labels, count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metricVec) labelString(values []string) string {
+	parts := make([]string, len(m.labels))
+	for i, name := range m.labels {
+		parts[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return strings.Join(parts, ",")
+}
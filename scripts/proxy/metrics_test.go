@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricVecWrite(t *testing.T) {
+	counter := &metricVec{name: "c_total", help: "Counter.", kind: "counter", labels: []string{"a"}, series: make(map[string]*metricSeries)}
+	counter.with("y").Add(3)
+	counter.with("x\"\n").Inc()
+	counter.with("y").Add(-1) // Ignored: counters only go up
+
+	hist := &metricVec{name: "h_seconds", help: "Histogram.", kind: "histogram", labels: []string{"a"}, buckets: []float64{0.1, 1}, series: make(map[string]*metricSeries)}
+	for _, v := range []float64{0.05, 0.5, 0.5, 5} {
+		hist.with("x").Observe(hist.buckets, v)
+	}
+
+	var b strings.Builder
+	counter.write(&b)
+	hist.write(&b)
+	want := `# HELP c_total Counter.
+# TYPE c_total counter
+c_total{a="x\"\n"} 1
+c_total{a="y"} 3
+# HELP h_seconds Histogram.
+# TYPE h_seconds histogram
+h_seconds_bucket{a="x",le="0.1"} 1
+h_seconds_bucket{a="x",le="1"} 3
+h_seconds_bucket{a="x",le="+Inf"} 4
+h_seconds_sum{a="x"} 6.05
+h_seconds_count{a="x"} 4
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestMetricSource(t *testing.T) {
+	withConfig(t, &Config{SourceConfig: []ApiSite{{Key: "vod"}}})
+	for key, want := range map[string]string{"vod": "vod", "forged": "other", "": "none"} {
+		if got := getConfig().metricSource(key); got != want {
+			t.Errorf("metricSource(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	withConfig(t, &Config{LiveConfig: []LiveSource{{Key: "live"}}})
+	h := instrument("instrument-test", func(w http.ResponseWriter, r *http.Request) {
+		if l := metricLabelsOf(r.Context()); l.handler != "instrument-test" || l.source != "live" || sourceKeyOf(r.Context()) != "live" {
+			t.Errorf("labels %+v, source %q", l, sourceKeyOf(r.Context()))
+		}
+		w.Header().Set("X-Cache", "HIT")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("missing"))
+	})
+	series := map[string]*metricSeries{
+		"requests": requestsTotal.with("instrument-test", "live", "404"),
+		"bytes":    responseBytes.with("instrument-test", "live"),
+		"cache":    cacheResults.with("instrument-test", "live", "hit"),
+		"duration": requestDuration.with("instrument-test", "live"),
+	}
+	before := make(map[string]uint64)
+	for name, s := range series {
+		before[name] = s.count.Load()
+	}
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/proxy/x?moontv-source=live", nil))
+	for name, want := range map[string]uint64{"requests": 1, "bytes": 7, "cache": 1, "duration": 1} {
+		if got := series[name].count.Load() - before[name]; got != want {
+			t.Errorf("%s grew by %d, want %d", name, got, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		`lunatv_proxy_requests_total{handler="instrument-test",source="live",code="404"} `,
+		`lunatv_proxy_request_duration_seconds_bucket{handler="instrument-test",source="live",le="+Inf"} `,
+		`lunatv_proxy_cache_entries{cache="segments"} `,
+		`lunatv_proxy_semaphore_capacity `,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("scrape lacks %s", line)
+		}
+	}
+}
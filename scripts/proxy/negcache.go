@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ===== Negative Cache =====
+//
+// A segment fetch that fails upstream is remembered per cache key for a short
+// while, so retries from every viewer fail at once instead of queueing for a
+// globalSem slot and running fetchWithRetry's backoff against a host that is
+// already failing. Client errors (4xx) and server trouble (5xx, 429, timeouts
+// and connection errors) have separate TTLs; 0 disables a class. Fetches
+// cancelled because every viewer left are not failures.
+
+const (
+	MaxNegativeEntries      = 10000
+	DefaultNegativeTTL4xx   = 10 * time.Second
+	DefaultNegativeTTL5xx   = 5 * time.Second
+	negativeJanitorInterval = 30 * time.Second
+)
+
+type negativeEntry struct {
+	status    int // Upstream status; 504 for timeouts, 502 for connection errors
+	expiresAt time.Time
+}
+
+type NegativeCache struct {
+	ttl4xx, ttl5xx time.Duration // Set before serving
+
+	mu    sync.Mutex
+	items map[string]negativeEntry
+
+	hits, stored4xx, stored5xx, purged atomic.Int64
+}
+
+var negativeCache = NewNegativeCache(DefaultNegativeTTL4xx, DefaultNegativeTTL5xx)
+
+func NewNegativeCache(ttl4xx, ttl5xx time.Duration) *NegativeCache {
+	return &NegativeCache{ttl4xx: ttl4xx, ttl5xx: ttl5xx, items: make(map[string]negativeEntry)}
+}
+
+// Get returns the upstream status of a remembered failure for key.
+func (c *NegativeCache) Get(key string) (int, bool) {
+	c.mu.Lock()
+	e, ok := c.items[key]
+	if ok && time.Now().After(e.expiresAt) {
+		delete(c.items, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return 0, false
+	}
+	c.hits.Add(1)
+	return e.status, true
+}
+
+// Has reports whether a failure is remembered for key, without counting a hit.
+func (c *NegativeCache) Has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	return ok && time.Now().Before(e.expiresAt)
+}
+
+// RecordStatus remembers an upstream error status for key. Statuses below
+// 400 are ignored.
+func (c *NegativeCache) RecordStatus(gen uint64, key string, status int) {
+	switch {
+	case status == http.StatusTooManyRequests || status >= 500:
+		c.record(gen, key, status, c.ttl5xx, &c.stored5xx)
+	case status >= 400:
+		c.record(gen, key, status, c.ttl4xx, &c.stored4xx)
+	}
+}
+
+// RecordError remembers a failed fetch for key, unless it was cancelled.
+func (c *NegativeCache) RecordError(gen uint64, key string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	status := http.StatusBadGateway
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		status = http.StatusGatewayTimeout
+	}
+	c.record(gen, key, status, c.ttl5xx, &c.stored5xx)
+}
+
+func (c *NegativeCache) record(gen uint64, key string, status int, ttl time.Duration, stored *atomic.Int64) {
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != cacheGeneration.Load() {
+		return // Purged since the fetch started
+	}
+	if _, ok := c.items[key]; !ok && len(c.items) >= MaxNegativeEntries {
+		return
+	}
+	c.items[key] = negativeEntry{status: status, expiresAt: time.Now().Add(ttl)}
+	stored.Add(1)
+}
+
+// Purge removes every entry whose key matches. The caller must have bumped
+// cacheGeneration first.
+func (c *NegativeCache) Purge(match func(key string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key := range c.items {
+		if match(key) {
+			delete(c.items, key)
+			n++
+		}
+	}
+	c.purged.Add(int64(n))
+	return n
+}
+
+// janitor drops expired entries; main starts it once the TTLs are set.
+func (c *NegativeCache) janitor() {
+	for range time.Tick(negativeJanitorInterval) {
+		now := time.Now()
+		c.mu.Lock()
+		for key, e := range c.items {
+			if now.After(e.expiresAt) {
+				delete(c.items, key)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *NegativeCache) entries(match func(key string) bool) []cacheEntryInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []cacheEntryInfo
+	for key, e := range c.items {
+		if match(key) {
+			out = append(out, cacheEntryInfo{Key: key, Tier: "negative-" + strconv.Itoa(e.status), ExpiresAt: e.expiresAt})
+		}
+	}
+	return out
+}
+
+func (c *NegativeCache) snapshot() map[string]int64 {
+	c.mu.Lock()
+	n := len(c.items)
+	c.mu.Unlock()
+	return map[string]int64{
+		"entries":   int64(n),
+		"ttl4xxMs":  c.ttl4xx.Milliseconds(),
+		"ttl5xxMs":  c.ttl5xx.Milliseconds(),
+		"hits":      c.hits.Load(),
+		"stored4xx": c.stored4xx.Load(),
+		"stored5xx": c.stored5xx.Load(),
+		"purged":    c.purged.Load(),
+	}
+}
+
+// negativeSegmentStatus checks the negative cache for a segment request
+// before it takes a globalSem slot. Malformed requests are left to the
+// segment handler to reject.
+func negativeSegmentStatus(cfg *Config, q url.Values) (int, bool) {
+	dec, err := parseSegmentDecryption(cfg, q)
+	if err != nil {
+		return 0, false
+	}
+	sub, err := parseSegmentRange(q.Get("range"))
+	if err != nil {
+		return 0, false
+	}
+	return negativeCache.Get(segmentCacheKey(q.Get("moontv-source"), q.Get("url"), sub, dec))
+}
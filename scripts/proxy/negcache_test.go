@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestNegativeCacheRecord(t *testing.T) {
+	c := NewNegativeCache(time.Minute, time.Minute)
+	gen := cacheGeneration.Load()
+	c.RecordStatus(gen, "404", 404)
+	c.RecordStatus(gen, "429", 429)
+	c.RecordStatus(gen, "503", 503)
+	c.RecordStatus(gen, "304", 304)
+	c.RecordError(gen, "refused", errors.New("connection refused"))
+	c.RecordError(gen, "timeout", fmt.Errorf("get: %w", timeoutError{}))
+	c.RecordError(gen, "deadline", context.DeadlineExceeded)
+	c.RecordError(gen, "cancelled", context.Canceled)
+	c.RecordStatus(gen-1, "stale", 500)
+
+	want := map[string]int{"404": 404, "429": 429, "503": 503, "refused": 502, "timeout": 504, "deadline": 504}
+	for _, key := range []string{"404", "429", "503", "304", "refused", "timeout", "deadline", "cancelled", "stale"} {
+		status, ok := c.Get(key)
+		if status != want[key] || ok != (want[key] != 0) {
+			t.Errorf("Get(%s) = %d, %v; want %d", key, status, ok, want[key])
+		}
+	}
+	s := c.snapshot()
+	if s["stored4xx"] != 1 || s["stored5xx"] != 5 {
+		t.Errorf("snapshot = %v", s)
+	}
+}
+
+func TestNegativeCacheTTLs(t *testing.T) {
+	c := NewNegativeCache(time.Minute, 0)
+	gen := cacheGeneration.Load()
+	c.RecordStatus(gen, "a", 403)
+	c.RecordStatus(gen, "b", 500)
+	if !c.Has("a") || c.Has("b") {
+		t.Error("disabled 5xx TTL stored an entry")
+	}
+
+	c = NewNegativeCache(-time.Second, time.Minute)
+	c.RecordStatus(gen, "a", 403)
+	if c.Has("a") {
+		t.Error("non-positive TTL stored an entry")
+	}
+	c.items["expired"] = negativeEntry{status: 500, expiresAt: time.Now().Add(-time.Second)}
+	if _, ok := c.Get("expired"); ok {
+		t.Error("expired entry served")
+	}
+}
+
+func TestNegativeCachePurge(t *testing.T) {
+	c := NewNegativeCache(time.Minute, time.Minute)
+	gen := cacheGeneration.Load()
+	c.RecordStatus(gen, "src|a", 404)
+	c.RecordStatus(gen, "other|b", 404)
+	if n := c.Purge(func(k string) bool { return strings.HasPrefix(k, "src|") }); n != 1 {
+		t.Errorf("purged %d, want 1", n)
+	}
+	if c.Has("src|a") || !c.Has("other|b") {
+		t.Error("purge matched the wrong keys")
+	}
+}
+
+func TestNegativeSegmentStatus(t *testing.T) {
+	withSecret(t)
+	const target = "https://cdn.example.com/v/0.ts"
+	old := negativeCache
+	negativeCache = NewNegativeCache(time.Minute, time.Minute)
+	t.Cleanup(func() { negativeCache = old })
+
+	uri := buildProxyURL("/api/proxy", "/segment", target, testSource, false, nil)
+	for _, status := range []int{404, 403, 503} {
+		negativeCache.RecordStatus(cacheGeneration.Load(), segmentCacheKey(testSource, target, nil, nil), status)
+		w := httptest.NewRecorder()
+		commonHandler(w, httptest.NewRequest("GET", uri, nil), "segment")
+		if w.Code != status || w.Header().Get("X-Cache") != "NEGATIVE" {
+			t.Errorf("remembered %d answered %d, X-Cache %q", status, w.Code, w.Header().Get("X-Cache"))
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lunatv/proxy-script/hls"
+)
+
+// ===== Playlist Cache =====
+//
+// Upstream playlists are cached per source and URL after ad filtering but
+// before rewriting, so every viewer still gets freshly signed URLs for their
+// own proxy host. Concurrent polls of the same playlist share one upstream
+// fetch through sfGroup. Live playlists live for about half a target
+// duration; VOD playlists much longer.
+//
+// The cached headers carry the final URL after redirects (Content-Location),
+// which relative URIs resolve against, and the ad filter report.
+
+const (
+	MaxPlaylistItems     = 512
+	MaxPlaylistBytes     = 64 * 1024 * 1024
+	MaxPlaylistSize      = 2 * 1024 * 1024
+	PlaylistFetchTimeout = 20 * time.Second
+	MinLivePlaylistTTL   = 1 * time.Second
+	MaxLivePlaylistTTL   = 10 * time.Second
+	MasterPlaylistTTL    = 30 * time.Second
+	VODPlaylistTTL       = 1 * time.Hour
+)
+
+var globalPlaylistCache = NewLRUCache(MaxPlaylistItems, MaxPlaylistBytes)
+
+// uncachedResponse is an upstream response that isn't a cacheable playlist
+// (an error status, or not a playlist at all). It is relayed as is.
+type uncachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (e *uncachedResponse) Error() string {
+	return fmt.Sprintf("uncacheable playlist response (%d)", e.status)
+}
+
+// playlistTTL picks the cache lifetime of a decoded playlist.
+func playlistTTL(pl hls.Playlist) time.Duration {
+	media, ok := pl.(*hls.MediaPlaylist)
+	if !ok {
+		return MasterPlaylistTTL
+	}
+	if media.Endlist || strings.EqualFold(media.PlaylistType, "VOD") {
+		return VODPlaylistTTL
+	}
+	ttl := time.Duration(media.TargetDuration) * time.Second / 2
+	if ttl < MinLivePlaylistTTL {
+		ttl = MinLivePlaylistTTL
+	}
+	if ttl > MaxLivePlaylistTTL {
+		ttl = MaxLivePlaylistTTL
+	}
+	return ttl
+}
+
+// loadPlaylist returns the ad-filtered, unrewritten playlist for targetURL.
+// Non-playlist responses are returned as an *uncachedResponse error.
+func loadPlaylist(ctx context.Context, sourceKey, targetURL, ua string, reqHeaders map[string]string) ([]byte, http.Header, bool, error) {
+	cacheKey := sourceKey + "|" + targetURL
+	_, span := startSpan(ctx, "cache.lookup", spanKindInternal)
+	data, h, ok := globalPlaylistCache.Get(cacheKey)
+	span.SetAttr("cache.tier", "playlists")
+	span.SetAttr("cache.hit", ok)
+	span.End()
+	if ok {
+		if prefetch != nil {
+			prefetch.touch(cacheKey)
+		}
+		return data, h, true, nil
+	}
+
+	// Viewers share the result, so nothing viewer-specific goes upstream.
+	headers := cloneHeadersMap(reqHeaders)
+	for _, k := range []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		delete(headers, k)
+	}
+	headers["Accept-Encoding"] = "identity"
+
+	_, span = startSpan(ctx, "singleflight.wait", spanKindInternal)
+	data, h, shared, err := sfGroup.Do("m3u8|"+cacheKey, func() ([]byte, http.Header, error) {
+		// The fetch outlives the viewer that started it: others may be waiting.
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), PlaylistFetchTimeout)
+		defer cancel()
+		gen := cacheGeneration.Load()
+
+		resp, err := fetchWithRetry(fetchCtx, "GET", targetURL, ua, headers)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(io.LimitReader(resp.Body, MaxPlaylistSize))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		isPlaylist := bytes.Contains(body, m3u8Tag) || strings.Contains(resp.Header.Get("Content-Type"), "mpegurl")
+		if resp.StatusCode != http.StatusOK || !isPlaylist {
+			return nil, nil, &uncachedResponse{status: resp.StatusCode, header: resp.Header.Clone(), body: body}
+		}
+		pl, err := hls.Decode(body)
+		if err != nil {
+			return nil, nil, &uncachedResponse{status: resp.StatusCode, header: resp.Header.Clone(), body: body}
+		}
+
+		playlistURL := resp.Request.URL.String()
+		h := http.Header{}
+		h.Set("Content-Type", "application/vnd.apple.mpegurl")
+		h.Set("Content-Location", playlistURL)
+		cfg := configOf(fetchCtx)
+		if media, ok := pl.(*hls.MediaPlaylist); ok && cfg.sourceOptions(sourceKey).AdFilter {
+			if report := stripAds(media, playlistURL); report != nil {
+				h.Set("X-Ad-Filter", report.String())
+			}
+		}
+		data := pl.Encode()
+		globalPlaylistCache.SetGen(gen, cacheKey, data, h, playlistTTL(pl))
+		if media, ok := pl.(*hls.MediaPlaylist); ok && prefetch != nil {
+			prefetch.onPlaylist(cfg, cacheKey, sourceKey, playlistURL, media)
+		}
+		return data, h, nil
+	})
+	span.SetAttr("coalesced", shared)
+	if _, uncached := err.(*uncachedResponse); !uncached {
+		span.SetError(err)
+	}
+	span.End()
+	return data, h, false, err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lunatv/proxy-script/hls"
+)
+
+func TestPlaylistTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want time.Duration
+	}{
+		{"master", "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\nlow.m3u8\n", MasterPlaylistTTL},
+		{"vod", "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6,\n0.ts\n#EXT-X-ENDLIST\n", VODPlaylistTTL},
+		{"vod type", "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:6,\n0.ts\n", VODPlaylistTTL},
+		{"live", "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6,\n0.ts\n", 3 * time.Second},
+		{"live short", "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,\n0.ts\n", MinLivePlaylistTTL},
+		{"live long", "#EXTM3U\n#EXT-X-TARGETDURATION:60\n#EXTINF:60,\n0.ts\n", MaxLivePlaylistTTL},
+	}
+	for _, tt := range tests {
+		pl, err := hls.Decode([]byte(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := playlistTTL(pl); got != tt.want {
+			t.Errorf("%s: ttl %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadPlaylist(t *testing.T) {
+	const live = "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6,\nseg0.ts\n"
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	srv, ctx := testUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/live.m3u8":
+			fetches.Add(1)
+			<-release
+			io.WriteString(w, live)
+		case "/moved.m3u8":
+			http.Redirect(w, r, "/v2/live.m3u8", http.StatusFound)
+		case "/v2/live.m3u8":
+			io.WriteString(w, live)
+		default:
+			http.Error(w, "gone", http.StatusNotFound)
+		}
+	}))
+
+	// Concurrent polls share one fetch; the next is a cache hit.
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if data, _, _, err := loadPlaylist(ctx, testSource, srv.URL+"/live.m3u8", "ua", nil); err != nil || string(data) != live {
+				t.Errorf("loadPlaylist = %q, %v", data, err)
+			}
+		}()
+	}
+	for fetches.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond) // Let the others join; late ones hit the cache
+	close(release)
+	wg.Wait()
+	if _, _, hit, _ := loadPlaylist(ctx, testSource, srv.URL+"/live.m3u8", "ua", nil); !hit {
+		t.Error("second load missed the cache")
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("%d upstream fetches, want 1", fetches.Load())
+	}
+
+	// Relative URIs resolve against the URL after redirects.
+	_, h, _, err := loadPlaylist(ctx, testSource, srv.URL+"/moved.m3u8", "ua", nil)
+	if err != nil || h.Get("Content-Location") != srv.URL+"/v2/live.m3u8" {
+		t.Errorf("Content-Location %q, %v", h.Get("Content-Location"), err)
+	}
+
+	// Errors are relayed, not cached.
+	for range 2 {
+		_, _, hit, err := loadPlaylist(ctx, testSource, srv.URL+"/missing.m3u8", "ua", nil)
+		var uncached *uncachedResponse
+		if !errors.As(err, &uncached) || uncached.status != http.StatusNotFound || hit {
+			t.Errorf("missing playlist: %v, hit %v", err, hit)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lunatv/proxy-script/hls"
+)
+
+// ===== Segment Prefetch =====
+//
+// Every upstream fetch of a media playlist records the proxied segments in
+// playback order. When a viewer requests one of them, the next N are fetched
+// into globalSegmentCache through the usual fills, so a viewer who catches up
+// with a prefetch joins it instead of starting another fetch. A freshly
+// loaded live playlist warms its newest segments and a VOD playlist its
+// first ones, which makes channel changes and seeks cheap.
+//
+// Prefetches use at most -prefetch-slots of globalSem and never wait for a
+// slot: when the proxy is busy they are skipped. Playlists nobody has polled
+// or played from for PrefetchIdleTimeout are dropped and their prefetches
+// cancelled.
+
+const (
+	DefaultPrefetchSlots = 8
+	PrefetchIdleTimeout  = 30 * time.Second
+)
+
+type prefetchJob struct {
+	cacheKey string
+	target   string
+	sub      *segmentRange
+	dec      *segmentDecryption
+}
+
+// prefetchWatch is a playlist someone is watching.
+type prefetchWatch struct {
+	sourceKey string
+	ctx       context.Context
+	cancel    context.CancelFunc
+	jobs      []prefetchJob
+	lastSeen  time.Time
+}
+
+type prefetchPos struct {
+	w   *prefetchWatch
+	idx int
+}
+
+type prefetchStats struct {
+	Started atomic.Int64 // Prefetches started
+	Skipped atomic.Int64 // Prefetches dropped because no slot was free
+}
+
+type prefetcher struct {
+	ahead int
+	slots chan struct{}
+	stats prefetchStats
+
+	mu      sync.Mutex
+	watches map[string]*prefetchWatch // By playlist cache key
+	index   map[string]prefetchPos    // By segment cache key
+	pending map[string]bool
+}
+
+var prefetch *prefetcher // nil when prefetching is disabled
+
+func newPrefetcher(ahead, slots int) *prefetcher {
+	p := &prefetcher{ahead: ahead, slots: make(chan struct{}, slots), watches: make(map[string]*prefetchWatch), index: make(map[string]prefetchPos), pending: make(map[string]bool)}
+	go p.janitor()
+	return p
+}
+
+// prefetchJobs lists the segments of p that viewers will fetch through
+// /segment, with the same parameters the rewriter signs into their URLs.
+func prefetchJobs(p *hls.MediaPlaylist, playlistURL, sourceKey string, cfg *Config) []prefetchJob {
+	opts := cfg.sourceOptions(sourceKey)
+	decrypt := opts.Decrypt && canDecryptServerSide(p)
+	mode := segmentModeOf(opts)
+	jobs := make([]prefetchJob, 0, len(p.Segments))
+	for _, s := range p.Segments {
+		target := resolveURL(playlistURL, s.URI)
+		if !strings.HasPrefix(target, "http") || (!decrypt && !cfg.shouldProxySegment(mode, target, sourceKey)) {
+			continue
+		}
+		_, sub, dec, err := segmentParams(playlistURL, s, decrypt)
+		if err != nil {
+			continue
+		}
+		jobs = append(jobs, prefetchJob{cacheKey: segmentCacheKey(sourceKey, target, sub, dec), target: target, sub: sub, dec: dec})
+	}
+	return jobs
+}
+
+// onPlaylist records a fresh upstream copy of a media playlist and warms the
+// segments a new viewer starts with.
+func (p *prefetcher) onPlaylist(cfg *Config, playlistKey, sourceKey, playlistURL string, media *hls.MediaPlaylist) {
+	jobs := prefetchJobs(media, playlistURL, sourceKey, cfg)
+	live := !media.Endlist && !strings.EqualFold(media.PlaylistType, "VOD")
+
+	p.mu.Lock()
+	w, known := p.watches[playlistKey]
+	if !known {
+		ctx, cancel := context.WithCancel(context.Background())
+		w = &prefetchWatch{sourceKey: sourceKey, ctx: ctx, cancel: cancel}
+		p.watches[playlistKey] = w
+	}
+	p.unindex(w)
+	w.jobs = jobs
+	w.lastSeen = time.Now()
+	for i, j := range jobs {
+		p.index[j.cacheKey] = prefetchPos{w: w, idx: i}
+	}
+	var warm []prefetchJob
+	switch {
+	case live:
+		warm = jobs[max(0, len(jobs)-p.ahead):]
+	case !known:
+		warm = jobs[:min(len(jobs), p.ahead)]
+	}
+	p.mu.Unlock()
+
+	p.schedule(w, warm)
+}
+
+// touch keeps a playlist's prefetching alive on a cached poll.
+func (p *prefetcher) touch(playlistKey string) {
+	p.mu.Lock()
+	if w, ok := p.watches[playlistKey]; ok {
+		w.lastSeen = time.Now()
+	}
+	p.mu.Unlock()
+}
+
+// onSegment prefetches the segments following one a viewer requested.
+func (p *prefetcher) onSegment(cacheKey string) {
+	p.mu.Lock()
+	pos, ok := p.index[cacheKey]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	pos.w.lastSeen = time.Now()
+	next := pos.w.jobs[pos.idx+1 : min(len(pos.w.jobs), pos.idx+1+p.ahead)]
+	p.mu.Unlock()
+
+	p.schedule(pos.w, next)
+}
+
+func (p *prefetcher) schedule(w *prefetchWatch, jobs []prefetchJob) {
+	for _, j := range jobs {
+		if globalSegmentCache.Peek(j.cacheKey) || segmentFills.inFlight(j.cacheKey) || negativeCache.Has(j.cacheKey) || (diskTier != nil && diskTier.Has(j.cacheKey)) {
+			continue
+		}
+		p.mu.Lock()
+		if p.pending[j.cacheKey] || w.ctx.Err() != nil {
+			p.mu.Unlock()
+			continue
+		}
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			p.mu.Unlock()
+			p.stats.Skipped.Add(1)
+			return
+		}
+		select {
+		case globalSem <- struct{}{}:
+		default:
+			<-p.slots
+			p.mu.Unlock()
+			p.stats.Skipped.Add(1)
+			return
+		}
+		p.pending[j.cacheKey] = true
+		p.mu.Unlock()
+
+		p.stats.Started.Add(1)
+		go p.run(w, j)
+	}
+}
+
+func (p *prefetcher) run(w *prefetchWatch, j prefetchJob) {
+	defer func() {
+		<-globalSem
+		<-p.slots
+		p.mu.Lock()
+		delete(p.pending, j.cacheKey)
+		p.mu.Unlock()
+	}()
+	// A job outlives the request that scheduled it and takes the current config.
+	ctx := withConfigSnapshot(w.ctx, getConfig())
+	profile := configOf(ctx).requestProfile(w.sourceKey, j.target)
+	fr, _ := segmentFills.join(ctx, j.cacheKey, segmentSource(j.target, w.sourceKey, profile.userAgent(), profile.headers(nil), j.sub, j.dec, nil), segmentCommit(j.cacheKey, SegmentTTL))
+	defer fr.Close()
+	if _, err := fr.Header(); err != nil {
+		return
+	}
+	io.Copy(io.Discard, fr)
+}
+
+func (p *prefetcher) unindex(w *prefetchWatch) {
+	for _, j := range w.jobs {
+		if pos, ok := p.index[j.cacheKey]; ok && pos.w == w {
+			delete(p.index, j.cacheKey)
+		}
+	}
+}
+
+// janitor drops playlists nobody is watching any more.
+func (p *prefetcher) janitor() {
+	for range time.Tick(PrefetchIdleTimeout / 2) {
+		cutoff := time.Now().Add(-PrefetchIdleTimeout)
+		p.mu.Lock()
+		for key, w := range p.watches {
+			if w.lastSeen.Before(cutoff) {
+				p.unindex(w)
+				delete(p.watches, key)
+				w.cancel()
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *prefetcher) snapshot() map[string]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return map[string]int64{
+		"watching": int64(len(p.watches)),
+		"inflight": int64(len(p.pending)),
+		"started":  p.stats.Started.Load(),
+		"skipped":  p.stats.Skipped.Load(),
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// prefetchUpstream serves segments named by their path and installs a
+// config that proxies testSource's segments.
+func prefetchUpstream(t *testing.T) string {
+	t.Helper()
+	srv, _ := testUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+	withConfig(t, &Config{
+		LiveConfig:   []LiveSource{{Key: testSource, SourceOptions: SourceOptions{AllowPrivate: true, SegmentMode: SegmentModeProxy}}},
+		TargetPolicy: TargetPolicy{AllowedPorts: []int{port}},
+	})
+	return srv.URL
+}
+
+// waitPrefetches waits for the prefetches p started to finish.
+func waitPrefetches(t *testing.T, p *prefetcher) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for p.snapshot()["inflight"] > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("prefetches did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	base := prefetchUpstream(t)
+	// Each case gets its own segment names, so earlier fills don't count.
+	playlist := func(name string, n int, endlist bool) (string, []string) {
+		var b strings.Builder
+		b.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:4\n")
+		var keys []string
+		for i := range n {
+			fmt.Fprintf(&b, "#EXTINF:4,\n%s-%d.ts\n", name, i)
+			keys = append(keys, segmentCacheKey(testSource, fmt.Sprintf("%s/%s-%d.ts", base, name, i), nil, nil))
+		}
+		if endlist {
+			b.WriteString("#EXT-X-ENDLIST\n")
+		}
+		return b.String(), keys
+	}
+	cached := func(keys []string) string {
+		var s []byte
+		for _, k := range keys {
+			if globalSegmentCache.Peek(k) {
+				s = append(s, 'x')
+			} else {
+				s = append(s, '.')
+			}
+		}
+		return string(s)
+	}
+
+	p := newPrefetcher(2, 4)
+
+	// A new VOD playlist warms its first segments, a viewer the next ones.
+	in, keys := playlist("vod", 6, true)
+	p.onPlaylist(getConfig(), "vod", testSource, base+"/vod.m3u8", decodeMedia(t, in))
+	waitPrefetches(t, p)
+	if got := cached(keys); got != "xx...." {
+		t.Errorf("after load: %s", got)
+	}
+	p.onSegment(keys[2])
+	waitPrefetches(t, p)
+	if got := cached(keys); got != "xx.xx." {
+		t.Errorf("after segment 2: %s", got)
+	}
+	if data, _, _ := globalSegmentCache.Get(keys[3]); string(data) != "/vod-3.ts" {
+		t.Errorf("prefetched body %q", data)
+	}
+
+	// A live playlist warms its newest segments.
+	in, keys = playlist("live", 5, false)
+	p.onPlaylist(getConfig(), "live", testSource, base+"/live.m3u8", decodeMedia(t, in))
+	waitPrefetches(t, p)
+	if got := cached(keys); got != "...xx" {
+		t.Errorf("live: %s", got)
+	}
+	if s := p.snapshot(); s["watching"] != 2 || s["started"] != 6 {
+		t.Errorf("snapshot = %v", s)
+	}
+
+	// Without a free slot prefetches are skipped, not queued.
+	busy := newPrefetcher(2, 0)
+	in, keys = playlist("busy", 3, true)
+	busy.onPlaylist(getConfig(), "busy", testSource, base+"/busy.m3u8", decodeMedia(t, in))
+	if got := cached(keys); got != "..." || busy.snapshot()["skipped"] != 1 {
+		t.Errorf("busy: %s, %v", got, busy.snapshot())
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ===== Request Profiles =====
+//
+// A request profile shapes what goes upstream: UA, Referer, Origin, Cookie,
+// extra headers, viewer headers to strip, which viewer headers to forward at
+// all (replacing forwardHeaderAllowlist), and the egress proxy (egress.go).
+// Profiles come from the config's RequestProfiles, matched on the target host
+// with path.Match patterns ("*.huya.com" does not match "huya.com"), and from
+// a source's requestProfile. Matching host profiles apply in order after the built-in
+// ones, then the source's profile; later layers override single values and
+// add to headers and strip lists.
+//
+//	"RequestProfiles": [{"hosts": ["*.example.com"], "referer": "https://example.com/"}]
+//	"LiveConfig": [{"key": "x", "requestProfile": {"cookie": "a=b", "stripHeaders": ["Origin"]}}]
+
+type RequestProfile struct {
+	UA      string            `json:"ua,omitempty"`
+	Referer string            `json:"referer,omitempty"`
+	Origin  string            `json:"origin,omitempty"`
+	Cookie  string            `json:"cookie,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// StripHeaders removes viewer headers that would otherwise be forwarded.
+	StripHeaders []string `json:"stripHeaders,omitempty"`
+	// ForwardHeaders replaces forwardHeaderAllowlist when set.
+	ForwardHeaders []string `json:"forwardHeaders,omitempty"`
+	// Egress is an outbound proxy URL, or "direct".
+	Egress string `json:"egress,omitempty"`
+}
+
+type HostRequestProfile struct {
+	Hosts []string `json:"hosts"`
+	RequestProfile
+
+	urlContains string // Built-in quirks: also match this anywhere in the URL
+}
+
+// Quirks of providers that were hardcoded before profiles existed. The huya
+// one matched "huya" anywhere in the URL, query and path included, and still
+// does.
+var builtinRequestProfiles = []HostRequestProfile{
+	{urlContains: "huya", RequestProfile: RequestProfile{Referer: "https://www.huya.com/"}},
+	{Hosts: []string{"doubanio.com", "*.doubanio.com"}, RequestProfile: RequestProfile{Referer: "https://movie.douban.com/"}},
+}
+
+func (p HostRequestProfile) matches(host, rawURL string) bool {
+	if p.urlContains != "" && strings.Contains(rawURL, p.urlContains) {
+		return true
+	}
+	for _, pattern := range p.Hosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// merge layers o over p.
+func (p *RequestProfile) merge(o *RequestProfile) {
+	if o == nil {
+		return
+	}
+	for _, f := range []struct{ dst, src *string }{{&p.UA, &o.UA}, {&p.Referer, &o.Referer}, {&p.Origin, &o.Origin}, {&p.Cookie, &o.Cookie}, {&p.Egress, &o.Egress}} {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
+	}
+	if len(o.Headers) > 0 {
+		headers := make(map[string]string, len(p.Headers)+len(o.Headers))
+		for k, v := range p.Headers {
+			headers[k] = v
+		}
+		for k, v := range o.Headers {
+			headers[http.CanonicalHeaderKey(k)] = v
+		}
+		p.Headers = headers
+	}
+	p.StripHeaders = append(p.StripHeaders[:len(p.StripHeaders):len(p.StripHeaders)], o.StripHeaders...)
+	if o.ForwardHeaders != nil {
+		p.ForwardHeaders = o.ForwardHeaders
+	}
+}
+
+// requestProfile resolves the profile for a request to targetURL on behalf of
+// sourceKey. targetURL may be empty for source-wide decisions.
+func (c *Config) requestProfile(sourceKey, targetURL string) RequestProfile {
+	return c.resolveProfile(sourceKey, targetURL, builtinRequestProfiles)
+}
+
+// configuredProfile is requestProfile without the built-in quirks.
+func (c *Config) configuredProfile(sourceKey, targetURL string) RequestProfile {
+	return c.resolveProfile(sourceKey, targetURL, nil)
+}
+
+func (c *Config) resolveProfile(sourceKey, targetURL string, builtins []HostRequestProfile) RequestProfile {
+	var p RequestProfile
+	if u, err := url.Parse(targetURL); err == nil && u.Host != "" {
+		host := strings.ToLower(u.Hostname())
+		for _, layer := range [][]HostRequestProfile{builtins, c.RequestProfiles} {
+			for i := range layer {
+				if layer[i].matches(host, targetURL) {
+					p.merge(&layer[i].RequestProfile)
+				}
+			}
+		}
+	}
+	for _, src := range c.LiveConfig {
+		if src.Key == sourceKey {
+			p.merge(&RequestProfile{UA: src.UA})
+			p.merge(src.RequestProfile)
+			return p
+		}
+	}
+	for _, src := range c.SourceConfig {
+		if src.Key == sourceKey {
+			p.merge(src.RequestProfile)
+			return p
+		}
+	}
+	return p
+}
+
+// userAgent returns the profile's UA, or DefaultUserAgent.
+func (p *RequestProfile) userAgent() string {
+	if p.UA != "" {
+		return p.UA
+	}
+	return DefaultUserAgent
+}
+
+// custom reports whether the profile sends anything a browser fetching the
+// URL directly could not, or from somewhere it could not.
+func (p *RequestProfile) custom() bool {
+	return p.UA != "" || p.Referer != "" || p.Origin != "" || p.Cookie != "" || len(p.Headers) > 0 || (p.Egress != "" && p.Egress != EgressDirect)
+}
+
+// headers returns the upstream request headers: the viewer's forwardable
+// headers from r (nil for requests on nobody's behalf) with the profile's
+// applied.
+func (p *RequestProfile) headers(r *http.Request) map[string]string {
+	h := make(map[string]string)
+	if r != nil {
+		allow := forwardHeaderAllowlist
+		if p.ForwardHeaders != nil {
+			allow = make(map[string]bool, len(p.ForwardHeaders))
+			for _, k := range p.ForwardHeaders {
+				allow[http.CanonicalHeaderKey(k)] = true
+			}
+		}
+		for k, vv := range r.Header {
+			if len(vv) > 0 && allow[http.CanonicalHeaderKey(k)] {
+				h[k] = vv[0]
+			}
+		}
+		for _, k := range p.StripHeaders {
+			delete(h, http.CanonicalHeaderKey(k))
+		}
+	}
+	for k, v := range map[string]string{"Referer": p.Referer, "Origin": p.Origin, "Cookie": p.Cookie} {
+		if v != "" {
+			h[k] = v
+		}
+	}
+	for k, v := range p.Headers {
+		h[k] = v
+	}
+	return h
+}
+
+func (p *RequestProfile) validate() error {
+	for k, v := range p.Headers {
+		if k == "" || strings.ContainsAny(k, " \t\r\n:") {
+			return fmt.Errorf("invalid header name %q", k)
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("invalid value for header %q", k)
+		}
+	}
+	for _, v := range []string{p.UA, p.Referer, p.Origin, p.Cookie} {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("invalid header value %q", v)
+		}
+	}
+	if p.Egress != "" && p.Egress != EgressDirect {
+		if _, err := parseEgress(p.Egress); err != nil {
+			return fmt.Errorf("egress: %v", err)
+		}
+	}
+	return nil
+}
+
+func (p HostRequestProfile) validate() error {
+	if len(p.Hosts) == 0 {
+		return fmt.Errorf("profile without hosts")
+	}
+	for _, pattern := range p.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("host pattern %q: %v", pattern, err)
+		}
+	}
+	return p.RequestProfile.validate()
+}
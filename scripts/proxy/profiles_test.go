@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestRequestProfileLayers(t *testing.T) {
+	withConfig(t, &Config{
+		LiveConfig: []LiveSource{{Key: "live", UA: "live-ua", SourceOptions: SourceOptions{RequestProfile: &RequestProfile{Cookie: "c=1"}}}},
+		RequestProfiles: []HostRequestProfile{
+			{Hosts: []string{"*.example.com"}, RequestProfile: RequestProfile{UA: "host-ua", Referer: "https://example.com/"}},
+		},
+	})
+	p := getConfig().requestProfile("live", "https://cdn.example.com/a.m3u8")
+	if p.UA != "live-ua" || p.Referer != "https://example.com/" || p.Cookie != "c=1" {
+		t.Errorf("merged profile = %+v", p)
+	}
+	if p := getConfig().requestProfile("", "https://img1.doubanio.com/a.jpg"); p.Referer != "https://movie.douban.com/" {
+		t.Errorf("builtin doubanio Referer = %q", p.Referer)
+	}
+	// The huya quirk matches anywhere in the URL, as it did before profiles.
+	for target, want := range map[string]string{
+		"https://al.hls.huya.com/src/a.m3u8":        "https://www.huya.com/",
+		"https://cdn.example.net/huya/a.m3u8":       "https://www.huya.com/",
+		"https://cdn.example.net/a.m3u8?from=huya":  "https://www.huya.com/",
+		"https://cdn.example.net/a.m3u8?from=douyu": "",
+	} {
+		if p := getConfig().requestProfile("", target); p.Referer != want {
+			t.Errorf("%s: Referer %q, want %q", target, p.Referer, want)
+		}
+	}
+}
+
+func TestRequestProfileHeaders(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Referer", "https://viewer.example/")
+	r.Header.Set("Range", "bytes=0-1")
+	r.Header.Set("Cookie", "viewer=1")
+
+	h := (&RequestProfile{}).headers(r)
+	if h["Referer"] != "https://viewer.example/" || h["Range"] != "bytes=0-1" || h["Cookie"] != "" {
+		t.Errorf("default headers = %v", h)
+	}
+	h = (&RequestProfile{Referer: "https://site/", StripHeaders: []string{"range"}}).headers(r)
+	if h["Referer"] != "https://site/" || h["Range"] != "" {
+		t.Errorf("profile headers = %v", h)
+	}
+}
+
+func TestImageProxyReferer(t *testing.T) {
+	got := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ref, ok := r.Header["Referer"]; ok {
+			got <- "[" + ref[0] + "]"
+		} else {
+			got <- "none"
+		}
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	tests := []struct {
+		name     string
+		profiles []HostRequestProfile
+		want     string
+	}{
+		{"no profile", nil, "none"},
+		{"profile referer", []HostRequestProfile{{Hosts: []string{u.Hostname()}, RequestProfile: RequestProfile{Referer: "https://site.example/"}}}, "[https://site.example/]"},
+	}
+	for _, tt := range tests {
+		withConfig(t, &Config{
+			RequestProfiles: tt.profiles,
+			TargetPolicy:    TargetPolicy{AllowedPorts: []int{port}, TrustedCIDRs: []string{u.Hostname()}},
+		})
+		r := httptest.NewRequest("GET", "/api/proxy/image?url="+url.QueryEscape(srv.URL+"/a.jpg"), nil)
+		r.Header.Set("Referer", "https://viewer.example/")
+		w := httptest.NewRecorder()
+		handleImageProxy(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tt.name, w.Code, w.Body)
+		}
+		if ref := <-got; ref != tt.want {
+			t.Errorf("%s: upstream Referer %s, want %s", tt.name, ref, tt.want)
+		}
+	}
+}
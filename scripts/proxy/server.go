@@ -5,45 +5,40 @@
 package main
 
 import (
-	"bytes"
 	"container/list"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
-	"path"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/lunatv/proxy-script/hls"
 )
 
 // ===== Configuration =====
 
 var (
-	config      Config
-	configPath  string
-	client      *http.Client
 	proxySecret string // Set via env PROXY_SECRET or -secret flag
 	devMode     bool
 
-	uriRegex = regexp.MustCompile(`URI="([^"]+)"`)
-
 	// Concurrency Control: Global Semaphore
 	// Limits concurrent upstream fetches to 200 total (Segments + FLV + Range)
 	globalSem = make(chan struct{}, 200)
@@ -52,18 +47,46 @@ var (
 	forwardHeaderAllowlist = map[string]bool{"Accept": true, "Accept-Language": true, "Cache-Control": true, "Content-Type": true, "Dnt": true, "If-Match": true, "If-Modified-Since": true, "If-None-Match": true, "If-Range": true, "If-Unmodified-Since": true, "Origin": true, "Pragma": true, "Range": true, "Referer": true, "Sec-Fetch-Dest": true, "Sec-Fetch-Mode": true, "Sec-Fetch-Site": true, "Sec-Fetch-User": true, "X-Requested-With": true}
 
 	// FIX: Removed Content-Encoding to prevent cache mismatches
-	cachedHeaderAllowlist = map[string]bool{"Content-Type": true, "Cache-Control": true, "Accept-Ranges": true, "Content-Range": true, "ETag": true, "Last-Modified": true, "Expires": true}
+	// Content-Location and X-Ad-Filter carry playlist cache metadata (see loadPlaylist)
+	// Keys are canonical: ETag is "Etag"
+	cachedHeaderAllowlist = map[string]bool{"Content-Type": true, "Cache-Control": true, "Accept-Ranges": true, "Content-Range": true, "Etag": true, "Last-Modified": true, "Expires": true, "Content-Location": true, "X-Ad-Filter": true}
 
 	skipHeaderPool  = sync.Pool{New: func() interface{} { return make(map[string]bool) }}
 	m3u8Tag         = []byte("#EXTM3U")
 	privateIPBlocks []*net.IPNet
 )
 
+// SourceOptions holds per-source proxy behaviour, keyed by moontv-source.
+// It is embedded in both live and VOD (CMS) source entries.
+type SourceOptions struct {
+	// SegmentMode selects how media segments and keys are emitted in rewritten
+	// playlists: "direct" (default), "proxy" or "auto".
+	SegmentMode string `json:"segmentMode,omitempty"`
+	// AdFilter strips spliced-in ad blocks from VOD playlists.
+	AdFilter bool `json:"adFilter,omitempty"`
+	// Decrypt makes the proxy fetch AES-128 keys and serve clear segments,
+	// for upstreams that bind keys to cookies or IP.
+	Decrypt bool `json:"decrypt,omitempty"`
+	// AllowPrivate lets the source reach private and loopback addresses
+	// (see targetpolicy.go).
+	AllowPrivate bool `json:"allowPrivate,omitempty"`
+	// Resolve pins host names to addresses for the source (see dns.go).
+	Resolve map[string][]string `json:"resolve,omitempty"`
+	// RequestProfile shapes upstream requests for the source (see profiles.go).
+	RequestProfile *RequestProfile `json:"requestProfile,omitempty"`
+}
 type LiveSource struct {
 	Key  string `json:"key"`
 	Name string `json:"name"`
 	URL  string `json:"url"`
 	UA   string `json:"ua"`
+	SourceOptions
+}
+type ApiSite struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	API  string `json:"api"`
+	SourceOptions
 }
 type SiteConfig struct {
 	DoubanImageProxyType string `json:"DoubanImageProxyType"`
@@ -71,8 +94,13 @@ type SiteConfig struct {
 	ImageCacheTTL        int    `json:"ImageCacheTTL"`
 }
 type Config struct {
-	LiveConfig []LiveSource `json:"LiveConfig"`
-	SiteConfig SiteConfig   `json:"SiteConfig"`
+	LiveConfig      []LiveSource         `json:"LiveConfig"`
+	SourceConfig    []ApiSite            `json:"SourceConfig"`
+	SiteConfig      SiteConfig           `json:"SiteConfig"`
+	RequestProfiles []HostRequestProfile `json:"RequestProfiles"`
+	TargetPolicy    TargetPolicy         `json:"TargetPolicy"`
+
+	egress *egressPool // Upstream clients, see egress.go
 }
 
 const (
@@ -83,18 +111,48 @@ const (
 	InitSegmentTTL   = 5 * time.Minute
 	MaxRetries       = 3
 	MaxSegmentSize   = 20 * 1024 * 1024
-	ReadLimit        = MaxSegmentSize + 1
 	PlaylistPeekByte = 2048
 )
 
+// Segment delivery modes for rewritten playlists.
+const (
+	SegmentModeDirect = "direct" // Browser fetches segments from the upstream (HTTPS-upgraded)
+	SegmentModeProxy  = "proxy"  // Segments and keys go through signed /api/proxy URLs
+	SegmentModeAuto   = "auto"   // Proxy only what the browser cannot fetch itself
+)
+
 // ===== HMAC Security (Strict V3) =====
 
+// signedExtraParams are optional query parameters covered by the signature.
+// They only enter the MAC when present, so URLs without them keep the
+// original V3 signature.
+var signedExtraParams = []string{"dkey", "div", "range", "init"}
+
+func writeSignedExtras(mac io.Writer, get func(string) string) {
+	for _, name := range signedExtraParams {
+		if v := get(name); v != "" {
+			mac.Write([]byte("|" + name + "="))
+			mac.Write([]byte(v))
+		}
+	}
+}
+
 func verifySignature(r *http.Request) bool {
+	reason := signatureFailure(r)
+	if reason != "" {
+		labels := metricLabelsOf(r.Context())
+		signatureFailures.with(labels.handler, labels.source, reason).Inc()
+	}
+	return reason == ""
+}
+
+// signatureFailure returns why r's signature is not acceptable, or "".
+func signatureFailure(r *http.Request) string {
 	if devMode {
-		return true
+		return ""
 	}
 	if proxySecret == "" {
-		return false
+		return "no-secret"
 	}
 
 	q := r.URL.Query()
@@ -103,12 +161,15 @@ func verifySignature(r *http.Request) bool {
 	targetURL := q.Get("url")
 
 	if providedHex == "" || expires == "" || targetURL == "" {
-		return false
+		return "missing"
 	}
 
 	expTime, err := strconv.ParseInt(expires, 10, 64)
-	if err != nil || time.Now().Unix() > expTime {
-		return false
+	if err != nil {
+		return "malformed"
+	}
+	if time.Now().Unix() > expTime {
+		return "expired"
 	}
 
 	rawAllow := q.Get("allowCORS")
@@ -116,12 +177,12 @@ func verifySignature(r *http.Request) bool {
 	if rawAllow == "true" {
 		allowStr = "true"
 	} else if rawAllow != "" {
-		return false
+		return "malformed"
 	}
 
 	provided, err := hex.DecodeString(providedHex)
 	if err != nil {
-		return false
+		return "malformed"
 	}
 
 	mac := hmac.New(sha256.New, []byte(proxySecret))
@@ -134,12 +195,16 @@ func verifySignature(r *http.Request) bool {
 	mac.Write([]byte(q.Get("moontv-source")))
 	mac.Write([]byte("|"))
 	mac.Write([]byte(allowStr))
+	writeSignedExtras(mac, q.Get)
 	expected := mac.Sum(nil)
 
-	return hmac.Equal(provided, expected)
+	if !hmac.Equal(provided, expected) {
+		return "mismatch"
+	}
+	return ""
 }
 
-func signURLParams(endpointPath, targetURL, sourceKey string, allowCORS bool) string {
+func signURLParams(endpointPath, targetURL, sourceKey string, allowCORS bool, extras url.Values) string {
 	if devMode {
 		return ""
 	}
@@ -160,6 +225,7 @@ func signURLParams(endpointPath, targetURL, sourceKey string, allowCORS bool) st
 	mac.Write([]byte(sourceKey))
 	mac.Write([]byte("|"))
 	mac.Write([]byte(allowStr))
+	writeSignedExtras(mac, extras.Get)
 	signature := hex.EncodeToString(mac.Sum(nil))
 
 	return fmt.Sprintf("&expires=%s&sign=%s", expires, signature)
@@ -168,7 +234,6 @@ func signURLParams(endpointPath, targetURL, sourceKey string, allowCORS bool) st
 // ===== Initialization & Security =====
 
 func init() {
-	rand.Seed(time.Now().UnixNano())
 	for _, cidr := range []string{
 		"0.0.0.0/8", "10.0.0.0/8", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4", "::/128", "::1/128", "fe80::/10", "fc00::/7", "ff00::/8",
 	} {
@@ -177,14 +242,23 @@ func init() {
 			privateIPBlocks = append(privateIPBlocks, block)
 		}
 	}
+}
+
+// upstreamDialer opens TCP connections to upstreams, or to egress proxies.
+var upstreamDialer = &net.Dialer{Timeout: 15 * time.Second, KeepAlive: 30 * time.Second}
+
+// dialFunc opens a raw connection to an address the SSRF guard has checked.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
 
-	dialer := &net.Dialer{Timeout: 15 * time.Second, KeepAlive: 30 * time.Second}
+// newUpstreamClient returns a client whose connections go through dial after
+// the SSRF guard.
+func newUpstreamClient(dial dialFunc) *http.Client {
 	baseTLSConfig := &tls.Config{MinVersion: tls.VersionTLS12}
 
 	transport := &http.Transport{
 		Proxy:                 nil, // Security: Ignore HTTP_PROXY
-		DialContext:           guardedDialContext(dialer),
-		DialTLSContext:        guardedDialTLSContext(dialer, baseTLSConfig),
+		DialContext:           guardedDialContext(dial),
+		DialTLSContext:        guardedDialTLSContext(dial, baseTLSConfig),
 		TLSClientConfig:       baseTLSConfig,
 		MaxIdleConns:          100,
 		MaxIdleConnsPerHost:   20,
@@ -196,7 +270,7 @@ func init() {
 		ForceAttemptHTTP2:     true,
 	}
 
-	client = &http.Client{
+	return &http.Client{
 		Transport: transport,
 		Timeout:   0,
 		Jar:       nil,
@@ -204,7 +278,7 @@ func init() {
 			if len(via) >= 3 {
 				return errors.New("stopped after 3 redirects")
 			}
-			return nil
+			return configOf(req.Context()).validateTargetURL(sourceKeyOf(req.Context()), req.URL.String())
 		},
 	}
 }
@@ -221,82 +295,54 @@ func isPrivateIP(ip net.IP) bool {
 	return false
 }
 
-func isSafePublicIP(ip net.IP) bool {
-	if ip == nil {
-		return false
-	}
-	ip = ip.To16()
-	if ip == nil || !ip.IsGlobalUnicast() || isPrivateIP(ip) {
-		return false
-	}
-	return true
-}
-
-func resolveAndPickSafeIP(ctx context.Context, host string) (net.IP, error) {
-	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+// safeDialAddr resolves addr to an IP the target policy allows, returning its
+// host name and the ip:port to dial.
+func safeDialAddr(ctx context.Context, addr string) (host, target string, err error) {
+	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil, err
+		return "", "", err
 	}
-	if len(ips) == 0 {
-		return nil, errors.New("no resolved ip")
-	}
-	safeIPs := make([]net.IP, 0, len(ips))
-	for _, ipa := range ips {
-		if isSafePublicIP(ipa.IP) {
-			safeIPs = append(safeIPs, ipa.IP)
+	ip := net.ParseIP(host)
+	if ip != nil {
+		if err := configOf(ctx).checkIP(sourceKeyOf(ctx), ip); err != nil {
+			return "", "", fmt.Errorf("ssrf blocked: %w", err)
 		}
+	} else if ip, err = resolveAndPickSafeIP(ctx, host); err != nil {
+		return "", "", err
 	}
-	if len(safeIPs) == 0 {
-		return nil, errors.New("ssrf blocked: no usable public ip")
-	}
-	return safeIPs[rand.Intn(len(safeIPs))], nil
+	return host, net.JoinHostPort(ip.String(), port), nil
 }
 
-func guardedDialContext(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+func guardedDialContext(dial dialFunc) func(ctx context.Context, network, addr string) (net.Conn, error) {
 	return func(ctx context.Context, network, addr string) (net.Conn, error) {
-		host, port, err := net.SplitHostPort(addr)
-		if err != nil {
-			return nil, err
-		}
-		if ip := net.ParseIP(host); ip != nil {
-			if !isSafePublicIP(ip) {
-				return nil, errors.New("ssrf blocked: non-public ip")
-			}
-			return d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
-		}
-		ip, err := resolveAndPickSafeIP(ctx, host)
+		_, target, err := safeDialAddr(ctx, addr)
 		if err != nil {
 			return nil, err
 		}
-		return d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		return dial(ctx, network, target)
 	}
 }
 
-func guardedDialTLSContext(d *net.Dialer, base *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+func guardedDialTLSContext(dial dialFunc, base *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
 	return func(ctx context.Context, network, addr string) (net.Conn, error) {
-		host, port, err := net.SplitHostPort(addr)
+		host, target, err := safeDialAddr(ctx, addr)
 		if err != nil {
 			return nil, err
 		}
-		var ip net.IP
-		if parsed := net.ParseIP(host); parsed != nil {
-			if !isSafePublicIP(parsed) {
-				return nil, errors.New("ssrf blocked: non-public ip")
-			}
-			ip = parsed
-		} else {
-			ip, err = resolveAndPickSafeIP(ctx, host)
-			if err != nil {
-				return nil, err
-			}
-		}
-		rawConn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		rawConn, err := dial(ctx, network, target)
 		if err != nil {
 			return nil, err
 		}
 		tlsConfig := buildTLSConfig(base, host)
 		tlsConn := tls.Client(rawConn, tlsConfig)
-		if err := tlsConn.HandshakeContext(ctx); err != nil {
+		// The transport only reports TLS to httptrace for handshakes it runs
+		// itself, so the span is recorded here.
+		_, span := startSpan(ctx, "tls", spanKindInternal)
+		span.SetAttr("tls.server_name", host)
+		err = tlsConn.HandshakeContext(ctx)
+		span.SetError(err)
+		span.End()
+		if err != nil {
 			rawConn.Close()
 			return nil, err
 		}
@@ -318,35 +364,16 @@ func buildTLSConfig(base *tls.Config, serverName string) *tls.Config {
 	return cfg
 }
 
-func validateTargetURL(rawURL string) error {
-	u, err := url.Parse(rawURL)
-	if err != nil {
-		return err
-	}
-	if u.Scheme != "http" && u.Scheme != "https" {
-		return errors.New("invalid scheme")
-	}
-	if u.Hostname() == "" {
-		return errors.New("missing hostname")
-	}
-	if u.User != nil {
-		return errors.New("user info not allowed")
-	}
-	port := u.Port()
-	if port != "" && port != "80" && port != "443" && port != "8080" {
-		return errors.New("non-standard port")
-	}
-	return nil
-}
-
 // ===== Cache & Singleflight =====
 
 type CacheItem struct {
-	Key       string
-	Data      []byte
-	Headers   http.Header
-	SizeBytes int64
-	ExpiresAt time.Time
+	Key        string
+	Data       []byte
+	Headers    http.Header
+	SizeBytes  int64
+	ExpiresAt  time.Time
+	Gen        uint64    // cacheGeneration the data was fetched under
+	StaleUntil time.Time // ShardedCache keeps stale entries until then for revalidation
 }
 type LRUCache struct {
 	sync.Mutex
@@ -355,28 +382,61 @@ type LRUCache struct {
 	currentBytes int64
 	items        map[string]*list.Element
 	evictList    *list.List
+
+	hits, misses, expired, evictions, purged, stale int64
 }
 
+// cacheGeneration is bumped by every purge. Data fetched before a purge is
+// never written back into any tier afterwards (see SetGen), so a purge can't
+// be undone by a fill or promotion that was already in flight.
+var cacheGeneration atomic.Uint64
+
 func NewLRUCache(capacity int, maxBytes int64) *LRUCache {
 	return &LRUCache{capacity: capacity, maxBytes: maxBytes, items: make(map[string]*list.Element), evictList: list.New()}
 }
 func (c *LRUCache) Get(key string) ([]byte, http.Header, bool) {
+	data, h, _, ok := c.GetGen(key)
+	return data, h, ok
+}
+
+// GetGen is Get that also returns the generation the entry was fetched under.
+func (c *LRUCache) GetGen(key string) ([]byte, http.Header, uint64, bool) {
 	c.Lock()
 	defer c.Unlock()
 	if ent, ok := c.items[key]; ok {
 		item := ent.Value.(*CacheItem)
 		if time.Now().After(item.ExpiresAt) {
 			c.removeElement(ent)
-			return nil, nil, false
+			c.expired++
+			c.misses++
+			return nil, nil, 0, false
 		}
 		c.evictList.MoveToFront(ent)
-		return item.Data, item.Headers, true
+		c.hits++
+		return item.Data, item.Headers, item.Gen, true
 	}
-	return nil, nil, false
+	c.misses++
+	return nil, nil, 0, false
 }
 func (c *LRUCache) Set(key string, data []byte, headers http.Header, ttl time.Duration) {
 	c.Lock()
 	defer c.Unlock()
+	c.set(cacheGeneration.Load(), key, data, headers, ttl)
+}
+
+// SetGen stores data fetched under generation gen, unless a purge has
+// happened since. It reports whether the entry was stored.
+func (c *LRUCache) SetGen(gen uint64, key string, data []byte, headers http.Header, ttl time.Duration) bool {
+	c.Lock()
+	defer c.Unlock()
+	if gen != cacheGeneration.Load() {
+		c.stale++
+		return false
+	}
+	c.set(gen, key, data, headers, ttl)
+	return true
+}
+func (c *LRUCache) set(gen uint64, key string, data []byte, headers http.Header, ttl time.Duration) {
 	headerCopy, headerBytes := filterAndCopyHeaders(headers)
 	itemSize := int64(len(data)) + headerBytes
 	if ent, ok := c.items[key]; ok {
@@ -387,16 +447,40 @@ func (c *LRUCache) Set(key string, data []byte, headers http.Header, ttl time.Du
 		item.Headers = headerCopy
 		item.SizeBytes = itemSize
 		item.ExpiresAt = time.Now().Add(ttl)
+		item.Gen = gen
 		c.currentBytes += itemSize
 		c.evict()
 		return
 	}
-	item := &CacheItem{Key: key, Data: data, Headers: headerCopy, SizeBytes: itemSize, ExpiresAt: time.Now().Add(ttl)}
+	item := &CacheItem{Key: key, Data: data, Headers: headerCopy, SizeBytes: itemSize, ExpiresAt: time.Now().Add(ttl), Gen: gen}
 	ent := c.evictList.PushFront(item)
 	c.items[key] = ent
 	c.currentBytes += itemSize
 	c.evict()
 }
+func (c *LRUCache) Delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if ent, ok := c.items[key]; ok {
+		c.removeElement(ent)
+	}
+}
+
+// Purge removes every entry whose key matches. The caller must have bumped
+// cacheGeneration first.
+func (c *LRUCache) Purge(match func(key string) bool) int {
+	c.Lock()
+	defer c.Unlock()
+	n := 0
+	for key, ent := range c.items {
+		if match(key) {
+			c.removeElement(ent)
+			n++
+		}
+	}
+	c.purged += int64(n)
+	return n
+}
 func (c *LRUCache) removeElement(e *list.Element) {
 	c.evictList.Remove(e)
 	kv := e.Value.(*CacheItem)
@@ -404,15 +488,30 @@ func (c *LRUCache) removeElement(e *list.Element) {
 	c.currentBytes -= kv.SizeBytes
 }
 func (c *LRUCache) evict() {
-	for c.evictList.Len() > c.capacity {
+	for c.evictList.Len() > c.capacity || (c.currentBytes > c.maxBytes && c.evictList.Len() > 0) {
 		c.removeElement(c.evictList.Back())
+		c.evictions++
 	}
-	for c.currentBytes > c.maxBytes && c.evictList.Len() > 0 {
-		c.removeElement(c.evictList.Back())
+}
+
+func (c *LRUCache) snapshot() map[string]int64 {
+	c.Lock()
+	defer c.Unlock()
+	return map[string]int64{
+		"entries":   int64(c.evictList.Len()),
+		"capacity":  int64(c.capacity),
+		"bytes":     c.currentBytes,
+		"maxBytes":  c.maxBytes,
+		"hits":      c.hits,
+		"misses":    c.misses,
+		"expired":   c.expired,
+		"evictions": c.evictions,
+		"purged":    c.purged,
+		"stale":     c.stale,
 	}
 }
 
-var globalSegmentCache = NewLRUCache(MaxCacheItems, MaxCacheBytes)
+var globalSegmentCache = NewShardedCache(DefaultCacheShards, MaxCacheItems, MaxCacheBytes)
 
 type call struct {
 	wg      sync.WaitGroup
@@ -423,62 +522,96 @@ type call struct {
 type Group struct {
 	mu sync.Mutex
 	m  map[string]*call
+
+	calls, shared atomic.Int64 // Calls made, and callers that waited for one
 }
 
-func (g *Group) Do(key string, fn func() ([]byte, http.Header, error)) ([]byte, http.Header, error) {
+// Do runs fn once for concurrent callers of key. shared reports whether the
+// result came from another caller's call.
+func (g *Group) Do(key string, fn func() ([]byte, http.Header, error)) (val []byte, headers http.Header, shared bool, err error) {
 	g.mu.Lock()
 	if g.m == nil {
 		g.m = make(map[string]*call)
 	}
 	if c, ok := g.m[key]; ok {
 		g.mu.Unlock()
+		g.shared.Add(1)
 		c.wg.Wait()
-		return c.val, c.headers, c.err
+		return c.val, c.headers, true, c.err
 	}
 	c := new(call)
 	c.wg.Add(1)
 	g.m[key] = c
 	g.mu.Unlock()
+	g.calls.Add(1)
 	c.val, c.headers, c.err = fn()
 	c.wg.Done()
 	g.mu.Lock()
-	delete(g.m, key)
+	if g.m[key] == c {
+		delete(g.m, key)
+	}
 	g.mu.Unlock()
-	return c.val, c.headers, c.err
+	return c.val, c.headers, false, c.err
+}
+
+// ForgetMatching detaches in-flight calls whose key matches, so later callers
+// start a fresh call instead of waiting for the old result.
+func (g *Group) ForgetMatching(match func(key string) bool) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := 0
+	for key := range g.m {
+		if match(key) {
+			delete(g.m, key)
+			n++
+		}
+	}
+	return n
 }
 
 var sfGroup Group
 
 // ===== Helper Functions =====
 
-// FIX: Fail fast if config is invalid
-func loadConfig(path string) error {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return err
+func (c *Config) sourceOptions(sourceKey string) SourceOptions {
+	for _, src := range c.LiveConfig {
+		if src.Key == sourceKey {
+			return src.SourceOptions
+		}
 	}
-	return json.Unmarshal(data, &config)
-}
-
-func getUserAgent(sourceKey string) string {
-	for _, src := range config.LiveConfig {
+	for _, src := range c.SourceConfig {
 		if src.Key == sourceKey {
-			if src.UA != "" {
-				return src.UA
-			}
+			return src.SourceOptions
 		}
 	}
-	return DefaultUserAgent
+	return SourceOptions{}
 }
 
-func forwardableHeaders(r *http.Request) map[string]string {
-	h := make(map[string]string)
-	for k, vv := range r.Header {
-		if len(vv) > 0 && forwardHeaderAllowlist[http.CanonicalHeaderKey(k)] {
-			h[k] = vv[0]
+func segmentModeOf(opts SourceOptions) string {
+	switch mode := opts.SegmentMode; mode {
+	case SegmentModeProxy, SegmentModeAuto:
+		return mode
+	}
+	return SegmentModeDirect
+}
+
+// shouldProxySegment decides per URI whether a segment/key must be proxied.
+// Auto mode proxies http-only URIs (mixed content) and URIs whose request
+// profile sets a UA or headers, which the browser cannot send on its own.
+// Built-in profiles don't count: auto mode never proxied for those quirks
+// before they became profiles.
+func (c *Config) shouldProxySegment(mode, resolved, sourceKey string) bool {
+	switch mode {
+	case SegmentModeProxy:
+		return true
+	case SegmentModeAuto:
+		if strings.HasPrefix(resolved, "http://") {
+			return true
 		}
+		p := c.configuredProfile(sourceKey, resolved)
+		return p.custom()
 	}
-	return h
+	return false
 }
 
 func copyHeaders(dst, src http.Header) {
@@ -584,9 +717,24 @@ func fetchWithRetry(ctx context.Context, method, targetURL, userAgent string, he
 	if method == "" {
 		method = "GET"
 	}
+	if err := configOf(ctx).validateTargetURL(sourceKeyOf(ctx), targetURL); err != nil {
+		return nil, err
+	}
+	labels := metricLabelsOf(ctx)
+	info := requestInfoOf(ctx)
+	c := clientFor(ctx, targetURL)
 	for i := 0; i < MaxRetries; i++ {
-		req, e := http.NewRequestWithContext(ctx, method, targetURL, nil)
+		if i > 0 {
+			upstreamRetries.with(labels.handler, labels.source).Inc()
+		}
+		attemptCtx, span := startSpan(ctx, "upstream.attempt", spanKindClient)
+		span.SetAttr("http.method", method)
+		span.SetAttr("url.full", redactURL(targetURL))
+		span.SetAttr("attempt", i+1)
+		req, e := http.NewRequestWithContext(attemptTrace(attemptCtx, span), method, targetURL, nil)
 		if e != nil {
+			span.SetError(e)
+			span.End()
 			return nil, e
 		}
 		req.Header.Set("User-Agent", userAgent)
@@ -594,14 +742,32 @@ func fetchWithRetry(ctx context.Context, method, targetURL, userAgent string, he
 			req.Header.Set(k, v)
 		}
 
-		resp, err = client.Do(req)
+		resp, err = c.Do(req)
+		if err == nil {
+			span.SetAttr("http.status_code", resp.StatusCode)
+		}
+		span.SetError(err)
+		span.End()
 		if err == nil {
+			info.noteAttempt(targetURL, resp.StatusCode, i > 0)
+			upstreamResponses.with(labels.handler, labels.source, strconv.Itoa(resp.StatusCode)).Inc()
+			resp.Body = &countingBody{ReadCloser: resp.Body, series: upstreamBytes.with(labels.handler, labels.source), info: info}
 			if resp.StatusCode < 500 && resp.StatusCode != 429 {
 				return resp, nil
 			}
 			resp.Body.Close()
-		} else if ctx.Err() != nil {
-			return nil, ctx.Err()
+			logger(ctx).Debug("upstream attempt failed", "url", redactURL(targetURL), "attempt", i+1, "status", resp.StatusCode)
+		} else {
+			info.noteAttempt(targetURL, 0, i > 0)
+			upstreamResponses.with(labels.handler, labels.source, "error").Inc()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			var denied *targetDenied
+			if errors.As(err, &denied) {
+				return nil, err // Retrying won't change the policy
+			}
+			logger(ctx).Debug("upstream attempt failed", "url", redactURL(targetURL), "attempt", i+1, "err", redactError(err))
 		}
 
 		select {
@@ -613,13 +779,133 @@ func fetchWithRetry(ctx context.Context, method, targetURL, userAgent string, he
 	return resp, err
 }
 
+func segmentCacheKey(sourceKey, targetURL string, sub *segmentRange, dec *segmentDecryption) string {
+	cacheKey := sourceKey + "|" + targetURL
+	if sub != nil {
+		cacheKey += "|range=" + sub.String()
+	}
+	if dec != nil {
+		cacheKey += "|" + dec.cacheSuffix()
+	}
+	return cacheKey
+}
+
+// segmentParams returns the signed extras of the /segment URL for s: its key
+// URL and IV in decrypt mode, and its byte range. sub and dec are what the
+// segment handler parses from them, for segmentCacheKey; err is what it
+// would reject them with.
+func segmentParams(playlistURL string, s *hls.Segment, decrypt bool) (extras url.Values, sub *segmentRange, dec *segmentDecryption, err error) {
+	if decrypt && s.Encrypted() {
+		k := s.Keys[0]
+		iv, ok := k.IV()
+		if !ok {
+			iv = hls.SequenceIV(s.SequenceNumber)
+		}
+		dec = &segmentDecryption{keyURL: resolveURL(playlistURL, k.URI()), iv: iv}
+		extras = url.Values{"dkey": {dec.keyURL}, "div": {hex.EncodeToString(iv)}}
+	}
+	extras = rangeExtras(extras, s.ByteRange)
+	sub, err = parseSegmentRange(extras.Get("range"))
+	return extras, sub, dec, err
+}
+
+// segmentSource fetches a segment for a fill: the requested sub-range,
+// decrypted if asked to. A stale cache entry is revalidated instead. Upstream
+// failures are remembered in negativeCache.
+func segmentSource(targetURL, sourceKey, ua string, headers map[string]string, sub *segmentRange, dec *segmentDecryption, stale *CacheItem) fillSource {
+	cacheKey := segmentCacheKey(sourceKey, targetURL, sub, dec)
+	gen := cacheGeneration.Load()
+	return func(ctx context.Context) (io.ReadCloser, http.Header, error) {
+		ctx = withSourceKey(withMetricLabels(ctx, "segment", sourceKey), sourceKey)
+		localHeaders := cloneHeadersMap(headers)
+		for _, k := range conditionalHeaders {
+			delete(localHeaders, k) // The fill is shared; validators are ours
+		}
+		localHeaders["Accept-Encoding"] = "identity"
+		if sub != nil {
+			localHeaders["Range"] = "bytes=" + sub.String()
+		}
+		if stale != nil {
+			revalidate(localHeaders, stale)
+		}
+
+		resp, err := fetchWithRetry(ctx, "GET", targetURL, ua, localHeaders)
+		if err != nil {
+			negativeCache.RecordError(gen, cacheKey, err)
+			return nil, nil, err
+		}
+		negativeCache.RecordStatus(gen, cacheKey, resp.StatusCode)
+		if stale != nil && resp.StatusCode == http.StatusNotModified {
+			body, h := notModifiedBody(resp, stale)
+			return body, h, nil
+		}
+		body, h, err := openSegmentBody(ctx, resp, sub, dec, sourceKey)
+		if err != nil {
+			resp.Body.Close()
+			return nil, nil, err
+		}
+		return body, h, nil
+	}
+}
+
+// segmentCommit stores a completed fill for as long as the upstream allows
+// (fallback without explicit freshness), unless it looks like an error page
+// or a purge happened since the fetch started.
+func segmentCommit(cacheKey string, fallback time.Duration) func([]byte, http.Header) {
+	gen := cacheGeneration.Load()
+	return func(data []byte, h http.Header) {
+		ct := h.Get("Content-Type")
+		if strings.Contains(ct, "html") || strings.Contains(ct, "json") {
+			return
+		}
+		ttl, ok := freshnessTTL(h, fallback, time.Now())
+		if !ok {
+			policyStats.Uncacheable.Add(1)
+			return
+		}
+		if ttl > 0 || hasValidators(h) {
+			globalSegmentCache.SetGen(gen, cacheKey, data, h, ttl)
+		}
+	}
+}
+
+// openSegmentBody positions a segment response at sub and wraps it in a
+// decrypter when asked to. The returned headers describe the bytes actually
+// returned; closing the body closes the upstream response.
+func openSegmentBody(ctx context.Context, resp *http.Response, sub *segmentRange, dec *segmentDecryption, sourceKey string) (io.ReadCloser, http.Header, error) {
+	h := resp.Header
+	var body io.Reader = resp.Body
+	if sub != nil {
+		r, err := openSubRange(resp, sub)
+		if err != nil {
+			return nil, nil, err
+		}
+		body = r
+		h = h.Clone()
+		h.Del("Content-Range")
+		h.Set("Content-Length", strconv.FormatInt(sub.length(), 10))
+	} else if resp.StatusCode != 200 {
+		return nil, nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if dec != nil {
+		var err error
+		if body, h, err = decryptSegment(ctx, body, h, dec, sourceKey); err != nil {
+			return nil, nil, err
+		}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{body, resp.Body}, h, nil
+}
+
 func handleHeadProxy(w http.ResponseWriter, r *http.Request, targetURL, ua string, reqHeaders map[string]string) bool {
 	if r.Method != http.MethodHead {
 		return false
 	}
 	resp, err := fetchWithRetry(r.Context(), "HEAD", targetURL, ua, reqHeaders)
 	if err != nil {
-		http.Error(w, "HEAD error", 502)
+		upstreamError(w, r, "HEAD error", err)
 		return true
 	}
 	defer resp.Body.Close()
@@ -634,110 +920,175 @@ func resolveURL(baseURL, relativePath string) string {
 		return relativePath
 	}
 	base, _ := url.Parse(baseURL)
-	ref, _ := url.Parse(relativePath)
+	ref, err := url.Parse(relativePath)
+	if base == nil || err != nil {
+		return relativePath
+	}
 	return base.ResolveReference(ref).String()
 }
 
-func getBaseURL(m3u8URL string) string {
-	u, _ := url.Parse(m3u8URL)
-	if strings.HasSuffix(u.Path, ".m3u8") {
-		u.Path = path.Dir(u.Path) + "/"
-	} else if !strings.HasSuffix(u.Path, "/") {
-		u.Path += "/"
+func buildProxyURL(proxyBase, endpoint, resolved, sourceKey string, allowCORS bool, extras url.Values) string {
+	signedParams := signURLParams("/api/proxy"+endpoint, resolved, sourceKey, allowCORS, extras)
+	pURL := fmt.Sprintf("%s%s?url=%s&moontv-source=%s%s", proxyBase, endpoint, url.QueryEscape(resolved), url.QueryEscape(sourceKey), signedParams)
+	for _, name := range signedExtraParams {
+		if v := extras.Get(name); v != "" {
+			pURL += "&" + name + "=" + url.QueryEscape(v)
+		}
+	}
+	if allowCORS {
+		pURL += "&allowCORS=true"
 	}
-	u.RawQuery = ""
-	u.Fragment = ""
-	return u.String()
+	return pURL
 }
 
-func rewriteM3U8(content, baseURL, proxyBase, sourceKey string, allowCORS bool) string {
-	// [FORCE HTTPS]
-	// Ensure the proxy base itself is HTTPS to match the site origin
-	if strings.HasPrefix(proxyBase, "http://") {
-		proxyBase = strings.Replace(proxyBase, "http://", "https://", 1)
+func upgradeHTTPS(resolved string) string {
+	if strings.HasPrefix(resolved, "http://") {
+		return strings.Replace(resolved, "http://", "https://", 1)
 	}
+	return resolved
+}
 
-	lines := strings.Split(content, "\n")
-	var result []string
-	pendingStreamInf := false
-
-	for i := 0; i < len(lines); i++ {
-		line := strings.TrimSpace(lines[i])
-		if line == "" {
-			result = append(result, "")
-			continue
-		}
-		if !strings.HasPrefix(line, "#") {
-			// Resolve to absolute URL always
-			resolved := resolveURL(baseURL, line)
-
-			// [HTTPS CHECK moved down]
+// playlistRewriter maps playlist URIs to proxy or direct URLs.
+// URIs are resolved against the final playlist URL (RFC 3986), and each URI
+// is classified by the tag it belongs to rather than by its file name.
+type playlistRewriter struct {
+	cfg         *Config
+	playlistURL string
+	proxyBase   string
+	sourceKey   string
+	segmentMode string
+	allowCORS   bool
+	decrypt     bool
+}
 
-			// [DIRECT PLAY MODE]
-			// User requested segments to be played directly from the source to reduce CPU load.
-			// OR if it is a nested M3U8 playlist, we MUST proxy it to keep control.
+// playlist proxies nested playlists (variants, renditions) to keep control.
+func (rw *playlistRewriter) playlist(ref string) string {
+	resolved := resolveURL(rw.playlistURL, ref)
+	if !strings.HasPrefix(resolved, "http") {
+		return ref
+	}
+	return buildProxyURL(rw.proxyBase, "/m3u8", resolved, rw.sourceKey, rw.allowCORS, nil)
+}
 
-			if pendingStreamInf || strings.HasSuffix(resolved, ".m3u8") {
-				// It's a playlist (Adaptive Stream), proxy it!
-				endpoint := "/m3u8"
-				signedParams := signURLParams("/api/proxy"+endpoint, resolved, sourceKey, allowCORS)
-				proxyURL := fmt.Sprintf("%s%s?url=%s&moontv-source=%s%s", proxyBase, endpoint, url.QueryEscape(resolved), url.QueryEscape(sourceKey), signedParams)
-				if allowCORS {
-					proxyURL += "&allowCORS=true"
-				}
-				result = append(result, proxyURL)
-				pendingStreamInf = false
-				continue
-			}
+// media handles segments, init sections and keys according to the segment mode.
+// Direct URIs are fetched by the browser and must be HTTPS to avoid Mixed
+// Content blocking.
+// A byte range moves into the signed URL when the URI is proxied, so the
+// returned range is nil in that case and the caller drops its BYTERANGE.
+func (rw *playlistRewriter) media(endpoint, ref string, br *hls.ByteRange, extras url.Values) (string, *hls.ByteRange) {
+	resolved := resolveURL(rw.playlistURL, ref)
+	if !strings.HasPrefix(resolved, "http") {
+		return ref, br // data:, skd:// and friends are left alone
+	}
+	if rw.cfg.shouldProxySegment(rw.segmentMode, resolved, rw.sourceKey) {
+		return buildProxyURL(rw.proxyBase, endpoint, resolved, rw.sourceKey, rw.allowCORS, rangeExtras(extras, br)), nil
+	}
+	return upgradeHTTPS(resolved), br
+}
 
-			// Otherwise, it's a SEGMENT (TS, JS, etc). Leave it as absolute URL (Direct Play).
+func (rw *playlistRewriter) segment(ref string) string {
+	uri, _ := rw.media("/segment", ref, nil, nil)
+	return uri
+}
 
-			// [HTTPS UPGRADE]
-			// Upgrade direct upstream links to HTTPS to avoid Mixed Content blocking.
-			// This is REQUIRED for Direct Play as the browser fetches these.
-			if strings.HasPrefix(resolved, "http://") {
-				resolved = strings.Replace(resolved, "http://", "https://", 1)
-			}
+// key always proxies AES keys: they are tiny, cacheable, and upstreams often
+// reject browser requests for them.
+func (rw *playlistRewriter) key(ref string) string {
+	resolved := resolveURL(rw.playlistURL, ref)
+	if !strings.HasPrefix(resolved, "http") {
+		return ref
+	}
+	return buildProxyURL(rw.proxyBase, "/key", resolved, rw.sourceKey, rw.allowCORS, nil)
+}
 
-			result = append(result, resolved)
+func (rw *playlistRewriter) tags(tags []*hls.Tag) {
+	for _, t := range tags {
+		uri := t.URI()
+		if uri == "" {
 			continue
 		}
+		switch t.Name {
+		case hls.TagMedia, hls.TagIFrameStreamInf, hls.TagRenditionReport:
+			t.SetURI(rw.playlist(uri))
+		case hls.TagSessionKey, hls.TagKey:
+			t.SetURI(rw.key(uri))
+		case hls.TagMap, hls.TagPart, hls.TagPreloadHint, hls.TagSessionData:
+			t.SetURI(rw.segment(uri))
+		}
+	}
+}
 
-		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
-			pendingStreamInf = true
+func (rw *playlistRewriter) rewrite(pl hls.Playlist) {
+	switch p := pl.(type) {
+	case *hls.MasterPlaylist:
+		rw.tags(p.Tags)
+		for _, v := range p.Variants {
+			v.URI = rw.playlist(v.URI)
 		}
+	case *hls.MediaPlaylist:
+		if rw.decrypt && canDecryptServerSide(p) {
+			rw.rewriteDecrypted(p)
+			return
+		}
+		for _, k := range p.Keys() {
+			if uri := k.URI(); uri != "" {
+				k.SetURI(rw.key(uri))
+			}
+		}
+		for _, m := range p.Maps() {
+			rw.initSection(m)
+		}
+		for _, s := range p.Segments {
+			rw.tags(s.Tags)
+			s.URI, s.ByteRange = rw.media("/segment", s.URI, s.ByteRange, nil)
+		}
+		rw.tags(p.Trailer)
+	}
+}
 
-		if strings.Contains(line, `URI="`) {
-			line = uriRegex.ReplaceAllStringFunc(line, func(match string) string {
-				sub := uriRegex.FindStringSubmatch(match)
-				if len(sub) < 2 {
-					return match
-				}
-				resolved := resolveURL(baseURL, sub[1])
-
-				// [HTTPS CHECK moved down]
-
-				// Only proxy if it looks like a playlist, otherwise direct
-				if strings.HasSuffix(resolved, ".m3u8") {
-					endpoint := "/m3u8"
-					signedParams := signURLParams("/api/proxy"+endpoint, resolved, sourceKey, allowCORS)
-					pURL := fmt.Sprintf("%s%s?url=%s&moontv-source=%s%s", proxyBase, endpoint, url.QueryEscape(resolved), url.QueryEscape(sourceKey), signedParams)
-					if allowCORS {
-						pURL += "&allowCORS=true"
-					}
-					return fmt.Sprintf(`URI="%s"`, pURL)
-				}
+func (rw *playlistRewriter) initSection(m *hls.Map) {
+	var br *hls.ByteRange
+	if r, ok := m.ByteRange(); ok {
+		br = &r
+	}
+	// init=1 selects InitSegmentTTL when the upstream gives no lifetime.
+	uri, br := rw.media("/segment", m.URI(), br, url.Values{"init": {"1"}})
+	m.SetURI(uri)
+	if br == nil {
+		m.Attrs.Del("BYTERANGE")
+	}
+}
 
-				// Key/Other -> Direct Play (Upgrade to HTTPS)
-				if strings.HasPrefix(resolved, "http://") {
-					resolved = strings.Replace(resolved, "http://", "https://", 1)
-				}
-				return fmt.Sprintf(`URI="%s"`, resolved)
-			})
+// rewriteDecrypted points every segment at a /segment URL that carries its
+// key URL and IV, and drops the EXT-X-KEY lines: the proxy serves clear TS.
+func (rw *playlistRewriter) rewriteDecrypted(p *hls.MediaPlaylist) {
+	for _, s := range p.Segments {
+		resolved := resolveURL(rw.playlistURL, s.URI)
+		extras, _, _, _ := segmentParams(rw.playlistURL, s, true)
+		rw.tags(s.Tags)
+		s.URI = buildProxyURL(rw.proxyBase, "/segment", resolved, rw.sourceKey, rw.allowCORS, extras)
+		s.ByteRange = nil
+		s.Keys = nil
+	}
+	trailer := p.Trailer[:0]
+	for _, t := range p.Trailer {
+		if t.Name != hls.TagKey {
+			trailer = append(trailer, t)
 		}
-		result = append(result, line)
 	}
-	return strings.Join(result, "\n")
+	p.Trailer = trailer
+	rw.tags(p.Trailer)
+}
+
+func rewriteM3U8(pl hls.Playlist, playlistURL, proxyBase, sourceKey string, cfg *Config, allowCORS bool) {
+	// [FORCE HTTPS]
+	// Ensure the proxy base itself is HTTPS to match the site origin
+	if strings.HasPrefix(proxyBase, "http://") {
+		proxyBase = strings.Replace(proxyBase, "http://", "https://", 1)
+	}
+	opts := cfg.sourceOptions(sourceKey)
+	rw := &playlistRewriter{cfg: cfg, playlistURL: playlistURL, proxyBase: proxyBase, sourceKey: sourceKey, segmentMode: segmentModeOf(opts), allowCORS: allowCORS, decrypt: opts.Decrypt}
+	rw.rewrite(pl)
 }
 
 func handleImageProxy(w http.ResponseWriter, r *http.Request) {
@@ -757,16 +1108,22 @@ func handleImageProxy(w http.ResponseWriter, r *http.Request) {
 	}
 
 	proxyURL := rawURL
-	headers := map[string]string{"Referer": ""}
+	cfg := configOf(ctx)
+	profile := cfg.requestProfile("", rawURL)
+	ua := profile.userAgent()
+	// The viewer's headers, Referer included, are not forwarded; a Referer
+	// goes upstream only if the host's profile sets one.
+	headers := profile.headers(nil)
 
-	// Douban Special Handling (The Fix)
+	site := cfg.SiteConfig
+
+	// Douban Special Handling (The Fix); its Referer comes from the doubanio request profile
 	if strings.Contains(rawURL, "doubanio.com") {
-		headers["Referer"] = "https://movie.douban.com/"
-		if config.SiteConfig.DoubanImageProxyType == "custom" && config.SiteConfig.DoubanImageProxy != "" {
+		if site.DoubanImageProxyType == "custom" && site.DoubanImageProxy != "" {
 			// If URL already encoded? No, config usually expects base.
 			// Let's assume standard behavior: append param
 			// But careful with double encoding if the config is just a prefix
-			proxyURL = config.SiteConfig.DoubanImageProxy + url.QueryEscape(rawURL)
+			proxyURL = site.DoubanImageProxy + url.QueryEscape(rawURL)
 		} else {
 			// Mirror Fallback
 			re := regexp.MustCompile(`img\d*\.doubanio\.com`)
@@ -778,20 +1135,19 @@ func handleImageProxy(w http.ResponseWriter, r *http.Request) {
 	}
 
 	finalURL := proxyURL
-	if err := validateTargetURL(finalURL); err != nil {
-		http.Error(w, "Invalid target", 403)
+	if err := cfg.validateTargetURL("", finalURL); err != nil {
+		http.Error(w, "Invalid target: "+err.Error(), 403)
 		return
 	}
 
-	if handleHeadProxy(w, r, finalURL, DefaultUserAgent, headers) {
+	if handleHeadProxy(w, r, finalURL, ua, headers) {
 		return
 	}
 
-	resp, err := fetchWithRetry(ctx, r.Method, finalURL, DefaultUserAgent, headers)
+	resp, err := fetchWithRetry(ctx, r.Method, finalURL, ua, headers)
 	if err != nil {
 		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
-			log.Printf("[Image Proxy Error] %s | Error: %v", finalURL, err)
-			http.Error(w, "Fetch error", 502)
+			upstreamError(w, r, "Fetch error", err)
 		}
 		return
 	}
@@ -817,7 +1173,7 @@ func handleImageProxy(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Content-Type", ct)
 
-	cacheTTL := config.SiteConfig.ImageCacheTTL
+	cacheTTL := site.ImageCacheTTL
 	if cacheTTL <= 0 {
 		cacheTTL = 30
 	}
@@ -825,7 +1181,7 @@ func handleImageProxy(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, stale-while-revalidate=%d", cacheTTL*86400, cacheTTL*86400))
 
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	streamBody(ctx, w, resp.Body)
 }
 
 // ===== Handlers =====
@@ -841,7 +1197,23 @@ func commonHandler(w http.ResponseWriter, r *http.Request, handlerType string) {
 		http.Error(w, "Forbidden: Invalid Signature", 403)
 		return
 	}
-	if err := acquireSemaphore(r.Context()); err != nil {
+	cfg := configOf(r.Context())
+	if handlerType == "segment" {
+		// Known upstream failures are answered without waiting for a slot.
+		if status, ok := negativeSegmentStatus(cfg, r.URL.Query()); ok {
+			setCORSHeaders(w)
+			w.Header().Set("X-Cache", "NEGATIVE")
+			http.Error(w, "Segment error", status)
+			return
+		}
+	}
+	_, span := startSpan(r.Context(), "admission", spanKindInternal)
+	err := acquireSemaphore(r.Context())
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		labels := metricLabelsOf(r.Context())
+		semaphoreTimeouts.with(labels.handler, labels.source).Inc()
 		http.Error(w, err.Error(), 503)
 		return
 	}
@@ -856,19 +1228,16 @@ func commonHandler(w http.ResponseWriter, r *http.Request, handlerType string) {
 		http.Error(w, "Missing url", 400)
 		return
 	}
-	if err := validateTargetURL(targetURL); err != nil {
-		http.Error(w, "Invalid target", 400)
+	sourceKey := r.URL.Query().Get("moontv-source")
+	if err := cfg.validateTargetURL(sourceKey, targetURL); err != nil {
+		http.Error(w, "Invalid target: "+err.Error(), 400)
 		return
 	}
 
-	sourceKey := r.URL.Query().Get("moontv-source")
 	allowCORS := r.URL.Query().Get("allowCORS") == "true"
-	ua := getUserAgent(sourceKey)
-	reqHeaders := forwardableHeaders(r)
-
-	if strings.Contains(targetURL, "huya") {
-		reqHeaders["Referer"] = "https://www.huya.com/"
-	}
+	profile := cfg.requestProfile(sourceKey, targetURL)
+	ua := profile.userAgent()
+	reqHeaders := profile.headers(r)
 
 	if handleHeadProxy(w, r, targetURL, ua, reqHeaders) {
 		return
@@ -876,134 +1245,177 @@ func commonHandler(w http.ResponseWriter, r *http.Request, handlerType string) {
 
 	// M3U8 Logic
 	if handlerType == "m3u8" {
-		reqHeaders["Accept-Encoding"] = "identity"
-
-		resp, err := fetchWithRetry(ctx, "GET", targetURL, ua, reqHeaders)
-		if err != nil {
-			http.Error(w, "Fetch error", 502)
+		body, h, hit, err := loadPlaylist(ctx, sourceKey, targetURL, ua, reqHeaders)
+		var raw *uncachedResponse
+		if errors.As(err, &raw) {
+			copyHeaders(w.Header(), raw.header)
+			setCORSHeaders(w)
+			w.WriteHeader(raw.status)
+			w.Write(raw.body)
 			return
 		}
-		defer resp.Body.Close()
-
-		body, err := io.ReadAll(io.LimitReader(resp.Body, 2*1024*1024))
 		if err != nil {
-			http.Error(w, "Read error", 502)
+			upstreamError(w, r, "Fetch error", err)
 			return
 		}
 
-		if bytes.Contains(body, m3u8Tag) || strings.Contains(resp.Header.Get("Content-Type"), "mpegurl") {
-			scheme := "http"
-			if r.TLS != nil || strings.EqualFold(firstCSV(r.Header.Get("X-Forwarded-Proto")), "https") {
-				scheme = "https"
-			}
-			host := r.Host
-			if fh := firstCSV(r.Header.Get("X-Forwarded-Host")); fh != "" {
-				host = fh
-			}
-			proxyBase := fmt.Sprintf("%s://%s/api/proxy", scheme, host)
-
-			baseURL := getBaseURL(resp.Request.URL.String())
-			rewritten := rewriteM3U8(string(body), baseURL, proxyBase, sourceKey, allowCORS)
-
-			copyHeaders(w.Header(), resp.Header)
-			setCORSHeaders(w)
-
-			w.Header().Del("Content-Length")
-			w.Header().Del("Content-Encoding")
-			w.Header().Del("ETag")
-			w.Header().Del("Last-Modified")
-			w.Header().Set("Cache-Control", "no-cache")
-			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		scheme := "http"
+		if r.TLS != nil || strings.EqualFold(firstCSV(r.Header.Get("X-Forwarded-Proto")), "https") {
+			scheme = "https"
+		}
+		host := r.Host
+		if fh := firstCSV(r.Header.Get("X-Forwarded-Host")); fh != "" {
+			host = fh
+		}
+		proxyBase := fmt.Sprintf("%s://%s/api/proxy", scheme, host)
 
-			w.WriteHeader(resp.StatusCode)
-			w.Write([]byte(rewritten))
+		// The cached body is shared: decode a private copy to rewrite.
+		pl, err := hls.Decode(body)
+		if err != nil {
+			upstreamError(w, r, "Playlist error", err)
 			return
 		}
-		copyHeaders(w.Header(), resp.Header)
+		rewriteM3U8(pl, h.Get("Content-Location"), proxyBase, sourceKey, cfg, allowCORS)
+
 		setCORSHeaders(w)
-		w.WriteHeader(resp.StatusCode)
-		w.Write(body)
+		if report := h.Get("X-Ad-Filter"); report != "" {
+			w.Header().Set("X-Ad-Filter", report)
+		}
+		if hit {
+			w.Header().Set("X-Cache", "HIT")
+		} else {
+			w.Header().Set("X-Cache", "MISS")
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.WriteHeader(200)
+		w.Write(pl.Encode())
+		return
+	}
+
+	// Key Logic
+	if handlerType == "key" {
+		serveKey(w, r, targetURL, sourceKey)
 		return
 	}
 
 	// Segment Logic
 	if handlerType == "segment" {
+		q := r.URL.Query()
+		dec, err := parseSegmentDecryption(cfg, q)
+		if err != nil {
+			http.Error(w, "Invalid decryption params", 400)
+			return
+		}
+		sub, err := parseSegmentRange(q.Get("range"))
+		if err != nil {
+			http.Error(w, "Invalid range", 400)
+			return
+		}
+
+		// Decrypted and sub-range segments are addressed by their signed URL and
+		// always served whole: the viewer's Range applies to neither.
+		whole := dec != nil || sub != nil
+		if whole {
+			delete(reqHeaders, "Range")
+			delete(reqHeaders, "If-Range")
+			if sub != nil {
+				reqHeaders["Range"] = "bytes=" + sub.String()
+			}
+		}
+
 		// FIX: Bypass cache if strong preconditions (If-Match) are present
-		bypassCache := r.Header.Get("Range") != "" || hasStrongPreconditions(r)
+		bypassCache := (r.Header.Get("Range") != "" && !whole) || hasStrongPreconditions(r)
 
 		if bypassCache {
-			if r.Header.Get("Range") != "" {
+			if r.Header.Get("Range") != "" && !whole {
 				reqHeaders["Range"] = r.Header.Get("Range")
 			}
-			// Preconditions are already in reqHeaders via forwardableHeaders
+			// Preconditions are already in reqHeaders via the request profile
 
 			// Force identity to avoid gzip mismatch if we are bypassing cache but upstream sends gzip
 			reqHeaders["Accept-Encoding"] = "identity"
 
 			resp, err := fetchWithRetry(ctx, r.Method, targetURL, ua, reqHeaders)
 			if err != nil {
-				http.Error(w, "Fetch error", 502)
+				upstreamError(w, r, "Fetch error", err)
 				return
 			}
 			defer resp.Body.Close()
+			if whole && (resp.StatusCode == 200 || (resp.StatusCode == 206 && sub != nil)) {
+				body, h, err := openSegmentBody(ctx, resp, sub, dec, sourceKey)
+				if err != nil {
+					upstreamError(w, r, "Segment error", err)
+					return
+				}
+				copyHeaders(w.Header(), h)
+				setCORSHeaders(w)
+				w.Header().Set("X-Cache", "BYPASS")
+				w.WriteHeader(200)
+				streamBody(ctx, w, body)
+				return
+			}
 			copyHeaders(w.Header(), resp.Header)
 			setCORSHeaders(w)
 			w.Header().Set("X-Cache", "BYPASS")
 			w.WriteHeader(resp.StatusCode)
-			io.Copy(w, resp.Body)
+			streamBody(ctx, w, resp.Body)
 			return
 		}
 
-		cacheKey := sourceKey + "|" + targetURL
-		if data, h, ok := globalSegmentCache.Get(cacheKey); ok {
+		cacheKey := segmentCacheKey(sourceKey, targetURL, sub, dec)
+		if prefetch != nil {
+			prefetch.onSegment(cacheKey)
+		}
+		_, span := startSpan(ctx, "cache.lookup", spanKindInternal)
+		item, hit := lookupSegment(cacheKey)
+		span.SetAttr("cache.tier", "segments")
+		span.SetAttr("cache.hit", hit != "")
+		span.SetAttr("cache.result", hit)
+		span.End()
+		if hit != "" {
+			data, h := item.Data, item.Headers
 			if shouldReturn304FromCache(r, h) {
 				copyHeaders(w.Header(), h)
 				setCORSHeaders(w)
-				w.Header().Set("X-Cache", "HIT-304")
+				w.Header().Set("X-Cache", hit+"-304")
 				w.WriteHeader(304)
 				return
 			}
 			copyHeaders(w.Header(), h)
 			setCORSHeaders(w)
-			w.Header().Set("X-Cache", "HIT")
+			w.Header().Set("X-Cache", hit)
 			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
 			w.Write(data)
 			return
 		}
 
-		data, h, err := sfGroup.Do(cacheKey, func() ([]byte, http.Header, error) {
-			localHeaders := cloneHeadersMap(reqHeaders)
-			localHeaders["Accept-Encoding"] = "identity"
-
-			resp, err := fetchWithRetry(r.Context(), "GET", targetURL, ua, localHeaders)
-			if err != nil {
-				return nil, nil, err
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != 200 {
-				return nil, nil, fmt.Errorf("status %d", resp.StatusCode)
-			}
-			d, err := io.ReadAll(io.LimitReader(resp.Body, int64(ReadLimit)))
-			if len(d) > MaxSegmentSize {
-				return nil, nil, errors.New("too large")
-			}
-			return d, resp.Header, err
-		})
-
+		fallback := SegmentTTL
+		if q.Get("init") == "1" {
+			fallback = InitSegmentTTL
+		}
+		fr, leader := segmentFills.join(ctx, cacheKey, segmentSource(targetURL, sourceKey, ua, reqHeaders, sub, dec, item), segmentCommit(cacheKey, fallback))
+		defer fr.Close()
+
+		_, span = startSpan(ctx, "fill.wait", spanKindInternal)
+		span.SetAttr("coalesced", !leader)
+		h, err := fr.Header()
+		span.SetError(err)
+		span.End()
 		if err != nil {
-			http.Error(w, "Segment error", 502)
+			upstreamError(w, r, "Segment error", err)
 			return
 		}
 
-		ct := h.Get("Content-Type")
-		if !strings.Contains(ct, "html") && !strings.Contains(ct, "json") {
-			globalSegmentCache.Set(cacheKey, data, h, SegmentTTL)
-		}
-
 		copyHeaders(w.Header(), h)
 		setCORSHeaders(w)
-		w.Header().Set("X-Cache", "MISS")
-		w.Write(data)
+		if leader {
+			w.Header().Set("X-Cache", "MISS")
+		} else {
+			w.Header().Set("X-Cache", "COALESCED")
+		}
+		w.WriteHeader(200)
+		streamBody(ctx, w, fr)
 		return
 	}
 
@@ -1013,14 +1425,14 @@ func commonHandler(w http.ResponseWriter, r *http.Request, handlerType string) {
 	}
 	resp, err := fetchWithRetry(ctx, r.Method, targetURL, ua, reqHeaders)
 	if err != nil {
-		http.Error(w, "Fetch error", 502)
+		upstreamError(w, r, "Fetch error", err)
 		return
 	}
 	defer resp.Body.Close()
 	copyHeaders(w.Header(), resp.Header)
 	setCORSHeaders(w)
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	streamBody(ctx, w, resp.Body)
 }
 
 // ===== Structs & Middleware =====
@@ -1029,7 +1441,7 @@ func setCORSHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
 	w.Header().Set("Access-Control-Allow-Headers", "Range, Content-Type")
-	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, X-Cache, ETag, Last-Modified")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, X-Cache, X-Ad-Filter, ETag, Last-Modified")
 }
 
 type statusWriter struct {
@@ -1051,27 +1463,51 @@ func (w *statusWriter) Write(b []byte) (int, error) {
 	return n, err
 }
 
-func logRequest(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		sw := &statusWriter{ResponseWriter: w}
-		next.ServeHTTP(sw, r)
-		log.Printf("%s %s %s | %d | %v", r.RemoteAddr, r.Method, r.URL.Path, sw.status, time.Since(start))
-	})
+// envOr returns the environment variable name, or def when it is unset.
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
 }
 
 func main() {
 	addr := flag.String("addr", ":8080", "Listen address")
 	configFlag := flag.String("config", "", "Config path")
+	configPollFlag := flag.Duration("config-poll", DefaultConfigPollInterval, "How often to check the config file for changes (0 disables; SIGHUP always reloads)")
 	secretFlag := flag.String("secret", "", "Proxy secret")
 	devFlag := flag.Bool("dev", false, "Enable dev mode (no auth)")
+	diskDirFlag := flag.String("disk-cache-dir", os.Getenv("PROXY_DISK_CACHE_DIR"), "Directory for the disk segment cache (disabled if empty)")
+	diskSizeFlag := flag.Int64("disk-cache-size", 4096, "Disk segment cache budget in MB")
+	diskTTLFlag := flag.Duration("disk-cache-ttl", DefaultDiskCacheTTL, "Disk segment cache entry lifetime")
+	prefetchFlag := flag.Int("prefetch", 0, "Segments to prefetch ahead of each viewer (0 disables)")
+	prefetchSlotsFlag := flag.Int("prefetch-slots", DefaultPrefetchSlots, "Upstream fetch slots prefetching may use")
+	adminTokenFlag := flag.String("admin-token", os.Getenv("PROXY_ADMIN_TOKEN"), "Bearer token for /api/proxy/admin (disabled if empty)")
+	snapshotFlag := flag.String("cache-snapshot", os.Getenv("PROXY_CACHE_SNAPSHOT"), "Save the segment cache here on shutdown and reload it on start (disabled if empty)")
+	cachePolicyFlag := flag.String("cache-policy", "clock", "Segment cache admission policy: clock or tinylfu")
+	cacheShadowFlag := flag.Bool("cache-policy-shadow", false, "Also simulate the other cache policy and report its hit ratio")
+	negative4xxFlag := flag.Duration("negative-ttl-4xx", DefaultNegativeTTL4xx, "How long upstream 4xx segment failures are remembered (0 disables)")
+	negative5xxFlag := flag.Duration("negative-ttl-5xx", DefaultNegativeTTL5xx, "How long upstream 5xx, 429 and timeout segment failures are remembered (0 disables)")
+	snapshotDataFlag := flag.Bool("cache-snapshot-data", false, "Include segment bodies in the cache snapshot (always on without -disk-cache-dir)")
+	logFormatFlag := flag.String("log-format", envOr("PROXY_LOG_FORMAT", "text"), "Log format: text or json")
+	logLevelFlag := flag.String("log-level", envOr("PROXY_LOG_LEVEL", "info"), "Minimum log level: debug, info, warn or error")
+	dnsUpstreamFlag := flag.String("dns-upstream", os.Getenv("PROXY_DNS_UPSTREAM"), "DNS for upstream hosts: system, a DoH URL, or nameserver IPs separated by commas")
+	dnsTTLFlag := flag.Duration("dns-ttl", DefaultDNSTTL, "How long system resolver answers are cached")
+	otlpEndpointFlag := flag.String("otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector to export traces to (disabled if empty)")
+	traceSampleFlag := flag.Float64("trace-sample", 1, "Fraction of requests without a traceparent to trace")
 	flag.Parse()
 
+	if err := setupLogging(*logFormatFlag, *logLevelFlag); err != nil {
+		fatal(err.Error())
+	}
+
 	if *configFlag != "" {
-		configPath = *configFlag
-		if err := loadConfig(configPath); err != nil {
-			log.Fatalf("Config load error: %v", err)
+		r, err := newConfigReloader(*configFlag)
+		if err != nil {
+			fatal("config load failed", "path", *configFlag, "err", err)
 		}
+		reloader = r
+		go reloader.watch(*configPollFlag)
 	}
 
 	proxySecret = os.Getenv("PROXY_SECRET")
@@ -1079,22 +1515,81 @@ func main() {
 		proxySecret = *secretFlag
 	}
 	devMode = *devFlag
+	adminToken = *adminTokenFlag
+	negativeCache.ttl4xx, negativeCache.ttl5xx = *negative4xxFlag, *negative5xxFlag
+	go negativeCache.janitor()
 
 	if proxySecret == "" && !devMode {
-		log.Fatal("🚨 FATAL: PROXY_SECRET not set. Use -secret or set env var. Use -dev to bypass.")
+		fatal("PROXY_SECRET not set. Use -secret or set env var. Use -dev to bypass.")
 	}
 	if devMode {
-		log.Println("⚠️  DEV MODE: Authentication disabled.")
+		slog.Warn("dev mode: authentication disabled")
+	}
+
+	switch *cachePolicyFlag {
+	case "clock":
+	case "tinylfu":
+		globalSegmentCache.enableTinyLFU()
+	default:
+		fatal("unknown -cache-policy", "policy", *cachePolicyFlag)
+	}
+	if *cacheShadowFlag {
+		globalSegmentCache.enableShadow()
+		slog.Info("segment cache policy shadowed", "policy", globalSegmentCache.policy(), "shadow", globalSegmentCache.shadow.policy())
+	}
+	lookup, err := newDNSUpstream(*dnsUpstreamFlag)
+	if err != nil {
+		fatal("invalid -dns-upstream", "err", err)
+	}
+	dnsCache = NewDNSCache(lookup)
+	dnsCache.systemTTL = *dnsTTLFlag
+	if lookup != nil {
+		slog.Info("dns upstream configured", "upstream", redactURL(*dnsUpstreamFlag))
+	}
+	if *otlpEndpointFlag != "" {
+		tracer = newTraceExporter(*otlpEndpointFlag, envOr("OTEL_SERVICE_NAME", "lunatv-proxy"), *traceSampleFlag)
+		slog.Info("tracing enabled", "endpoint", redactURL(tracer.endpoint), "sample", *traceSampleFlag)
+	}
+	if *diskDirFlag != "" {
+		d, err := NewDiskCache(*diskDirFlag, *diskSizeFlag*1024*1024, *diskTTLFlag)
+		if err != nil {
+			fatal("disk cache failed", "err", err)
+		}
+		diskTier = d
+		globalSegmentCache.onEvict = d.Demote
+		slog.Info("disk cache enabled", "dir", *diskDirFlag, "size_mb", *diskSizeFlag, "ttl", *diskTTLFlag)
+	}
+	if *prefetchFlag > 0 {
+		slots := *prefetchSlotsFlag
+		if slots <= 0 || slots >= cap(globalSem) {
+			fatal(fmt.Sprintf("-prefetch-slots must be between 1 and %d", cap(globalSem)-1))
+		}
+		prefetch = newPrefetcher(*prefetchFlag, slots)
+		slog.Info("prefetching enabled", "ahead", *prefetchFlag, "slots", slots)
+	}
+	if *snapshotFlag != "" {
+		if n, err := loadCacheSnapshot(globalSegmentCache, *snapshotFlag); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("cache snapshot not loaded", "path", *snapshotFlag, "err", err)
+		} else if n > 0 {
+			slog.Info("cache snapshot restored", "entries", n, "path", *snapshotFlag)
+		}
 	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/proxy/m3u8", func(w http.ResponseWriter, r *http.Request) { commonHandler(w, r, "m3u8") })
-	mux.HandleFunc("/api/proxy/segment", func(w http.ResponseWriter, r *http.Request) { commonHandler(w, r, "segment") })
-	mux.HandleFunc("/api/proxy/ts", func(w http.ResponseWriter, r *http.Request) { commonHandler(w, r, "segment") })
-	mux.HandleFunc("/api/proxy/key", func(w http.ResponseWriter, r *http.Request) { commonHandler(w, r, "key") })
-	mux.HandleFunc("/api/proxy/flv", func(w http.ResponseWriter, r *http.Request) { commonHandler(w, r, "flv") })
-	mux.HandleFunc("/api/image-proxy", handleImageProxy)
+	mux.HandleFunc("/api/proxy/m3u8", instrument("m3u8", func(w http.ResponseWriter, r *http.Request) { commonHandler(w, r, "m3u8") }))
+	mux.HandleFunc("/api/proxy/segment", instrument("segment", func(w http.ResponseWriter, r *http.Request) { commonHandler(w, r, "segment") }))
+	mux.HandleFunc("/api/proxy/ts", instrument("segment", func(w http.ResponseWriter, r *http.Request) { commonHandler(w, r, "segment") }))
+	mux.HandleFunc("/api/proxy/key", instrument("key", func(w http.ResponseWriter, r *http.Request) { commonHandler(w, r, "key") }))
+	mux.HandleFunc("/api/proxy/flv", instrument("flv", func(w http.ResponseWriter, r *http.Request) { commonHandler(w, r, "flv") }))
+	mux.HandleFunc("/api/image-proxy", instrument("image", handleImageProxy))
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("OK")) })
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/api/proxy/stats", requireAdmin(handleAdminStats)) // Same as cache/stats
+	mux.HandleFunc("/api/proxy/admin/cache/stats", requireAdmin(handleAdminStats))
+	mux.HandleFunc("/api/proxy/admin/cache/keys", requireAdmin(handleAdminKeys))
+	mux.HandleFunc("/api/proxy/admin/cache/purge", requireAdmin(handleAdminPurge))
+	mux.HandleFunc("/api/proxy/admin/config", requireAdmin(handleAdminConfig))
+	mux.HandleFunc("/api/proxy/admin/config/reload", requireAdmin(handleAdminConfigReload))
 
 	handler := logRequest(mux)
 
@@ -1105,11 +1600,11 @@ func main() {
 		MaxHeaderBytes:    1 << 20,
 	}
 
-	log.Printf("🚀 LunaTV Golden Master Proxy (V6.6.1) starting on %s", *addr)
+	slog.Info("LunaTV Golden Master Proxy (V6.6.1) starting", "addr", *addr)
 
 	go func() {
 		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("listen: %v", err)
+			fatal("listen failed", "err", err)
 		}
 	}()
 
@@ -1120,5 +1615,16 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	server.Shutdown(ctx)
-	log.Println("🛑 Server stopped")
+	if tracer != nil {
+		tracer.shutdown(ctx)
+	}
+	if *snapshotFlag != "" {
+		withData := *snapshotDataFlag || diskTier == nil // Metadata alone is useless without the disk tier
+		if n, err := saveCacheSnapshot(globalSegmentCache, *snapshotFlag, withData); err != nil {
+			slog.Warn("cache snapshot failed", "path", *snapshotFlag, "err", err)
+		} else {
+			slog.Info("cache snapshot saved", "entries", n, "path", *snapshotFlag)
+		}
+	}
+	slog.Info("server stopped")
 }
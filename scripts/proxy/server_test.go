@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lunatv/proxy-script/hls"
+)
+
+// withConfig installs cfg for the duration of the test.
+func withConfig(t *testing.T, cfg *Config) {
+	t.Helper()
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	old := getConfig()
+	cfg.egress = newEgressPool()
+	currentConfig.Store(cfg)
+	t.Cleanup(func() { currentConfig.Store(old) })
+}
+
+// testSource is the source key testUpstream lets reach its server.
+const testSource = "test"
+
+// testUpstream starts an upstream on loopback and installs a config that lets
+// testSource reach it. It returns the server and a context for testSource.
+func testUpstream(t *testing.T, h http.Handler) (*httptest.Server, context.Context) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+	withConfig(t, &Config{
+		LiveConfig:   []LiveSource{{Key: testSource, SourceOptions: SourceOptions{AllowPrivate: true}}},
+		TargetPolicy: TargetPolicy{AllowedPorts: []int{port}},
+	})
+	return srv, withSourceKey(context.Background(), testSource)
+}
+
+// withSecret signs proxy URLs with a fixed secret for the duration of the test.
+func withSecret(t *testing.T) {
+	t.Helper()
+	old := proxySecret
+	proxySecret = "test-secret"
+	t.Cleanup(func() { proxySecret = old })
+}
+
+// proxiedTarget returns the upstream URL a rewritten proxy URL points at, or
+// "" if uri does not go through the proxy endpoint.
+func proxiedTarget(t *testing.T, uri, endpoint string) string {
+	t.Helper()
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/api/proxy"+endpoint {
+		return ""
+	}
+	if !verifySignature(httptest.NewRequest("GET", uri, nil)) {
+		t.Errorf("bad signature on %s", uri)
+	}
+	return u.Query().Get("url")
+}
+
+func decodeMedia(t *testing.T, s string) *hls.MediaPlaylist {
+	t.Helper()
+	pl, err := hls.Decode([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pl.(*hls.MediaPlaylist)
+}
+
+func TestSegmentModeOf(t *testing.T) {
+	for mode, want := range map[string]string{SegmentModeProxy: SegmentModeProxy, SegmentModeAuto: SegmentModeAuto, "proxied": SegmentModeDirect, "": SegmentModeDirect} {
+		if got := segmentModeOf(SourceOptions{SegmentMode: mode}); got != want {
+			t.Errorf("segmentModeOf(%q) = %q, want %q", mode, got, want)
+		}
+	}
+}
+
+func TestAutoModeIgnoresBuiltinProfiles(t *testing.T) {
+	cfg := &Config{RequestProfiles: []HostRequestProfile{{Hosts: []string{"cdn.example.com"}, RequestProfile: RequestProfile{Referer: "https://example.com/"}}}}
+	tests := map[string]bool{
+		"https://al.hls.huya.com/src/a.ts":  false,
+		"https://img1.doubanio.com/a.jpg":   false,
+		"https://cdn.example.com/huya/a.ts": true, // Its configured profile counts
+	}
+	for target, want := range tests {
+		if got := cfg.shouldProxySegment(SegmentModeAuto, target, "src"); got != want {
+			t.Errorf("%s: proxied = %v, want %v", target, got, want)
+		}
+	}
+}
+
+func TestRewriteMaster(t *testing.T) {
+	withSecret(t)
+	pl, _ := hls.Decode([]byte(`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a",NAME="en",URI="audio/en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000
+low/index.m3u8
+`))
+	rewriteM3U8(pl, "https://cdn.example.com/live/master.m3u8", "https://proxy.example.com/api/proxy", "src", &Config{}, false)
+	p := pl.(*hls.MasterPlaylist)
+	if got := proxiedTarget(t, p.Variants[0].URI, "/m3u8"); got != "https://cdn.example.com/live/low/index.m3u8" {
+		t.Errorf("variant -> %q", got)
+	}
+	if got := proxiedTarget(t, p.TagsNamed(hls.TagMedia)[0].URI(), "/m3u8"); got != "https://cdn.example.com/live/audio/en.m3u8" {
+		t.Errorf("rendition -> %q", got)
+	}
+}
+
+func TestRewriteMediaSegmentModes(t *testing.T) {
+	withSecret(t)
+	const in = `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-KEY:METHOD=AES-128,URI="/keys/k1"
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4,
+http://cdn.example.com/vod/a.ts
+#EXTINF:4,
+#EXT-X-BYTERANGE:100@0
+b.ts
+`
+	const base = "https://cdn.example.com/vod/index.m3u8"
+	tests := []struct {
+		mode, source string
+		proxied      []bool // Init section, a.ts, b.ts
+	}{
+		{SegmentModeDirect, "src", []bool{false, false, false}},
+		{SegmentModeProxy, "src", []bool{true, true, true}},
+		{SegmentModeAuto, "src", []bool{false, true, false}}, // Only the http:// segment
+		{SegmentModeAuto, "ua", []bool{true, true, true}},    // The browser can't send the UA
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+"/"+tt.source, func(t *testing.T) {
+			src := LiveSource{Key: tt.source, SourceOptions: SourceOptions{SegmentMode: tt.mode}}
+			if tt.source == "ua" {
+				src.UA = "Custom/1.0"
+			}
+			p := decodeMedia(t, in)
+			rewriteM3U8(p, base, "https://proxy.example.com/api/proxy", tt.source, &Config{LiveConfig: []LiveSource{src}}, false)
+			if got := proxiedTarget(t, p.Keys()[0].URI(), "/key"); got != "https://cdn.example.com/keys/k1" {
+				t.Errorf("key -> %q", p.Keys()[0].URI())
+			}
+			uris := []string{p.Maps()[0].URI()}
+			for _, s := range p.Segments {
+				uris = append(uris, s.URI)
+			}
+			for i, uri := range uris {
+				target := proxiedTarget(t, uri, "/segment")
+				if (target != "") != tt.proxied[i] {
+					t.Errorf("URI %d -> %q, proxied = %v", i, uri, !tt.proxied[i])
+				}
+				if target == "" && !strings.HasPrefix(uri, "https://cdn.example.com/") {
+					t.Errorf("direct URI %d not upgraded to https: %q", i, uri)
+				}
+			}
+			b := p.Segments[1]
+			if tt.proxied[2] {
+				if b.ByteRange != nil || !strings.Contains(b.URI, "range=0-99") {
+					t.Errorf("proxied byte range: %q, %v", b.URI, b.ByteRange)
+				}
+			} else if b.ByteRange == nil {
+				t.Error("direct segment lost its byte range")
+			}
+		})
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"container/list"
+	"hash/maphash"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ===== Sharded Cache =====
+//
+// ShardedCache splits the segment cache into independently locked shards
+// chosen by key hash, with item and byte budgets accounted globally. Hits
+// only take a shard's read lock: instead of moving the entry to the front of
+// the LRU list they set its referenced bit, and eviction gives referenced
+// entries a second chance (CLOCK). Headers are filtered before any lock is
+// taken. Entries that can be revalidated outlive their freshness by
+// SegmentStaleRetention (see cachepolicy.go). With TinyLFU admission new
+// entries pass through a window region first (see tinylfu.go).
+
+const DefaultCacheShards = 64
+
+type shardEntry struct {
+	item       *CacheItem
+	referenced atomic.Bool
+	window     bool // In cacheShard.window rather than evictList
+}
+
+type cacheShard struct {
+	sync.RWMutex
+	items     map[string]*list.Element // Values are *shardEntry
+	evictList *list.List               // Main region
+	window    *list.List               // TinyLFU window region, newest first
+
+	// Hit counters live per shard so hits never share a cache line.
+	hits, misses atomic.Int64
+	_            [64]byte
+}
+
+type ShardedCache struct {
+	shards   []cacheShard
+	seed     maphash.Seed
+	capacity int64
+	maxBytes int64
+	onEvict  func(*CacheItem) // Called under a shard lock for capacity evictions only; must not block
+
+	admission *frequencySketch // nil for plain CLOCK
+	windowCap int64            // TinyLFU window budget, items
+	windowMax int64            // TinyLFU window budget, bytes
+	shadow    *ShardedCache    // Metadata-only copy running the other policy, or nil
+
+	count  atomic.Int64
+	bytes  atomic.Int64
+	cursor atomic.Uint64 // Next shard to evict from when over budget
+
+	windowCount, windowBytes atomic.Int64
+
+	expired, evictions, purged, stale, admitted, rejected atomic.Int64
+}
+
+// NewShardedCache creates a cache with shards rounded up to a power of two.
+func NewShardedCache(shards, capacity int, maxBytes int64) *ShardedCache {
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+	c := &ShardedCache{shards: make([]cacheShard, n), seed: maphash.MakeSeed(), capacity: int64(capacity), maxBytes: maxBytes}
+	for i := range c.shards {
+		c.shards[i].items = make(map[string]*list.Element)
+		c.shards[i].evictList = list.New()
+		c.shards[i].window = list.New()
+	}
+	return c
+}
+
+// enableTinyLFU switches admission to W-TinyLFU. It must be called before
+// the cache is used.
+func (c *ShardedCache) enableTinyLFU() {
+	c.admission = newFrequencySketch(int(c.capacity))
+	c.windowCap = int64(float64(c.capacity) * TinyLFUWindowRatio)
+	c.windowMax = int64(float64(c.maxBytes) * TinyLFUWindowRatio)
+}
+
+// enableShadow tracks the hit ratio the other policy would have had on the
+// same requests, without storing any data.
+func (c *ShardedCache) enableShadow() {
+	c.shadow = NewShardedCache(len(c.shards), int(c.capacity), c.maxBytes)
+	if c.admission == nil {
+		c.shadow.enableTinyLFU()
+	}
+}
+
+func (c *ShardedCache) policy() string {
+	if c.admission != nil {
+		return "tinylfu"
+	}
+	return "clock"
+}
+
+// access records a request for key with the admission policy and the shadow.
+func (c *ShardedCache) access(key string) {
+	if c.admission != nil {
+		c.admission.increment(key)
+	}
+	if c.shadow != nil {
+		c.shadow.Lookup(key)
+	}
+}
+
+func (c *ShardedCache) shard(key string) *cacheShard {
+	return &c.shards[maphash.String(c.seed, key)&uint64(len(c.shards)-1)]
+}
+
+func (c *ShardedCache) Get(key string) ([]byte, http.Header, bool) {
+	data, h, _, ok := c.GetGen(key)
+	return data, h, ok
+}
+
+// GetGen is Get that also returns the generation the entry was fetched under.
+func (c *ShardedCache) GetGen(key string) ([]byte, http.Header, uint64, bool) {
+	c.access(key)
+	s := c.shard(key)
+	s.RLock()
+	ent, ok := s.items[key]
+	if !ok {
+		s.RUnlock()
+		s.misses.Add(1)
+		return nil, nil, 0, false
+	}
+	e := ent.Value.(*shardEntry)
+	item := e.item
+	s.RUnlock()
+
+	if now := time.Now(); now.After(item.ExpiresAt) {
+		if now.After(item.StaleUntil) {
+			s.Lock()
+			if cur, ok := s.items[key]; ok && cur == ent {
+				c.remove(s, ent)
+				c.expired.Add(1)
+			}
+			s.Unlock()
+		}
+		s.misses.Add(1)
+		return nil, nil, 0, false
+	}
+	if !e.referenced.Load() {
+		e.referenced.Store(true)
+	}
+	s.hits.Add(1)
+	return item.Data, item.Headers, item.Gen, true
+}
+
+// Lookup is Get that also returns a stale entry still kept for revalidation.
+// fresh reports whether it may be served as is.
+func (c *ShardedCache) Lookup(key string) (item *CacheItem, fresh bool) {
+	c.access(key)
+	s := c.shard(key)
+	s.RLock()
+	ent, ok := s.items[key]
+	if ok {
+		item = ent.Value.(*shardEntry).item
+	}
+	s.RUnlock()
+	if !ok || time.Now().After(item.StaleUntil) {
+		s.misses.Add(1)
+		return nil, false
+	}
+	if time.Now().After(item.ExpiresAt) {
+		s.misses.Add(1)
+		return item, false
+	}
+	ent.Value.(*shardEntry).referenced.Store(true)
+	s.hits.Add(1)
+	return item, true
+}
+
+// Peek reports whether a fresh entry exists, without marking it referenced or
+// touching the hit counters.
+func (c *ShardedCache) Peek(key string) bool {
+	s := c.shard(key)
+	s.RLock()
+	defer s.RUnlock()
+	ent, ok := s.items[key]
+	return ok && time.Now().Before(ent.Value.(*shardEntry).item.ExpiresAt)
+}
+
+func (c *ShardedCache) Set(key string, data []byte, headers http.Header, ttl time.Duration) {
+	c.set(key, data, headers, ttl, 0, false)
+}
+
+// SetGen stores data fetched under generation gen, unless a purge has
+// happened since. It reports whether the entry was stored.
+func (c *ShardedCache) SetGen(gen uint64, key string, data []byte, headers http.Header, ttl time.Duration) bool {
+	return c.set(key, data, headers, ttl, gen, true)
+}
+
+func (c *ShardedCache) set(key string, data []byte, headers http.Header, ttl time.Duration, gen uint64, checkGen bool) bool {
+	headerCopy, headerBytes := filterAndCopyHeaders(headers)
+	item := &CacheItem{Key: key, Data: data, Headers: headerCopy, SizeBytes: int64(len(data)) + headerBytes, ExpiresAt: time.Now().Add(ttl)}
+	item.StaleUntil = item.ExpiresAt
+	if hasValidators(headerCopy) {
+		item.StaleUntil = item.StaleUntil.Add(SegmentStaleRetention)
+	}
+	if !c.insert(item, gen, checkGen) {
+		return false
+	}
+	if c.shadow != nil {
+		c.shadow.insert(&CacheItem{Key: key, SizeBytes: item.SizeBytes, ExpiresAt: item.ExpiresAt, StaleUntil: item.StaleUntil}, 0, false)
+	}
+	return true
+}
+
+func (c *ShardedCache) insert(item *CacheItem, gen uint64, checkGen bool) bool {
+	s := c.shard(item.Key)
+	s.Lock()
+	if !checkGen {
+		gen = cacheGeneration.Load()
+	} else if gen != cacheGeneration.Load() {
+		s.Unlock()
+		c.stale.Add(1)
+		return false
+	}
+	item.Gen = gen
+	if ent, ok := s.items[item.Key]; ok {
+		// Readers copy e.item under the read lock, so it can be swapped here.
+		e := ent.Value.(*shardEntry)
+		c.bytes.Add(item.SizeBytes - e.item.SizeBytes)
+		if e.window {
+			c.windowBytes.Add(item.SizeBytes - e.item.SizeBytes)
+			s.window.MoveToFront(ent)
+		} else {
+			s.evictList.MoveToFront(ent)
+		}
+		e.item = item
+	} else if c.admission != nil {
+		s.items[item.Key] = s.window.PushFront(&shardEntry{item: item, window: true})
+		c.count.Add(1)
+		c.bytes.Add(item.SizeBytes)
+		c.windowCount.Add(1)
+		c.windowBytes.Add(item.SizeBytes)
+	} else {
+		s.items[item.Key] = s.evictList.PushFront(&shardEntry{item: item})
+		c.count.Add(1)
+		c.bytes.Add(item.SizeBytes)
+	}
+	if c.admission != nil {
+		// Drain the window as it fills rather than all at once when the
+		// whole cache first goes over budget.
+		for c.windowOver() && c.settleWindow(s) {
+		}
+	}
+	s.Unlock()
+
+	c.shrink()
+	return true
+}
+
+func (c *ShardedCache) Delete(key string) {
+	if c.shadow != nil {
+		c.shadow.Delete(key)
+	}
+	s := c.shard(key)
+	s.Lock()
+	if ent, ok := s.items[key]; ok {
+		c.remove(s, ent)
+	}
+	s.Unlock()
+}
+
+// Purge removes every entry whose key matches. The caller must have bumped
+// cacheGeneration first.
+func (c *ShardedCache) Purge(match func(key string) bool) int {
+	if c.shadow != nil {
+		c.shadow.Purge(match)
+	}
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		for key, ent := range s.items {
+			if match(key) {
+				c.remove(s, ent)
+				n++
+			}
+		}
+		s.Unlock()
+	}
+	c.purged.Add(int64(n))
+	return n
+}
+
+func (c *ShardedCache) remove(s *cacheShard, ent *list.Element) {
+	e := ent.Value.(*shardEntry)
+	item := e.item
+	if e.window {
+		s.window.Remove(ent)
+		c.windowCount.Add(-1)
+		c.windowBytes.Add(-item.SizeBytes)
+	} else {
+		s.evictList.Remove(ent)
+	}
+	delete(s.items, item.Key)
+	c.count.Add(-1)
+	c.bytes.Add(-item.SizeBytes)
+}
+
+func (c *ShardedCache) overBudget() bool {
+	return c.count.Load() > c.capacity || c.bytes.Load() > c.maxBytes
+}
+
+// shrink evicts from the shards in turn until the cache is within budget.
+func (c *ShardedCache) shrink() {
+	for idle := 0; c.overBudget() && idle < len(c.shards); {
+		s := &c.shards[c.cursor.Add(1)&uint64(len(c.shards)-1)]
+		s.Lock()
+		if c.evictOne(s) {
+			idle = 0
+		} else {
+			idle++
+		}
+		s.Unlock()
+	}
+}
+
+// evictOne removes one entry of s, or with TinyLFU may instead settle the
+// admission of a window entry. It reports whether it made progress.
+func (c *ShardedCache) evictOne(s *cacheShard) bool {
+	if c.admission != nil {
+		return c.evictTinyLFU(s)
+	}
+	victim := c.clockVictim(s)
+	if victim == nil {
+		return false
+	}
+	c.evict(s, victim)
+	return true
+}
+
+// clockVictim returns the least recently used unreferenced entry of the main
+// region of s, clearing referenced bits on the way.
+func (c *ShardedCache) clockVictim(s *cacheShard) *list.Element {
+	for i := s.evictList.Len(); i >= 0; i-- {
+		ent := s.evictList.Back()
+		if ent == nil {
+			return nil
+		}
+		if i > 0 && ent.Value.(*shardEntry).referenced.Swap(false) {
+			s.evictList.MoveToFront(ent)
+			continue
+		}
+		return ent
+	}
+	return nil
+}
+
+// evictTinyLFU settles the oldest window entry of s while the window is over
+// its share, and otherwise evicts the main victim.
+func (c *ShardedCache) evictTinyLFU(s *cacheShard) bool {
+	if c.windowOver() && c.settleWindow(s) {
+		return true
+	}
+	victim := c.clockVictim(s)
+	if victim == nil {
+		victim = s.window.Back()
+	}
+	if victim == nil {
+		return false
+	}
+	c.evict(s, victim)
+	return true
+}
+
+func (c *ShardedCache) windowOver() bool {
+	return c.windowCount.Load() > c.windowCap || c.windowBytes.Load() > c.windowMax
+}
+
+// settleWindow moves the oldest window entry of s into the main region. Once
+// the main region is full, the entry only gets in by evicting a main victim
+// requested less often than itself. It reports false if the window of s is
+// empty, the excess being in other shards.
+func (c *ShardedCache) settleWindow(s *cacheShard) bool {
+	candidate := s.window.Back()
+	if candidate == nil {
+		return false
+	}
+	windowCount, windowBytes := c.windowCount.Load(), c.windowBytes.Load()
+	mainFull := c.count.Load()-windowCount >= c.capacity-c.windowCap || c.bytes.Load()-windowBytes >= c.maxBytes-c.windowMax
+	victim := c.clockVictim(s)
+	switch {
+	case !mainFull || victim == nil:
+		c.promote(s, candidate)
+	case c.admission.estimate(candidate.Value.(*shardEntry).item.Key) > c.admission.estimate(victim.Value.(*shardEntry).item.Key):
+		c.admitted.Add(1)
+		c.evict(s, victim)
+		c.promote(s, candidate)
+	default:
+		c.rejected.Add(1)
+		c.evict(s, candidate)
+	}
+	return true
+}
+
+// promote moves a window entry to the front of the main region.
+func (c *ShardedCache) promote(s *cacheShard, ent *list.Element) {
+	e := ent.Value.(*shardEntry)
+	s.window.Remove(ent)
+	c.windowCount.Add(-1)
+	c.windowBytes.Add(-e.item.SizeBytes)
+	e.window = false
+	s.items[e.item.Key] = s.evictList.PushFront(e)
+}
+
+func (c *ShardedCache) evict(s *cacheShard, ent *list.Element) {
+	item := ent.Value.(*shardEntry).item
+	c.remove(s, ent)
+	c.evictions.Add(1)
+	if c.onEvict != nil {
+		c.onEvict(item)
+	}
+}
+
+// liveItems returns the live entries, least recently used first within each
+// shard.
+func (c *ShardedCache) liveItems() []CacheItem {
+	now := time.Now()
+	var out []CacheItem
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.RLock()
+		for _, l := range []*list.List{s.evictList, s.window} {
+			for ent := l.Back(); ent != nil; ent = ent.Prev() {
+				if item := ent.Value.(*shardEntry).item; now.Before(item.ExpiresAt) {
+					out = append(out, *item)
+				}
+			}
+		}
+		s.RUnlock()
+	}
+	return out
+}
+
+func (c *ShardedCache) entries(tier string, match func(key string) bool) []cacheEntryInfo {
+	var out []cacheEntryInfo
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.RLock()
+		for key, ent := range s.items {
+			if match(key) {
+				item := ent.Value.(*shardEntry).item
+				out = append(out, cacheEntryInfo{Key: key, Tier: tier, Bytes: item.SizeBytes, ExpiresAt: item.ExpiresAt})
+			}
+		}
+		s.RUnlock()
+	}
+	return out
+}
+
+func (c *ShardedCache) snapshot() map[string]int64 {
+	var hits, misses int64
+	for i := range c.shards {
+		hits += c.shards[i].hits.Load()
+		misses += c.shards[i].misses.Load()
+	}
+	return map[string]int64{
+		"entries":   c.count.Load(),
+		"capacity":  c.capacity,
+		"bytes":     c.bytes.Load(),
+		"maxBytes":  c.maxBytes,
+		"shards":    int64(len(c.shards)),
+		"hits":      hits,
+		"misses":    misses,
+		"expired":   c.expired.Load(),
+		"evictions": c.evictions.Load(),
+		"purged":    c.purged.Load(),
+		"stale":     c.stale.Load(),
+		"window":    c.windowCount.Load(),
+		"admitted":  c.admitted.Load(),
+		"rejected":  c.rejected.Load(),
+	}
+}
+
+// policySnapshot reports the hit ratio of the cache, and of the shadow when
+// one runs.
+func (c *ShardedCache) policySnapshot() map[string]interface{} {
+	stats := c.snapshot()
+	out := map[string]interface{}{
+		"policy":   c.policy(),
+		"hits":     stats["hits"],
+		"misses":   stats["misses"],
+		"hitRatio": hitRatio(stats["hits"], stats["misses"]),
+	}
+	if c.shadow != nil {
+		out["shadow"] = c.shadow.policySnapshot()
+	}
+	return out
+}
+
+func hitRatio(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Each workload hits a warm cache from benchParallelism goroutines per
+// GOMAXPROCS, roughly the proxy's concurrency; a workload's writes are the
+// share of Gets followed by a Set (a miss being filled). Use -cpu to compare
+// core counts:
+//
+//	go test -run '^$' -bench . -cpu 1,4,16
+
+type benchCache interface {
+	Get(key string) ([]byte, http.Header, bool)
+	Set(key string, data []byte, headers http.Header, ttl time.Duration)
+}
+
+const (
+	benchKeys        = 4096
+	benchParallelism = 32
+
+	simCapacity  = 1000
+	simLiveKeys  = 800 // Popular segments, Zipf distributed
+	simRequests  = 200000
+	simScanShare = 0.3 // Share of requests for segments nobody asks for again
+)
+
+var benchWorkloads = []struct {
+	name     string
+	setEvery int
+}{{"read-only", 0}, {"10%-writes", 10}, {"50%-writes", 2}}
+
+func benchmarkCache(b *testing.B, c benchCache, setEvery int) {
+	keys := make([]string, benchKeys)
+	data := make([]byte, 4096)
+	h := http.Header{"Content-Type": {"video/mp2t"}, "Etag": {`"abc"`}}
+	for i := range keys {
+		keys[i] = "source|https://cdn.example.com/hls/" + strconv.Itoa(i) + ".ts"
+		c.Set(keys[i], data, h, time.Hour)
+	}
+	var seed atomic.Int64
+	b.ReportAllocs()
+	b.SetParallelism(benchParallelism)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(seed.Add(1)))
+		for n := 0; pb.Next(); n++ {
+			key := keys[r.Intn(len(keys))]
+			if _, _, ok := c.Get(key); !ok || (setEvery > 0 && n%setEvery == 0) {
+				c.Set(key, data, h, time.Hour)
+			}
+		}
+	})
+}
+
+func BenchmarkLRUCache(b *testing.B) {
+	for _, w := range benchWorkloads {
+		b.Run(w.name, func(b *testing.B) {
+			benchmarkCache(b, NewLRUCache(benchKeys*2, MaxCacheBytes), w.setEvery)
+		})
+	}
+}
+
+func BenchmarkShardedCache(b *testing.B) {
+	for _, w := range benchWorkloads {
+		b.Run(w.name, func(b *testing.B) {
+			benchmarkCache(b, NewShardedCache(DefaultCacheShards, benchKeys*2, MaxCacheBytes), w.setEvery)
+		})
+	}
+}
+
+// BenchmarkHitRatio compares the admission policies on a shared live working
+// set while one viewer seeks through a long VOD. It reports the hit ratio of
+// the live requests.
+func BenchmarkHitRatio(b *testing.B) {
+	for _, policy := range []string{"clock", "tinylfu"} {
+		b.Run(policy, func(b *testing.B) {
+			var ratio float64
+			for i := 0; i < b.N; i++ {
+				c := NewShardedCache(DefaultCacheShards, simCapacity, MaxCacheBytes)
+				if policy == "tinylfu" {
+					c.enableTinyLFU()
+				}
+				ratio = simulateHitRatio(c)
+			}
+			b.ReportMetric(100*ratio, "live-hit-%")
+		})
+	}
+}
+
+// simulateHitRatio replays live viewers mixed with a VOD scan and returns
+// the hit ratio of the live requests.
+func simulateHitRatio(c *ShardedCache) float64 {
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.1, 1, simLiveKeys-1)
+	var hits, live, scan int
+	for i := 0; i < simRequests; i++ {
+		key := "live|" + strconv.FormatUint(zipf.Uint64(), 10)
+		isLive := r.Float64() >= simScanShare
+		if !isLive {
+			scan++
+			key = "vod|" + strconv.Itoa(scan)
+		}
+		_, _, ok := c.Get(key)
+		if isLive {
+			live++
+			if ok {
+				hits++
+			}
+		}
+		if !ok {
+			c.Set(key, nil, nil, time.Hour)
+		}
+	}
+	return float64(hits) / float64(live)
+}
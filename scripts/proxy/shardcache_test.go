@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShardedCacheGetSet(t *testing.T) {
+	c := NewShardedCache(DefaultCacheShards, 100, MaxCacheBytes)
+	c.Set("a", []byte("1"), nil, time.Hour)
+	if data, _, ok := c.Get("a"); !ok || string(data) != "1" {
+		t.Fatalf("Get(a) = %q, %v", data, ok)
+	}
+	c.Set("a", []byte("22"), nil, time.Hour)
+	if data, _, _ := c.Get("a"); string(data) != "22" {
+		t.Errorf("replaced Get(a) = %q", data)
+	}
+	if _, _, ok := c.Get("missing"); ok {
+		t.Error("Get(missing) hit")
+	}
+	c.Set("expired", []byte("x"), nil, -time.Second)
+	if _, _, ok := c.Get("expired"); ok || c.Peek("expired") {
+		t.Error("expired entry served")
+	}
+	c.Delete("a")
+	if _, _, ok := c.Get("a"); ok {
+		t.Error("deleted entry served")
+	}
+}
+
+func TestShardedCacheBudgets(t *testing.T) {
+	c := NewShardedCache(8, 50, MaxCacheBytes)
+	for i := 0; i < 500; i++ {
+		c.Set(strconv.Itoa(i), []byte("x"), nil, time.Hour)
+	}
+	if n := c.count.Load(); n != 50 {
+		t.Errorf("%d entries, capacity 50", n)
+	}
+
+	c = NewShardedCache(8, 1000, 1000)
+	for i := 0; i < 100; i++ {
+		c.Set(strconv.Itoa(i), make([]byte, 100), nil, time.Hour)
+	}
+	if b := c.bytes.Load(); b > 1000 {
+		t.Errorf("%d bytes, budget 1000", b)
+	}
+}
+
+func TestShardedCacheSecondChance(t *testing.T) {
+	c := NewShardedCache(1, 3, MaxCacheBytes)
+	for _, k := range []string{"a", "b", "c"} {
+		c.Set(k, []byte(k), nil, time.Hour)
+	}
+	c.Get("a") // Referenced: survives the next eviction
+	c.Set("d", []byte("d"), nil, time.Hour)
+	for k, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if c.Peek(k) != want {
+			t.Errorf("Peek(%s) = %v, want %v", k, !want, want)
+		}
+	}
+}
+
+func TestShardedCacheGenerations(t *testing.T) {
+	c := NewShardedCache(4, 100, MaxCacheBytes)
+	gen := cacheGeneration.Load()
+	if !c.SetGen(gen, "src|a", []byte("1"), nil, time.Hour) {
+		t.Fatal("current generation rejected")
+	}
+	c.Set("other|b", []byte("2"), nil, time.Hour)
+	cacheGeneration.Add(1)
+	if n := c.Purge(func(k string) bool { return strings.HasPrefix(k, "src|") }); n != 1 {
+		t.Errorf("purged %d, want 1", n)
+	}
+	if c.SetGen(gen, "src|a", []byte("1"), nil, time.Hour) {
+		t.Error("fetch from before the purge stored")
+	}
+	if !c.Peek("other|b") || c.Peek("src|a") {
+		t.Error("purge matched the wrong keys")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ===== Cache Snapshot =====
+//
+// On graceful shutdown the segment cache is written to a snapshot file and
+// reloaded at the next start, so a redeploy doesn't send every viewer to the
+// upstreams at once. A metadata-only snapshot keeps keys, headers and expiry;
+// the bodies are then served from the disk tier (live entries are flushed to
+// it on shutdown). With -cache-snapshot-data the bodies go into the snapshot
+// itself.
+
+const cacheSnapshotVersion = 1
+
+type snapshotHeader struct {
+	Version  int
+	SavedAt  time.Time
+	WithData bool
+	Count    int
+}
+
+type snapshotEntry struct {
+	Key       string
+	Headers   http.Header
+	ExpiresAt time.Time
+	Data      []byte // Empty in metadata-only snapshots
+}
+
+// saveCacheSnapshot writes the live entries of cache to path atomically.
+func saveCacheSnapshot(cache *ShardedCache, path string, withData bool) (int, error) {
+	items := cache.liveItems()
+	if !withData && diskTier != nil {
+		for _, item := range items {
+			if err := diskTier.Put(item.Gen, item.Key, item.Data, item.Headers, item.ExpiresAt); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), diskTempPrefix+"snapshot-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+	w := bufio.NewWriter(tmp)
+	enc := gob.NewEncoder(w)
+	err = enc.Encode(snapshotHeader{Version: cacheSnapshotVersion, SavedAt: time.Now(), WithData: withData, Count: len(items)})
+	for i := 0; err == nil && i < len(items); i++ {
+		e := snapshotEntry{Key: items[i].Key, Headers: items[i].Headers, ExpiresAt: items[i].ExpiresAt}
+		if withData {
+			e.Data = items[i].Data
+		}
+		err = enc.Encode(e)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(items), os.Rename(tmp.Name(), path)
+}
+
+// loadCacheSnapshot restores the unexpired entries of a snapshot into cache.
+// Metadata-only entries are restored only if their body is in the disk tier.
+func loadCacheSnapshot(cache *ShardedCache, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	var hdr snapshotHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return 0, err
+	}
+	if hdr.Version != cacheSnapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", hdr.Version)
+	}
+	if !hdr.WithData && diskTier == nil {
+		return 0, errors.New("metadata-only snapshot needs the disk cache")
+	}
+
+	restored := 0
+	for i := 0; i < hdr.Count; i++ {
+		var e snapshotEntry
+		if err := dec.Decode(&e); err != nil {
+			return restored, err
+		}
+		ttl := time.Until(e.ExpiresAt)
+		if ttl <= 0 {
+			continue
+		}
+		data, h := e.Data, e.Headers
+		if !hdr.WithData {
+			d, ok := diskTier.Get(e.Key)
+			if !ok {
+				continue
+			}
+			data = d.Data
+		}
+		cache.Set(e.Key, data, h, ttl)
+		restored++
+	}
+	return restored, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withDiskTier installs a disk cache in a temporary directory, or none if
+// dir is "".
+func withDiskTier(t *testing.T, dir string) {
+	t.Helper()
+	old := diskTier
+	diskTier = nil
+	if dir != "" {
+		d, err := NewDiskCache(dir, 1<<20, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diskTier = d
+	}
+	t.Cleanup(func() { diskTier = old })
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	for _, withData := range []bool{true, false} {
+		dir := t.TempDir()
+		if withData {
+			withDiskTier(t, "")
+		} else {
+			withDiskTier(t, filepath.Join(dir, "disk"))
+		}
+		path := filepath.Join(dir, "cache.snapshot")
+
+		c := NewShardedCache(4, 100, MaxCacheBytes)
+		c.Set("live", []byte("segment"), http.Header{"Content-Type": {"video/mp2t"}}, time.Hour)
+		c.Set("expired", []byte("old"), nil, -time.Second)
+		if n, err := saveCacheSnapshot(c, path, withData); err != nil || n != 1 {
+			t.Fatalf("withData=%v: saved %d, %v", withData, n, err)
+		}
+
+		restored := NewShardedCache(4, 100, MaxCacheBytes)
+		if n, err := loadCacheSnapshot(restored, path); err != nil || n != 1 {
+			t.Fatalf("withData=%v: restored %d, %v", withData, n, err)
+		}
+		data, h, ok := restored.Get("live")
+		if !ok || string(data) != "segment" || h.Get("Content-Type") != "video/mp2t" {
+			t.Errorf("withData=%v: Get = %q, %v, %v", withData, data, h, ok)
+		}
+	}
+}
+
+func TestCacheSnapshotNeedsDiskTier(t *testing.T) {
+	dir := t.TempDir()
+	withDiskTier(t, filepath.Join(dir, "disk"))
+	path := filepath.Join(dir, "cache.snapshot")
+	c := NewShardedCache(4, 100, MaxCacheBytes)
+	c.Set("live", []byte("segment"), nil, time.Hour)
+	if _, err := saveCacheSnapshot(c, path, false); err != nil {
+		t.Fatal(err)
+	}
+
+	diskTier = nil
+	if _, err := loadCacheSnapshot(NewShardedCache(4, 100, MaxCacheBytes), path); err == nil {
+		t.Error("metadata-only snapshot loaded without a disk tier")
+	}
+
+	// Bodies evicted from the disk tier since are skipped.
+	withDiskTier(t, filepath.Join(dir, "empty"))
+	if n, err := loadCacheSnapshot(NewShardedCache(4, 100, MaxCacheBytes), path); err != nil || n != 0 {
+		t.Errorf("restored %d, %v without bodies", n, err)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ===== Target Policy =====
+//
+// Which upstreams the proxy may reach is set by the config's TargetPolicy:
+//
+//	"TargetPolicy": {
+//	  "allowedPorts": [80, 443, 8080, 8000, 9901],
+//	  "allowHosts": ["*.example.com"],  // If set, nothing else is allowed
+//	  "denyHosts": ["ads.example.com"],  // Checked first
+//	  "trustedCIDRs": ["192.168.1.20/32"]
+//	}
+//
+// URLs without a port are always allowed their scheme's default. Host globs
+// are path.Match patterns. Private, loopback and other non-public addresses
+// are refused unless they fall in a trusted CIDR, or the source opted in with
+// allowPrivate. URLs are checked when a request arrives and before every
+// upstream fetch and redirect; resolved addresses are checked when dialing,
+// for the moontv-source carried in the request context. A denial names the
+// rule that matched.
+
+var DefaultAllowedPorts = []int{80, 443, 8080}
+
+type TargetPolicy struct {
+	AllowedPorts []int    `json:"allowedPorts,omitempty"`
+	AllowHosts   []string `json:"allowHosts,omitempty"`
+	DenyHosts    []string `json:"denyHosts,omitempty"`
+	TrustedCIDRs []string `json:"trustedCIDRs,omitempty"`
+
+	trusted []*net.IPNet // Parsed TrustedCIDRs
+}
+
+// targetDenied is a target refused by the policy. kind labels the metric;
+// rule says what matched.
+type targetDenied struct {
+	kind, rule string
+}
+
+func (e *targetDenied) Error() string {
+	return "target denied: " + e.rule
+}
+
+func deny(kind, format string, args ...any) error {
+	targetDenials.with(kind).Inc()
+	return &targetDenied{kind: kind, rule: fmt.Sprintf(format, args...)}
+}
+
+// compile validates the policy and parses its CIDRs.
+func (p *TargetPolicy) compile() error {
+	for _, port := range p.AllowedPorts {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	for _, pattern := range append(slices.Clip(p.AllowHosts), p.DenyHosts...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("host pattern %q: %v", pattern, err)
+		}
+	}
+	p.trusted = nil
+	for _, cidr := range p.TrustedCIDRs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		p.trusted = append(p.trusted, block)
+	}
+	return nil
+}
+
+func matchHost(patterns []string, host string) (string, bool) {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// checkHost applies the port and host rules to host:port (port may be empty).
+func (p *TargetPolicy) checkHost(host, port string) error {
+	if port != "" {
+		allowed := p.AllowedPorts
+		if len(allowed) == 0 {
+			allowed = DefaultAllowedPorts
+		}
+		if n, err := strconv.Atoi(port); err != nil || !slices.Contains(allowed, n) {
+			return deny("port", "port %s not in allowedPorts %v", port, allowed)
+		}
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if pattern, ok := matchHost(p.DenyHosts, host); ok {
+		return deny("deny_host", "host %q matches denyHosts %q", host, pattern)
+	}
+	if len(p.AllowHosts) > 0 {
+		if _, ok := matchHost(p.AllowHosts, host); !ok {
+			return deny("allow_host", "host %q not in allowHosts", host)
+		}
+	}
+	return nil
+}
+
+// checkIP decides whether sourceKey may connect to ip.
+func (c *Config) checkIP(sourceKey string, ip net.IP) error {
+	for _, block := range c.TargetPolicy.trusted {
+		if block.Contains(ip) {
+			return nil
+		}
+	}
+	if c.sourceOptions(sourceKey).AllowPrivate && (ip.IsGlobalUnicast() || ip.IsLoopback()) {
+		return nil
+	}
+	if !ip.IsGlobalUnicast() {
+		return deny("non_unicast", "ip %s is not a unicast address", ip)
+	}
+	for _, block := range privateIPBlocks {
+		if block.Contains(ip) {
+			return deny("private_ip", "ip %s in private range %s (not in trustedCIDRs, source %q lacks allowPrivate)", ip, block, sourceKey)
+		}
+	}
+	return nil
+}
+
+// validateTargetURL checks a URL to be fetched for sourceKey.
+func (c *Config) validateTargetURL(sourceKey, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("invalid scheme")
+	}
+	if u.Hostname() == "" {
+		return errors.New("missing hostname")
+	}
+	if u.User != nil {
+		return errors.New("user info not allowed")
+	}
+	if err := c.TargetPolicy.checkHost(u.Hostname(), u.Port()); err != nil {
+		return err
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		return c.checkIP(sourceKey, ip)
+	}
+	return nil
+}
+
+// resolveAndPickSafeIP resolves host to an address the source in ctx may
+// reach, picked at random.
+func resolveAndPickSafeIP(ctx context.Context, host string) (net.IP, error) {
+	ips, err := resolveHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no resolved ip")
+	}
+	cfg, sourceKey := configOf(ctx), sourceKeyOf(ctx)
+	safeIPs := make([]net.IP, 0, len(ips))
+	var denied error
+	for _, ip := range ips {
+		if err := cfg.checkIP(sourceKey, ip); err != nil {
+			denied = err
+		} else {
+			safeIPs = append(safeIPs, ip)
+		}
+	}
+	if len(safeIPs) == 0 {
+		return nil, fmt.Errorf("ssrf blocked: no usable ip for %s: %w", host, denied)
+	}
+	return safeIPs[rand.Intn(len(safeIPs))], nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestValidateTargetURL(t *testing.T) {
+	withConfig(t, &Config{
+		LiveConfig: []LiveSource{{Key: "lan", SourceOptions: SourceOptions{AllowPrivate: true}}},
+		TargetPolicy: TargetPolicy{
+			AllowedPorts: []int{80, 443, 8443},
+			AllowHosts:   []string{"*.example.com", "192.168.*", "10.0.0.1", "127.0.0.1", "::1", "169.254.169.254"},
+			DenyHosts:    []string{"ads.example.com"},
+			TrustedCIDRs: []string{"192.168.1.0/24", "10.0.0.1"},
+		},
+	})
+	tests := []struct {
+		source, url string
+		kind        string // Denial kind, "" if allowed
+	}{
+		{"", "https://cdn.example.com/a.m3u8", ""},
+		{"", "https://cdn.example.com:8443/a.m3u8", ""},
+		{"", "https://CDN.Example.com./a.m3u8", ""},
+		{"", "https://cdn.example.com:8080/a.m3u8", "port"},
+		{"", "https://ads.example.com/a.ts", "deny_host"},
+		{"", "https://other.net/a.ts", "allow_host"},
+		{"", "http://192.168.1.20/a.ts", ""},
+		{"", "http://10.0.0.1/a.ts", ""},
+		{"", "http://192.168.2.1/a.ts", "private_ip"},
+		{"", "http://127.0.0.1/a.ts", "non_unicast"},
+		{"lan", "http://127.0.0.1/a.ts", ""},
+		{"lan", "http://192.168.2.1/a.ts", ""},
+		{"lan", "http://[::1]/a.ts", ""},
+		{"lan", "http://169.254.169.254/latest", "non_unicast"},
+	}
+	for _, tt := range tests {
+		err := getConfig().validateTargetURL(tt.source, tt.url)
+		var denied *targetDenied
+		switch {
+		case tt.kind == "" && err != nil:
+			t.Errorf("%s for %q: %v", tt.url, tt.source, err)
+		case tt.kind != "" && (!errors.As(err, &denied) || denied.kind != tt.kind):
+			t.Errorf("%s for %q: %v, want %s denial", tt.url, tt.source, err, tt.kind)
+		}
+	}
+
+	for _, bad := range []string{"ftp://cdn.example.com/a", "https:///a", "https://u:p@cdn.example.com/a", "://"} {
+		if err := getConfig().validateTargetURL("", bad); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+func TestTargetPolicyDefaults(t *testing.T) {
+	withConfig(t, &Config{})
+	for url, ok := range map[string]bool{
+		"https://cdn.example.com/a":      true,
+		"http://cdn.example.com:8080/a":  true,
+		"http://cdn.example.com:9000/a":  false,
+		"http://8.8.8.8/a":               true,
+		"http://172.16.0.1/a":            false,
+		"http://[fd00::1]/a":             false,
+		"http://0.0.0.0/a":               false,
+		"http://[::ffff:10.0.0.1]:8080/": false,
+	} {
+		if err := getConfig().validateTargetURL("", url); (err == nil) != ok {
+			t.Errorf("%s: %v, want ok %v", url, err, ok)
+		}
+	}
+}
+
+func TestTargetPolicyCompile(t *testing.T) {
+	for _, p := range []TargetPolicy{
+		{AllowedPorts: []int{0}},
+		{AllowedPorts: []int{65536}},
+		{AllowHosts: []string{"["}},
+		{DenyHosts: []string{"["}},
+		{TrustedCIDRs: []string{"10.0.0.0/33"}},
+		{TrustedCIDRs: []string{"not-an-ip"}},
+	} {
+		if err := p.compile(); err == nil {
+			t.Errorf("%+v compiled", p)
+		}
+	}
+	p := TargetPolicy{TrustedCIDRs: []string{"10.0.0.1", "fd00::1"}}
+	if err := p.compile(); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.trusted) != 2 || p.trusted[0].String() != "10.0.0.1/32" || p.trusted[1].String() != "fd00::1/128" {
+		t.Errorf("trusted = %v", p.trusted)
+	}
+}
+
+func TestResolvedAddressChecked(t *testing.T) {
+	withConfig(t, &Config{
+		LiveConfig: []LiveSource{
+			{Key: "pinned", SourceOptions: SourceOptions{Resolve: map[string][]string{"cdn.example.com": {"10.1.2.3"}}}},
+			{Key: "lan", SourceOptions: SourceOptions{AllowPrivate: true, Resolve: map[string][]string{"cdn.example.com": {"10.1.2.3"}}}},
+		},
+	})
+	if _, err := resolveAndPickSafeIP(withSourceKey(context.Background(), "pinned"), "cdn.example.com"); err == nil {
+		t.Error("private address resolved for a source without allowPrivate")
+	}
+	ip, err := resolveAndPickSafeIP(withSourceKey(context.Background(), "lan"), "cdn.example.com")
+	if err != nil || !ip.Equal(net.ParseIP("10.1.2.3")) {
+		t.Errorf("allowPrivate source: %v, %v", ip, err)
+	}
+}
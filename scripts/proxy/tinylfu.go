@@ -0,0 +1,98 @@
+package main
+
+import (
+	"hash/maphash"
+	"sync/atomic"
+)
+
+// ===== TinyLFU Admission =====
+//
+// With -cache-policy tinylfu the segment cache keeps a small window region
+// (TinyLFUWindowRatio of its budget) in front of the main CLOCK region. New
+// entries always enter the window, which each insert drains back to its
+// budget. Once the cache is full, the oldest window entry competes with the main region's eviction victim and only replaces it
+// if its key has been requested more often recently (W-TinyLFU). Someone
+// seeking through a long VOD produces keys requested once, which lose against
+// the live segments every other viewer keeps requesting.
+//
+// Request frequencies come from a count-min sketch of 4-bit counters that is
+// halved every tinyLFUSampleFactor × capacity requests, so popularity ages.
+
+const (
+	TinyLFUWindowRatio  = 0.01
+	tinyLFUSampleFactor = 10
+	tinyLFUDepth        = 4
+	tinyLFUMinWords     = 64
+)
+
+type frequencySketch struct {
+	table     []atomic.Uint64 // 16 4-bit counters per word
+	mask      uint64          // Number of counters - 1
+	seed      maphash.Seed
+	additions atomic.Int64
+	sample    int64
+}
+
+func newFrequencySketch(capacity int) *frequencySketch {
+	words := tinyLFUMinWords
+	for words < capacity {
+		words <<= 1
+	}
+	return &frequencySketch{table: make([]atomic.Uint64, words), mask: uint64(words*16 - 1), seed: maphash.MakeSeed(), sample: int64(capacity) * tinyLFUSampleFactor}
+}
+
+// index returns the i-th counter of key (double hashing).
+func (f *frequencySketch) index(h uint64, i int) uint64 {
+	return (h + uint64(i)*(h>>32|1)) & f.mask
+}
+
+func (f *frequencySketch) counter(idx uint64) uint64 {
+	return f.table[idx>>4].Load() >> ((idx & 15) * 4) & 15
+}
+
+// increment records one request for key.
+func (f *frequencySketch) increment(key string) {
+	h := maphash.String(f.seed, key)
+	added := false
+	for i := 0; i < tinyLFUDepth; i++ {
+		idx := f.index(h, i)
+		word, shift := &f.table[idx>>4], (idx&15)*4
+		for {
+			old := word.Load()
+			if old>>shift&15 == 15 {
+				break
+			}
+			if word.CompareAndSwap(old, old+1<<shift) {
+				added = true
+				break
+			}
+		}
+	}
+	if added && f.additions.Add(1) == f.sample {
+		f.age()
+	}
+}
+
+// estimate returns how often key was requested recently, at most 15.
+func (f *frequencySketch) estimate(key string) uint64 {
+	h := maphash.String(f.seed, key)
+	freq := uint64(15)
+	for i := 0; i < tinyLFUDepth; i++ {
+		freq = min(freq, f.counter(f.index(h, i)))
+	}
+	return freq
+}
+
+// age halves every counter. Only the request that reaches the sample size
+// calls it, so concurrent increments are merely rounded down.
+func (f *frequencySketch) age() {
+	for i := range f.table {
+		for {
+			old := f.table[i].Load()
+			if f.table[i].CompareAndSwap(old, old>>1&0x7777777777777777) {
+				break
+			}
+		}
+	}
+	f.additions.Add(-f.sample / 2)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFrequencySketch(t *testing.T) {
+	f := newFrequencySketch(100)
+	for i := 0; i < 20; i++ {
+		f.increment("hot")
+	}
+	for i := 0; i < 3; i++ {
+		f.increment("warm")
+	}
+	if got := f.estimate("hot"); got != 15 {
+		t.Errorf("estimate(hot) = %d, want 15 (saturated)", got)
+	}
+	if got := f.estimate("warm"); got != 3 {
+		t.Errorf("estimate(warm) = %d, want 3", got)
+	}
+	if got := f.estimate("cold"); got != 0 {
+		t.Errorf("estimate(cold) = %d, want 0", got)
+	}
+
+	f.age()
+	if hot, warm := f.estimate("hot"), f.estimate("warm"); hot != 7 || warm != 1 {
+		t.Errorf("after aging: hot %d, warm %d; want 7, 1", hot, warm)
+	}
+}
+
+func TestFrequencySketchAgesItself(t *testing.T) {
+	f := newFrequencySketch(1) // Ages every 10 additions
+	for i := 0; i < 9; i++ {
+		f.increment("k")
+	}
+	if got := f.estimate("k"); got != 9 {
+		t.Fatalf("estimate = %d before aging, want 9", got)
+	}
+	f.increment("k")
+	if got := f.estimate("k"); got != 5 {
+		t.Errorf("estimate = %d after the sample filled, want 5", got)
+	}
+	if got := f.additions.Load(); got != 5 {
+		t.Errorf("additions = %d after aging, want 5", got)
+	}
+}
+
+// request looks key up the way the segment handler does, filling it on a
+// miss.
+func request(c *ShardedCache, key string) bool {
+	if _, _, ok := c.Get(key); ok {
+		return true
+	}
+	c.Set(key, nil, nil, time.Hour)
+	return false
+}
+
+func TestTinyLFUAdmission(t *testing.T) {
+	c := NewShardedCache(1, 100, MaxCacheBytes)
+	c.enableTinyLFU()
+	for i := 0; i < 100; i++ {
+		key := "live|" + strconv.Itoa(i)
+		c.Get(key)
+		c.Get(key)
+		request(c, key)
+	}
+
+	// A key colliding with a live key in the sketch may rightly win, so scan
+	// with keys the sketch hasn't seen.
+	var scan []string
+	for i := 0; len(scan) < 11; i++ {
+		if key := "vod|" + strconv.Itoa(i); c.admission.estimate(key) == 0 {
+			scan = append(scan, key)
+		}
+	}
+	// The last live key leaves the window in a tie with the first victim.
+	request(c, scan[0])
+	before := c.snapshot()
+
+	// Keys requested once lose against the main region's victims.
+	for _, key := range scan[1:] {
+		request(c, key)
+	}
+	s := c.snapshot()
+	if admitted, rejected := s["admitted"]-before["admitted"], s["rejected"]-before["rejected"]; admitted != 0 || rejected != 10 {
+		t.Errorf("after a scan: admitted %d, rejected %d; want 0, 10", admitted, rejected)
+	}
+	kept := 0
+	for i := 0; i < 100; i++ {
+		if c.Peek("live|" + strconv.Itoa(i)) {
+			kept++
+		}
+	}
+	if kept < 99 {
+		t.Errorf("scan evicted popular entries: %d of 100 kept", kept)
+	}
+
+	// A key requested more often than the victim is admitted.
+	for i := 0; i < 10; i++ {
+		c.Get("popular")
+	}
+	request(c, "popular")
+	before = c.snapshot()
+	request(c, "vod|next") // Moves popular out of the window
+	if s := c.snapshot(); s["admitted"]-before["admitted"] != 1 || !c.Peek("popular") {
+		t.Errorf("popular key: admitted %d, cached %v", s["admitted"]-before["admitted"], c.Peek("popular"))
+	}
+	if c.count.Load() != 100 {
+		t.Errorf("%d entries, capacity 100", c.count.Load())
+	}
+}
+
+func TestTinyLFUWindowDrainsOnInsert(t *testing.T) {
+	c := NewShardedCache(8, 1000, MaxCacheBytes)
+	c.enableTinyLFU()
+	for i := 0; i < 500; i++ {
+		request(c, strconv.Itoa(i))
+		if n := c.windowCount.Load(); n > c.windowCap {
+			t.Fatalf("window holds %d entries after %d inserts, budget %d", n, i+1, c.windowCap)
+		}
+	}
+	// Half full: everything past the window was promoted, nothing evicted.
+	if s := c.snapshot(); s["entries"] != 500 || s["evictions"] != 0 || s["window"] != c.windowCap {
+		t.Errorf("half full: %v", s)
+	}
+}
+
+func TestTinyLFUKeepsPopularEntries(t *testing.T) {
+	c := NewShardedCache(1, 100, MaxCacheBytes)
+	c.enableTinyLFU()
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 50; i++ {
+			request(c, "live|"+strconv.Itoa(i))
+		}
+	}
+	for i := 0; i < 1000; i++ { // A scan of keys requested once
+		request(c, "vod|"+strconv.Itoa(i))
+	}
+	kept := 0
+	for i := 0; i < 50; i++ {
+		if c.Peek("live|" + strconv.Itoa(i)) {
+			kept++
+		}
+	}
+	if kept < 45 {
+		t.Errorf("scan evicted popular entries: %d of 50 kept", kept)
+	}
+	if c.count.Load() > 100 {
+		t.Errorf("%d entries, capacity 100", c.count.Load())
+	}
+}
+
+func TestShadowPolicy(t *testing.T) {
+	c := NewShardedCache(1, 100, MaxCacheBytes)
+	c.enableShadow()
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 50; i++ {
+			request(c, "live|"+strconv.Itoa(i))
+		}
+		for i := 0; i < 200; i++ {
+			request(c, "vod|"+strconv.Itoa(round)+"-"+strconv.Itoa(i))
+		}
+	}
+	stats := c.policySnapshot()
+	shadow, _ := stats["shadow"].(map[string]interface{})
+	if stats["policy"] != "clock" || shadow == nil || shadow["policy"] != "tinylfu" {
+		t.Fatalf("policySnapshot = %v", stats)
+	}
+	if shadow["hits"].(int64)+shadow["misses"].(int64) != stats["hits"].(int64)+stats["misses"].(int64) {
+		t.Errorf("shadow saw %v lookups, cache %v", shadow, stats)
+	}
+	// The live keys survive each scan only under TinyLFU.
+	if shadow["hitRatio"].(float64) <= stats["hitRatio"].(float64) {
+		t.Errorf("shadow hit ratio %v, cache %v", shadow["hitRatio"], stats["hitRatio"])
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ===== Tracing =====
+//
+// Requests are traced when -otlp-endpoint (or OTEL_EXPORTER_OTLP_ENDPOINT) is
+// set, and spans are exported in batches as OTLP/HTTP JSON to its
+// /v1/traces. Spans cover admission to globalSem, cache lookups, waits for
+// a coalesced fetch, every upstream attempt (with DNS and connect child spans
+// from httptrace and a TLS span from the dialer) and streaming the response.
+// Incoming W3C traceparent headers are honored: the request joins the
+// caller's trace and follows its sampling decision. Other requests are
+// sampled at -trace-sample.
+//
+// startSpan returns a nil span when the request isn't recorded; all span
+// methods are no-ops on nil, so call sites need no checks.
+
+const (
+	traceQueueSize     = 4096
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+	traceExportTimeout = 10 * time.Second
+
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+type traceSpan struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	name     string
+	kind     int
+	start    time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs map[string]any
+	err   string
+}
+
+type traceSpanKey struct{}
+
+type traceExporter struct {
+	endpoint string
+	service  string
+	sample   float64
+	client   *http.Client
+	spans    chan *traceSpan
+	stop     chan struct{}
+	done     chan struct{}
+
+	exported, dropped, failed atomic.Int64
+}
+
+var tracer *traceExporter // nil when tracing is disabled
+
+func newTraceExporter(endpoint, service string, sample float64) *traceExporter {
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	t := &traceExporter{
+		endpoint: endpoint,
+		service:  service,
+		sample:   sample,
+		client:   &http.Client{Timeout: traceExportTimeout},
+		spans:    make(chan *traceSpan, traceQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.loop()
+	return t
+}
+
+func spanFromContext(ctx context.Context) *traceSpan {
+	s, _ := ctx.Value(traceSpanKey{}).(*traceSpan)
+	return s
+}
+
+// startSpan starts a child of the span in ctx, or a new sampled-or-not root.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *traceSpan) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &traceSpan{name: name, kind: kind, start: time.Now()}
+	if parent := spanFromContext(ctx); parent != nil {
+		if !parent.sampled {
+			return ctx, nil
+		}
+		s.traceID, s.parentID, s.sampled = parent.traceID, parent.spanID, true
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = tracer.sample >= 1 || float64(s.traceID[0])/math.MaxUint8 < tracer.sample
+	}
+	rand.Read(s.spanID[:])
+	ctx = context.WithValue(ctx, traceSpanKey{}, s)
+	if !s.sampled {
+		return ctx, nil
+	}
+	return ctx, s
+}
+
+// startServerSpan starts the span of an incoming request, continuing the
+// trace of a valid traceparent header.
+func startServerSpan(r *http.Request, name string) (context.Context, *traceSpan) {
+	ctx := r.Context()
+	if tracer == nil {
+		return ctx, nil
+	}
+	if parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		ctx = context.WithValue(ctx, traceSpanKey{}, parent)
+	}
+	return startSpan(ctx, name, spanKindServer)
+}
+
+// parseTraceparent parses a version 00 W3C traceparent header.
+func parseTraceparent(h string) (*traceSpan, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, false
+	}
+	s := &traceSpan{}
+	flags, err := hex.DecodeString(parts[3])
+	if _, e1 := hex.Decode(s.traceID[:], []byte(parts[1])); e1 != nil || err != nil {
+		return nil, false
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil {
+		return nil, false
+	}
+	if s.traceID == [16]byte{} || s.spanID == [8]byte{} {
+		return nil, false
+	}
+	s.sampled = flags[0]&1 == 1
+	return s, true
+}
+
+func (s *traceSpan) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]any)
+	}
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+func (s *traceSpan) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = redactError(err)
+	s.mu.Unlock()
+}
+
+func (s *traceSpan) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt ends the span at t and queues it for export.
+func (s *traceSpan) EndAt(t time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	ended := !s.end.IsZero()
+	if !ended {
+		s.end = t
+	}
+	s.mu.Unlock()
+	if ended {
+		return
+	}
+	select {
+	case tracer.spans <- s:
+	default:
+		tracer.dropped.Add(1)
+	}
+}
+
+// child records a finished child span with explicit timestamps.
+func (s *traceSpan) child(name string, start, end time.Time) *traceSpan {
+	if s == nil {
+		return nil
+	}
+	c := &traceSpan{traceID: s.traceID, parentID: s.spanID, sampled: true, name: name, kind: spanKindInternal, start: start}
+	rand.Read(c.spanID[:])
+	c.EndAt(end)
+	return c
+}
+
+// attemptTrace records dial timings of an upstream attempt as child spans of
+// span. The TLS span comes from guardedDialTLSContext.
+func attemptTrace(ctx context.Context, span *traceSpan) context.Context {
+	if span == nil {
+		return ctx
+	}
+	var mu sync.Mutex
+	var dnsStart, connectStart time.Time
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStart = time.Now()
+			mu.Unlock()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			span.child("dns", dnsStart, time.Now()).SetError(info.Err)
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			connectStart = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			c := span.child("connect", connectStart, time.Now())
+			c.SetAttr("net.peer.addr", addr)
+			c.SetError(err)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			span.SetAttr("net.conn.reused", info.Reused)
+		},
+		GotFirstResponseByte: func() {
+			span.SetAttr("http.ttfb_ms", time.Since(span.start).Milliseconds())
+		},
+	})
+}
+
+func (t *traceExporter) loop() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	var batch []*traceSpan
+	for {
+		select {
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) >= traceBatchSize {
+				t.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				t.export(batch)
+				batch = nil
+			}
+		case <-t.stop:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					if len(batch) > 0 {
+						t.export(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// shutdown exports the queued spans, waiting at most until ctx is done.
+func (t *traceExporter) shutdown(ctx context.Context) {
+	close(t.stop)
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+	}
+}
+
+// OTLP/JSON encoding of ExportTraceServiceRequest.
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func otlpAttribute(key string, v any) otlpAttr {
+	a := otlpAttr{Key: key}
+	switch v := v.(type) {
+	case string:
+		a.Value.StringValue = &v
+	case bool:
+		a.Value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.IntValue = &s
+	case float64:
+		a.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+func (s *traceSpan) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for k, v := range s.attrs {
+		o.Attributes = append(o.Attributes, otlpAttribute(k, v))
+	}
+	if s.err != "" {
+		o.Status.Code, o.Status.Message = 2, s.err
+	}
+	return o
+}
+
+func (t *traceExporter) export(batch []*traceSpan) {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = s.otlp()
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource":   map[string]any{"attributes": []otlpAttr{otlpAttribute("service.name", t.service)}},
+			"scopeSpans": []any{map[string]any{"scope": map[string]string{"name": "lunatv-proxy"}, "spans": spans}},
+		}},
+	})
+	if err != nil {
+		t.failed.Add(int64(len(batch)))
+		return
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		t.failed.Add(int64(len(batch)))
+		slog.Warn("trace export failed", "endpoint", redactURL(t.endpoint), "spans", len(batch), "err", err)
+		return
+	}
+	t.exported.Add(int64(len(batch)))
+}
+
+func (t *traceExporter) snapshot() map[string]int64 {
+	return map[string]int64{
+		"queued":   int64(len(t.spans)),
+		"exported": t.exported.Load(),
+		"dropped":  t.dropped.Load(),
+		"failed":   t.failed.Load(),
+	}
+}
+
+// streamBody copies body to w inside a response.stream span.
+func streamBody(ctx context.Context, w io.Writer, body io.Reader) {
+	_, span := startSpan(ctx, "response.stream", spanKindInternal)
+	n, err := io.Copy(w, body)
+	span.SetAttr("bytes", n)
+	span.SetError(err)
+	span.End()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// withTracer records every request and returns the queue spans are sent to.
+func withTracer(t *testing.T) chan *traceSpan {
+	t.Helper()
+	old := tracer
+	tracer = &traceExporter{sample: 1, spans: make(chan *traceSpan, 16)}
+	t.Cleanup(func() { tracer = old })
+	return tracer.spans
+}
+
+func TestDialTLSRecordsSpan(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+	withConfig(t, &Config{
+		LiveConfig:   []LiveSource{{Key: testSource, SourceOptions: SourceOptions{AllowPrivate: true}}},
+		TargetPolicy: TargetPolicy{AllowedPorts: []int{port}},
+	})
+	spans := withTracer(t)
+
+	ctx, parent := startSpan(withSourceKey(context.Background(), testSource), "upstream.attempt", spanKindClient)
+	base := srv.Client().Transport.(*http.Transport).TLSClientConfig
+	var d net.Dialer
+	conn, err := guardedDialTLSContext(d.DialContext, base)(ctx, "tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	s := <-spans
+	if s.name != "tls" || s.parentID != parent.spanID || s.traceID != parent.traceID {
+		t.Errorf("span %q, parent %x; want tls under %x", s.name, s.parentID, parent.spanID)
+	}
+	if s.err != "" || s.end.IsZero() {
+		t.Errorf("span err %q, ended %v", s.err, !s.end.IsZero())
+	}
+
+	// A failed handshake is recorded with its error.
+	if _, err := guardedDialTLSContext(d.DialContext, nil)(ctx, "tcp", u.Host); err == nil {
+		t.Fatal("untrusted certificate accepted")
+	}
+	if s := <-spans; s.name != "tls" || s.err == "" {
+		t.Errorf("failed handshake span %q, err %q", s.name, s.err)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	const trace, span = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	tests := map[string]bool{
+		"00-" + trace + "-" + span + "-01":                    true,
+		"00-" + trace + "-" + span + "-00":                    true,
+		" 00-" + trace + "-" + span + "-01 ":                  true,
+		"01-" + trace + "-" + span + "-01":                    false,
+		"00-" + trace + "-" + span:                            false,
+		"00-" + trace[1:] + "-" + span + "-01":                false,
+		"00-" + strings.Repeat("0", 32) + "-" + span + "-01":  false,
+		"00-" + trace + "-" + strings.Repeat("0", 16) + "-01": false,
+		"00-" + trace + "-" + span + "-zz":                    false,
+	}
+	for h, ok := range tests {
+		s, got := parseTraceparent(h)
+		if got != ok {
+			t.Errorf("parseTraceparent(%q) ok = %v", h, got)
+			continue
+		}
+		if ok && (hex.EncodeToString(s.traceID[:]) != trace || hex.EncodeToString(s.spanID[:]) != span || s.sampled != strings.HasSuffix(strings.TrimSpace(h), "1")) {
+			t.Errorf("parseTraceparent(%q) = %x %x sampled %v", h, s.traceID, s.spanID, s.sampled)
+		}
+	}
+}
+
+func TestServerSpanJoinsTrace(t *testing.T) {
+	withTracer(t)
+	const trace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	for flags, sampled := range map[string]bool{"01": true, "00": false} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("traceparent", "00-"+trace+"-00f067aa0ba902b7-"+flags)
+		_, s := startServerSpan(r, "segment")
+		if (s != nil) != sampled {
+			t.Errorf("flags %s: span %v", flags, s)
+		}
+		if s != nil && hex.EncodeToString(s.traceID[:]) != trace {
+			t.Errorf("span joined trace %x", s.traceID)
+		}
+	}
+}